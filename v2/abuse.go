@@ -0,0 +1,336 @@
+package paypal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var ErrBadAbuseProtectionConfig error = errors.New("paypal: bad abuse protection config")
+
+// Entries kept by a limiter or the negative cache before the stale ones are dropped
+const maxProtectionEntries = 1 << 16
+
+// AbuseProtectionConfig is the "abuseProtection" of initConf, in JSON. Zero values take the defaults.
+//
+// The callback endpoints are public, and a single approve costs a GetOrder with PayPal and several
+// database queries. Requests beyond the limits get 429 RATE_LIMITED with a Retry-After, bodies beyond
+// MaxBodyBytes get 413 REQUEST_TOO_LARGE. 400, 404 and 410 responses are answered again from the
+// negative cache for NegativeCacheTTL to the same request, without asking PayPal or the database.
+// The webhook endpoints only get their own cap, MaxWebhookBodyBytes, see protectedWebhook().
+type AbuseProtectionConfig struct {
+	PerIP RateLimit `json:"per_ip"` // Defaults to 5 per second, bursts of 20
+	// Keyed by the ReferenceID, or the OrderID PayPal returns the payer with. Defaults to 1 per second, bursts of 10.
+	PerReference     RateLimit `json:"per_reference"`
+	MaxBodyBytes     int64     `json:"max_body_bytes"`     // Negative disables the cap. Defaults to 16384.
+	NegativeCacheTTL string    `json:"negative_cache_ttl"` // Negative disables the cache. Defaults to 30s.
+
+	MaxWebhookBodyBytes int64 `json:"max_webhook_body_bytes"` // Negative disables the cap. Defaults to 262144.
+}
+
+// RateLimit is a token bucket: Rate requests per second, up to Burst at once. A negative Rate disables it.
+type RateLimit struct {
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+}
+
+// abuseProtection guards the callback endpoints. A nil limiter or cache lets everything through.
+type abuseProtection struct {
+	perIP        *keyedLimiter
+	perReference *keyedLimiter
+	maxBodyBytes int64 // 0 for no cap
+	negative     *negativeCache
+
+	maxWebhookBodyBytes int64 // 0 for no cap
+}
+
+// build() validates the config and fills in the defaults.
+func (c AbuseProtectionConfig) build() (*abuseProtection, error) {
+	perIP, err := c.PerIP.limiter("per_ip", RateLimit{Rate: 5, Burst: 20})
+	if err != nil {
+		return nil, err
+	}
+	perReference, err := c.PerReference.limiter("per_reference", RateLimit{Rate: 1, Burst: 10})
+	if err != nil {
+		return nil, err
+	}
+	p := &abuseProtection{perIP: perIP, perReference: perReference, maxBodyBytes: c.MaxBodyBytes, maxWebhookBodyBytes: c.MaxWebhookBodyBytes}
+	if p.maxBodyBytes == 0 {
+		p.maxBodyBytes = 16 << 10
+	} else if p.maxBodyBytes < 0 {
+		p.maxBodyBytes = 0
+	}
+	if p.maxWebhookBodyBytes == 0 {
+		p.maxWebhookBodyBytes = 256 << 10
+	} else if p.maxWebhookBodyBytes < 0 {
+		p.maxWebhookBodyBytes = 0
+	}
+
+	ttl := 30 * time.Second
+	if c.NegativeCacheTTL != "" {
+		if ttl, err = time.ParseDuration(c.NegativeCacheTTL); err != nil {
+			return nil, fmt.Errorf("%w: negative_cache_ttl %q", ErrBadAbuseProtectionConfig, c.NegativeCacheTTL)
+		}
+	}
+	if ttl > 0 {
+		p.negative = &negativeCache{ttl: ttl, entries: map[string]negativeEntry{}}
+	}
+	return p, nil
+}
+
+func (r RateLimit) limiter(name string, defaults RateLimit) (*keyedLimiter, error) {
+	if r.Rate < 0 {
+		return nil, nil
+	}
+	if r.Rate == 0 {
+		r.Rate = defaults.Rate
+	}
+	if r.Burst == 0 {
+		r.Burst = defaults.Burst
+	}
+	if r.Burst < 0 || math.IsInf(r.Rate, 0) || math.IsNaN(r.Rate) {
+		return nil, fmt.Errorf("%w: %s rate %v burst %d", ErrBadAbuseProtectionConfig, name, r.Rate, r.Burst)
+	}
+	return &keyedLimiter{rate: r.Rate, burst: float64(r.Burst), buckets: map[string]*tokenBucket{}}, nil
+}
+
+// keyedLimiter is a token bucket per key, e.g. per IP.
+type keyedLimiter struct {
+	rate  float64
+	burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// allow() takes a token from the bucket of key. If there is none, tells how long until there is.
+func (l *keyedLimiter) allow(key string) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= maxProtectionEntries {
+			l.sweep(now)
+		}
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// sweep() drops the buckets refilled by now, which are no different from new ones. If they all are
+// in use, all are dropped: letting a flood of keys through beats growing without bounds.
+func (l *keyedLimiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+	if len(l.buckets) >= maxProtectionEntries {
+		l.buckets = map[string]*tokenBucket{}
+	}
+}
+
+// negativeCache keeps 400, 404 and 410 responses for ttl, by request.
+type negativeCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]negativeEntry
+}
+
+type negativeEntry struct {
+	status      int
+	contentType string
+	location    string
+	body        []byte
+	expires     time.Time
+}
+
+func (nc *negativeCache) get(key string) (negativeEntry, bool) {
+	if nc == nil {
+		return negativeEntry{}, false
+	}
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	e, ok := nc.entries[key]
+	if ok && time.Now().After(e.expires) {
+		delete(nc.entries, key)
+		return negativeEntry{}, false
+	}
+	return e, ok
+}
+
+func (nc *negativeCache) put(key string, e negativeEntry) {
+	if nc == nil {
+		return
+	}
+	now := time.Now()
+	e.expires = now.Add(nc.ttl)
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	if len(nc.entries) >= maxProtectionEntries {
+		for k, old := range nc.entries {
+			if now.After(old.expires) {
+				delete(nc.entries, k)
+			}
+		}
+		if len(nc.entries) >= maxProtectionEntries {
+			nc.entries = map[string]negativeEntry{}
+		}
+	}
+	nc.entries[key] = e
+}
+
+// Set by redirectReturn() to the status of a result sent as a redirect
+const callbackStatusKey = "paypal.callback_status"
+
+func negativeStatus(status int) bool {
+	return status == http.StatusBadRequest || status == http.StatusNotFound || status == http.StatusGone
+}
+
+// recordingWriter keeps what a handler writes, up to maxLoggedErrorBody, for the negative cache.
+type recordingWriter struct {
+	gin.ResponseWriter
+	body      bytes.Buffer
+	truncated bool
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	w.record(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *recordingWriter) WriteString(s string) (int, error) {
+	w.record([]byte(s))
+	return w.ResponseWriter.WriteString(s)
+}
+
+func (w *recordingWriter) record(b []byte) {
+	if w.body.Len()+len(b) > maxLoggedErrorBody {
+		w.truncated = true
+		return
+	}
+	w.body.Write(b)
+}
+
+// protected() puts a callback endpoint behind the rate limits, the body size cap and the negative cache.
+func (pg *PrepaidGateway) protected(endpoint string, handler gin.HandlerFunc) func(*gin.Context) {
+	return func(c *gin.Context) {
+		p := pg.abuse
+		if p == nil {
+			handler(c)
+			return
+		}
+
+		ip := c.ClientIP()
+		if ok, wait := p.perIP.allow(ip); !ok {
+			pg.rateLimited(c, endpoint, wait, "ip", ip)
+			return
+		}
+
+		if p.maxBodyBytes > 0 && c.Request.Body != nil {
+			if c.Request.ContentLength > p.maxBodyBytes {
+				pg.respondCallback(c, endpoint, http.StatusRequestEntityTooLarge, REQUEST_TOO_LARGE)
+				return
+			}
+			c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, p.maxBodyBytes)
+		}
+		// The form is part of the negative cache key
+		if err := c.Request.ParseForm(); err != nil { // Too large after all, or malformed
+			pg.respondCallback(c, endpoint, http.StatusBadRequest, BAD_REQUEST)
+			return
+		}
+
+		if ref := protectionKey(c); ref != "" {
+			if ok, wait := p.perReference.allow(endpoint + "\x00" + ref); !ok {
+				pg.rateLimited(c, endpoint, wait, "ReferenceID", ref)
+				return
+			}
+		}
+
+		key := endpoint + "\x00" + c.Request.Method + "\x00" + c.Request.URL.RequestURI() + "\x00" + c.Request.PostForm.Encode()
+		if e, ok := p.negative.get(key); ok {
+			pg.log.Debug("callback answered from negative cache", "endpoint", endpoint, "ip", ip, "status", e.status)
+			if e.location != "" {
+				c.Header("Location", e.location)
+			}
+			c.Data(e.status, e.contentType, e.body)
+			return
+		}
+
+		w := &recordingWriter{ResponseWriter: c.Writer}
+		c.Writer = w
+		handler(c)
+		c.Writer = w.ResponseWriter
+
+		status := w.Status()
+		if redirected := c.GetInt(callbackStatusKey); redirected != 0 {
+			status = redirected
+		}
+		if negativeStatus(status) && !w.truncated {
+			p.negative.put(key, negativeEntry{
+				status:      w.Status(),
+				contentType: w.Header().Get("Content-Type"),
+				location:    w.Header().Get("Location"),
+				body:        w.body.Bytes(),
+			})
+		}
+	}
+}
+
+// protectedWebhook() only caps the body of webhook events. PayPal delivers them in bursts from a few IPs,
+// all to the same URL and without a form, so the rate limits and the negative cache would turn its genuine
+// events away after one bad request. Their signature is verified with PayPal instead.
+func (pg *PrepaidGateway) protectedWebhook(endpoint string, handler gin.HandlerFunc) func(*gin.Context) {
+	return func(c *gin.Context) {
+		if p := pg.abuse; p != nil && p.maxWebhookBodyBytes > 0 && c.Request.Body != nil {
+			if c.Request.ContentLength > p.maxWebhookBodyBytes {
+				pg.respondCallback(c, endpoint, http.StatusRequestEntityTooLarge, REQUEST_TOO_LARGE)
+				return
+			}
+			c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, p.maxWebhookBodyBytes)
+		}
+		handler(c)
+	}
+}
+
+// protectionKey() is what the per-ReferenceID limit applies to: the ReferenceID, or the OrderID PayPal returns the payer with.
+func protectionKey(c *gin.Context) string {
+	if ReferenceID := c.Param("ref_id"); ReferenceID != "" {
+		return ReferenceID
+	}
+	if ReferenceID := c.PostForm("ref_id"); ReferenceID != "" {
+		return ReferenceID
+	}
+	return c.Query("token")
+}
+
+func (pg *PrepaidGateway) rateLimited(c *gin.Context, endpoint string, wait time.Duration, keysAndValues ...interface{}) {
+	pg.log.Warn("callback rate limited", append([]interface{}{"endpoint", endpoint}, keysAndValues...)...)
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	pg.respondCallback(c, endpoint, http.StatusTooManyRequests, RATE_LIMITED)
+}
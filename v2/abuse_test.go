@@ -0,0 +1,73 @@
+package paypal
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestKeyedLimiter(t *testing.T) {
+	tests := []struct {
+		name  string
+		rate  float64
+		burst float64
+		keys  []string
+		want  []bool
+	}{
+		{"burst then limited", 1, 3, []string{"a", "a", "a", "a"}, []bool{true, true, true, false}},
+		{"keys have their own bucket", 1, 1, []string{"a", "b", "a", "b", "c"}, []bool{true, true, false, false, true}},
+		{"no burst allows nothing", 1, 0, []string{"a"}, []bool{false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := &keyedLimiter{rate: tt.rate, burst: tt.burst, buckets: map[string]*tokenBucket{}}
+			for i, key := range tt.keys {
+				ok, wait := l.allow(key)
+				if ok != tt.want[i] {
+					t.Fatalf("allow(%q) #%d = %v, want %v", key, i, ok, tt.want[i])
+				}
+				if ok && wait != 0 {
+					t.Fatalf("allow(%q) #%d waits %s while allowed", key, i, wait)
+				}
+				if !ok && (wait <= 0 || wait > time.Duration(float64(time.Second)/tt.rate)) {
+					t.Fatalf("allow(%q) #%d waits %s, want within (0, %s]", key, i, wait, time.Duration(float64(time.Second)/tt.rate))
+				}
+			}
+		})
+	}
+}
+
+func TestKeyedLimiterRefills(t *testing.T) {
+	l := &keyedLimiter{rate: 100, burst: 1, buckets: map[string]*tokenBucket{}}
+	if ok, _ := l.allow("a"); !ok {
+		t.Fatal("first allow() = false")
+	}
+	ok, wait := l.allow("a")
+	if ok {
+		t.Fatal("allow() = true with an empty bucket")
+	}
+	time.Sleep(wait + 5*time.Millisecond)
+	if ok, _ := l.allow("a"); !ok {
+		t.Fatalf("allow() = false %s after being told to wait %s", wait+5*time.Millisecond, wait)
+	}
+}
+
+func TestKeyedLimiterSweep(t *testing.T) {
+	l := &keyedLimiter{rate: 1, burst: 2, buckets: map[string]*tokenBucket{}}
+	for i := 0; i < maxProtectionEntries; i++ {
+		l.buckets[strconv.Itoa(i)] = &tokenBucket{tokens: 2, last: time.Now()}
+	}
+	l.buckets["0"].tokens = 0 // In use, kept by the sweep unless all are
+
+	l.allow("new")
+	if len(l.buckets) != 2 || l.buckets["0"] == nil || l.buckets["new"] == nil {
+		t.Fatalf("%d buckets after sweep, want the one in use and the new one", len(l.buckets))
+	}
+}
+
+func TestNilKeyedLimiter(t *testing.T) {
+	var l *keyedLimiter
+	if ok, wait := l.allow("a"); !ok || wait != 0 {
+		t.Fatal("a nil keyedLimiter must allow everything")
+	}
+}
@@ -0,0 +1,182 @@
+package paypal
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/TunnelWork/Ulysses.Lib/payment"
+	"github.com/TunnelWork/payment.PayPal/v2/internal/sqlwrapper"
+	pp "github.com/plutov/paypal/v4"
+)
+
+var ErrUnknownAccount error = errors.New("paypal: unknown merchant account")
+
+// MerchantAccount is a PayPal business account other than the default one of initConf,
+// in the "accounts" of initConf keyed by name, in JSON.
+type MerchantAccount struct {
+	ClientID string `json:"client_id"`
+	SecretID string `json:"secret_id"`
+	ApiBase  string `json:"api_base"` // Defaults to the apiBase of initConf
+}
+
+// AccountRouting picks the merchant account a PaymentRequest is paid to, the "accountRouting" of initConf, in JSON.
+// The longest ReferenceID prefix matching wins, then the currency. Requests matching neither go to the default account.
+type AccountRouting struct {
+	ReferencePrefixes map[string]string `json:"reference_prefixes"` // e.g. {"brandb-":"brand_b"}
+	Currencies        map[string]string `json:"currencies"`         // e.g. {"EUR":"eu"}
+}
+
+// AccountRouter picks the merchant account a PaymentRequest is paid to, by name. An empty name leaves it to
+// the AccountRouting of initConf. See GatewayConfig.
+type AccountRouter func(pr payment.PaymentRequest) string
+
+// merchantAccount has its own client, so its own access token.
+// The default account is named "", which is what rows saved before merchant accounts existed have.
+type merchantAccount struct {
+	name       string
+	httpClient *http.Client // Falls back to the previous credentials, see credentialFallback
+
+	mu        sync.RWMutex
+	client    *pp.Client // Swapped by ReloadCredentials()
+	rotatedAt time.Time
+	refused   error // Of the last credentials loaded, if PayPal refused them
+
+	oauthErr       error     // Of the last access token asked for, see tokenTransport
+	tokenExpiresAt time.Time // Of the last access token issued
+
+	webhookID  string // Verifies the signature of webhook events, see WebhookConfig
+	webhookURL string
+	webhookErr error // Of the last subscription, see syncWebhook()
+
+	previous            *pp.Client // Until previousUntil
+	previousUntil       time.Time
+	previousToken       *pp.TokenResponse
+	previousTokenExpiry time.Time
+	fellBackAt          time.Time
+}
+
+type accountKey struct{}
+
+// withAccount() makes the PayPal calls under ctx go to the merchant account.
+func withAccount(ctx context.Context, account *merchantAccount) context.Context {
+	ctx = context.WithValue(ctx, accountKey{}, account)
+	if account.name != "" {
+		ctx = withLogFields(ctx, "account", account.name)
+	}
+	return ctx
+}
+
+// account() is the merchant account of ctx, the default one if none is set.
+func (pg *PrepaidGateway) account(ctx context.Context) *merchantAccount {
+	if account, ok := ctx.Value(accountKey{}).(*merchantAccount); ok {
+		return account
+	}
+	return pg.accounts[""]
+}
+
+// client() is the PayPal client of the merchant account of ctx.
+func (pg *PrepaidGateway) client(ctx context.Context) *pp.Client {
+	return pg.account(ctx).current()
+}
+
+// accountNamed() looks up a merchant account by name.
+func (pg *PrepaidGateway) accountNamed(name string) (*merchantAccount, error) {
+	account, ok := pg.accounts[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownAccount, name)
+	}
+	return account, nil
+}
+
+// routeAccount() sets the merchant account a new PaymentRequest is paid to on ctx.
+func (pg *PrepaidGateway) routeAccount(ctx context.Context, pr payment.PaymentRequest) (context.Context, error) {
+	name := ""
+	if pg.accountRouter != nil {
+		name = pg.accountRouter(pr)
+	}
+	if name == "" {
+		name = pg.accountRouting.route(pr)
+	}
+	account, err := pg.accountNamed(name)
+	if err != nil {
+		return ctx, err
+	}
+	return withAccount(ctx, account), nil
+}
+
+// referenceAccount() sets the merchant account a saved ReferenceID is paid to on ctx.
+// A ReferenceID not saved goes to the default account.
+func (pg *PrepaidGateway) referenceAccount(ctx context.Context, ReferenceID string) (context.Context, error) {
+	done := pg.observeDB(ctx, "SelectAccount", "ReferenceID", ReferenceID)
+	name, err := sqlwrapper.SelectAccount(pg.db, pg.orderSqlTable, ReferenceID)
+	done(err)
+	if err == sql.ErrNoRows {
+		name, err = "", nil
+	}
+	if err != nil {
+		return ctx, err
+	}
+	account, err := pg.accountNamed(name)
+	if err != nil {
+		pg.log.Error("order saved with an unknown merchant account", "ReferenceID", ReferenceID, "account", name)
+		return ctx, err
+	}
+	return withAccount(ctx, account), nil
+}
+
+// recordAccount() sets the merchant account of an order record on ctx.
+func (pg *PrepaidGateway) recordAccount(ctx context.Context, record sqlwrapper.OrderRecord) (context.Context, error) {
+	account, err := pg.accountNamed(record.Account)
+	if err != nil {
+		pg.log.Error("order saved with an unknown merchant account", "ReferenceID", record.ReferenceID, "account", record.Account)
+		return ctx, err
+	}
+	return withAccount(ctx, account), nil
+}
+
+func (r AccountRouting) route(pr payment.PaymentRequest) string {
+	var longest string
+	for prefix := range r.ReferencePrefixes {
+		if strings.HasPrefix(pr.Item.ReferenceID, prefix) && len(prefix) > len(longest) {
+			longest = prefix
+		}
+	}
+	if longest != "" {
+		return r.ReferencePrefixes[longest]
+	}
+	return r.Currencies[strings.ToUpper(pr.Item.Currency)]
+}
+
+// validate() checks every account routed to exists.
+func (r AccountRouting) validate(accounts map[string]*merchantAccount) error {
+	for _, routes := range []map[string]string{r.ReferencePrefixes, r.Currencies} {
+		for _, name := range routes {
+			if _, ok := accounts[name]; !ok {
+				return fmt.Errorf("%w: %q in accountRouting", ErrUnknownAccount, name)
+			}
+		}
+	}
+	return nil
+}
+
+// accountNames() lists the merchant accounts, the default one first.
+func (pg *PrepaidGateway) accountNames() []string {
+	names := make([]string, 0, len(pg.accounts))
+	for name := range pg.accounts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Accounts() lists the names of the merchant accounts besides the default one.
+func (pg *PrepaidGateway) Accounts() []string {
+	return pg.accountNames()[1:]
+}
@@ -0,0 +1,223 @@
+package paypal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	pp "github.com/plutov/paypal/v4"
+)
+
+// Kinds of PayPal API failures, matched with errors.Is() against an *APIError.
+// An *APIError matches the kind of its issue or name, if known, and the kind of its HTTP status.
+var (
+	// By issue or name
+	ErrCaptureFullyRefunded     error = errors.New("paypal: capture is fully refunded")             // CAPTURE_FULLY_REFUNDED
+	ErrRefundTimeLimitExceeded  error = errors.New("paypal: capture is too old to be refunded")     // REFUND_TIME_LIMIT_EXCEEDED
+	ErrRefundAmountExceeded     error = errors.New("paypal: refund exceeds the captured amount")    // REFUND_AMOUNT_EXCEEDED
+	ErrRefundNotAllowed         error = errors.New("paypal: refund is not allowed for the capture") // REFUND_NOT_ALLOWED, PARTIAL_REFUND_NOT_ALLOWED...
+	ErrOrderNotApproved         error = errors.New("paypal: order is not approved by the payer")    // ORDER_NOT_APPROVED
+	ErrOrderAlreadyCaptured     error = errors.New("paypal: order is already captured")             // ORDER_ALREADY_CAPTURED, ORDER_ALREADY_COMPLETED
+	ErrOrderExpired             error = errors.New("paypal: order is expired or voided")            // ORDER_EXPIRED
+	ErrInstrumentDeclined       error = errors.New("paypal: payment method is declined")            // INSTRUMENT_DECLINED, TRANSACTION_REFUSED
+	ErrPayerActionRequired      error = errors.New("paypal: payer action is required")              // PAYER_ACTION_REQUIRED
+	ErrDuplicateInvoiceID       error = errors.New("paypal: invoice ID is used already")            // DUPLICATE_INVOICE_ID
+	ErrPayPalRequestInvalid     error = errors.New("paypal: request rejected as invalid")           // INVALID_REQUEST, UNPROCESSABLE_ENTITY otherwise
+	ErrPayPalRequestIDConflict  error = errors.New("paypal: PayPal-Request-Id reused")              // DUPLICATE_REQUEST_ID
+	ErrPayPalRateLimited        error = errors.New("paypal: rate limit reached")                    // RATE_LIMIT_REACHED, 429
+	ErrPayPalResourceNotFound   error = errors.New("paypal: resource not found")                    // RESOURCE_NOT_FOUND, 404
+	ErrPayPalAuthentication     error = errors.New("paypal: authentication with PayPal failed")     // AUTHENTICATION_FAILURE, 401
+	ErrPayPalPermissionDenied   error = errors.New("paypal: permission denied by PayPal")           // NOT_AUTHORIZED, PERMISSION_DENIED, 403
+	ErrPayPalUnavailable        error = errors.New("paypal: PayPal is unavailable")                 // 5xx, network failures
+	ErrPayPalUnexpectedResponse error = errors.New("paypal: unexpected response from PayPal")       // any other status
+)
+
+// kindError is an error of this package matching a kind of PayPal API failure with errors.Is().
+type kindError struct {
+	msg  string
+	kind error
+}
+
+func (e *kindError) Error() string {
+	return e.msg
+}
+
+func (e *kindError) Is(target error) bool {
+	return e.kind == target
+}
+
+// Issues and names PayPal reports in errors, see https://developer.paypal.com/api/rest/reference/orders/v2/errors/
+// and https://developer.paypal.com/docs/api/payments/v2/#errors
+var issueKinds = map[string]error{
+	"CAPTURE_FULLY_REFUNDED":                      ErrCaptureFullyRefunded,
+	"REFUND_TIME_LIMIT_EXCEEDED":                  ErrRefundTimeLimitExceeded,
+	"REFUND_AMOUNT_EXCEEDED":                      ErrRefundAmountExceeded,
+	"PARTIAL_REFUND_NOT_ALLOWED":                  ErrRefundNotAllowed,
+	"REFUND_NOT_ALLOWED":                          ErrRefundNotAllowed,
+	"REFUND_CAPTURE_CURRENCY_MISMATCH":            ErrRefundNotAllowed,
+	"CAPTURE_DISPUTED_PARTIAL_REFUND_NOT_ALLOWED": ErrRefundNotAllowed,
+	"ORDER_NOT_APPROVED":                          ErrOrderNotApproved,
+	"ORDER_ALREADY_CAPTURED":                      ErrOrderAlreadyCaptured,
+	"ORDER_ALREADY_COMPLETED":                     ErrOrderAlreadyCaptured,
+	"ORDER_EXPIRED":                               ErrOrderExpired,
+	"INSTRUMENT_DECLINED":                         ErrInstrumentDeclined,
+	"TRANSACTION_REFUSED":                         ErrInstrumentDeclined,
+	"PAYER_ACTION_REQUIRED":                       ErrPayerActionRequired,
+	"DUPLICATE_INVOICE_ID":                        ErrDuplicateInvoiceID,
+	"DUPLICATE_REQUEST_ID":                        ErrPayPalRequestIDConflict,
+	"RATE_LIMIT_REACHED":                          ErrPayPalRateLimited,
+	"RESOURCE_NOT_FOUND":                          ErrPayPalResourceNotFound,
+	"INVALID_RESOURCE_ID":                         ErrPayPalResourceNotFound,
+	"AUTHENTICATION_FAILURE":                      ErrPayPalAuthentication,
+	"NOT_AUTHORIZED":                              ErrPayPalPermissionDenied,
+	"PERMISSION_DENIED":                           ErrPayPalPermissionDenied,
+	"INVALID_REQUEST":                             ErrPayPalRequestInvalid,
+	"UNPROCESSABLE_ENTITY":                        ErrPayPalRequestInvalid,
+	"INTERNAL_SERVER_ERROR":                       ErrPayPalUnavailable,
+	"SERVICE_UNAVAILABLE":                         ErrPayPalUnavailable,
+}
+
+// APIError is a failed call to the PayPal REST API: either PayPal answered with an error, or it couldn't be reached.
+// Test its kind with errors.Is(), e.g. errors.Is(err, ErrCaptureFullyRefunded).
+type APIError struct {
+	Method     string
+	Endpoint   string // API path with IDs replaced, e.g. /v2/payments/captures/{id}/refund
+	StatusCode int    // 0 if PayPal couldn't be reached
+
+	Name    string // e.g. UNPROCESSABLE_ENTITY
+	Issue   string // Of the first detail, e.g. CAPTURE_FULLY_REFUNDED
+	Message string
+	DebugID string // Quote it to PayPal support
+	Details []pp.ErrorResponseDetail
+
+	Err error // *pp.ErrorResponse or the transport error
+}
+
+// apiError() turns an error from the PayPal client into an *APIError. Other errors and nil are returned unchanged.
+func apiError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return err
+	}
+
+	var errResp *pp.ErrorResponse
+	if errors.As(err, &errResp) {
+		apiErr = &APIError{
+			Name:    errResp.Name,
+			Message: errResp.Message,
+			DebugID: errResp.DebugID,
+			Details: errResp.Details,
+			Err:     err,
+		}
+		if len(errResp.Details) > 0 {
+			apiErr.Issue = errResp.Details[0].Issue
+		}
+		if resp := errResp.Response; resp != nil {
+			apiErr.StatusCode = resp.StatusCode
+			if apiErr.DebugID == "" {
+				apiErr.DebugID = resp.Header.Get("Paypal-Debug-Id")
+			}
+			if resp.Request != nil {
+				apiErr.Method = resp.Request.Method
+				apiErr.Endpoint = endpointLabel(resp.Request.URL.Path)
+			}
+		}
+		return apiErr
+	}
+
+	// http.Client.Do() fails with a *url.Error
+	var netErr interface {
+		error
+		Timeout() bool
+	}
+	if errors.As(err, &netErr) || errors.Is(err, context.DeadlineExceeded) {
+		return &APIError{Message: err.Error(), Err: err}
+	}
+	return err
+}
+
+func (e *APIError) Error() string {
+	var b strings.Builder
+	b.WriteString("paypal: ")
+	if e.Method != "" {
+		fmt.Fprintf(&b, "%s %s: ", e.Method, e.Endpoint)
+	}
+	if e.StatusCode == 0 {
+		fmt.Fprintf(&b, "PayPal unreachable: %s", e.Message)
+		return b.String()
+	}
+	fmt.Fprintf(&b, "%d", e.StatusCode)
+	for _, s := range []string{e.Name, e.Issue} {
+		if s != "" {
+			b.WriteString(" " + s)
+		}
+	}
+	if e.Message != "" {
+		b.WriteString(": " + e.Message)
+	}
+	if e.DebugID != "" {
+		fmt.Fprintf(&b, " (debug_id %s)", e.DebugID)
+	}
+	return b.String()
+}
+
+func (e *APIError) Unwrap() error {
+	return e.Err
+}
+
+// Is() matches the kind of the issue or name, and the kind of the HTTP status.
+func (e *APIError) Is(target error) bool {
+	if kind, ok := issueKinds[e.Issue]; ok && kind == target {
+		return true
+	}
+	if kind, ok := issueKinds[e.Name]; ok && kind == target {
+		return true
+	}
+	return e.statusKind() == target
+}
+
+func (e *APIError) statusKind() error {
+	switch {
+	case e.StatusCode == 0, e.StatusCode >= http.StatusInternalServerError:
+		return ErrPayPalUnavailable
+	case e.StatusCode == http.StatusTooManyRequests:
+		return ErrPayPalRateLimited
+	case e.StatusCode == http.StatusNotFound:
+		return ErrPayPalResourceNotFound
+	case e.StatusCode == http.StatusUnauthorized:
+		return ErrPayPalAuthentication
+	case e.StatusCode == http.StatusForbidden:
+		return ErrPayPalPermissionDenied
+	case e.StatusCode == http.StatusBadRequest, e.StatusCode == http.StatusUnprocessableEntity:
+		return ErrPayPalRequestInvalid
+	default:
+		return ErrPayPalUnexpectedResponse
+	}
+}
+
+// Retryable() tells if the same request may succeed later: PayPal couldn't be reached, timed out,
+// failed on its side or limited the rate. Calls failing fast with ErrCircuitOpen are not retryable. Retry with the same PayPal-Request-Id for requests that create anything.
+func (e *APIError) Retryable() bool {
+	if errors.Is(e.Err, context.Canceled) || errors.Is(e.Err, ErrCircuitOpen) {
+		return false
+	}
+	switch {
+	case e.StatusCode == 0,
+		e.StatusCode == http.StatusRequestTimeout,
+		e.StatusCode == http.StatusTooManyRequests,
+		e.StatusCode >= http.StatusInternalServerError:
+		return true
+	}
+	return false
+}
+
+// IsRetryable() tells if err is an *APIError worth retrying, see APIError.Retryable().
+func IsRetryable(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.Retryable()
+}
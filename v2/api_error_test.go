@@ -0,0 +1,35 @@
+package paypal
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestRefundErrorKinds(t *testing.T) {
+	tests := []struct {
+		err  error
+		kind error
+	}{
+		{ErrOrderNotPaid, ErrRefundNotAllowed},
+		{ErrNoCaptureID, ErrRefundNotAllowed},
+		{ErrRepeatedRefund, ErrCaptureFullyRefunded},
+		{ErrRefundExceedsPaid, ErrRefundAmountExceeded},
+		{ErrRefundCurrencyMismatch, ErrRefundNotAllowed},
+	}
+	for _, tt := range tests {
+		wrapped := fmt.Errorf("ReferenceID REF-1: %w", tt.err)
+		if !errors.Is(tt.err, tt.kind) || !errors.Is(wrapped, tt.kind) {
+			t.Errorf("%q doesn't match %q", tt.err, tt.kind)
+		}
+		if !errors.Is(wrapped, tt.err) {
+			t.Errorf("%q doesn't match itself", tt.err)
+		}
+		if errors.Is(tt.err, ErrPayPalUnavailable) || IsRetryable(tt.err) {
+			t.Errorf("%q matches a PayPal failure", tt.err)
+		}
+	}
+	if errors.Is(ErrRepeatedRefund, ErrRefundExceedsPaid) {
+		t.Error("refund errors match each other")
+	}
+}
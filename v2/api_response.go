@@ -18,15 +18,63 @@ var (
 	// 503 Service Unavailable
 	BUYER_PAYPAL_ERROR = api.MessageResponse(api.ERROR, "BUYER_PAYPAL_ERROR")
 
+	// 413 Request Entity Too Large, see AbuseProtectionConfig
+	REQUEST_TOO_LARGE = api.MessageResponse(api.ERROR, "REQUEST_TOO_LARGE")
+
+	// 401 Unauthorized, see the healthToken of initConf
+	UNAUTHORIZED = api.MessageResponse(api.ERROR, "UNAUTHORIZED")
+
+	// 200 OK, a webhook event whose signature PayPal verified
+	WEBHOOK_RECEIVED = api.MessageResponse(api.SUCCESS, "WEBHOOK_RECEIVED")
+
+	// 401 Unauthorized, PayPal didn't verify the signature of the webhook event
+	WEBHOOK_NOT_VERIFIED = api.MessageResponse(api.ERROR, "WEBHOOK_NOT_VERIFIED")
+
+	// 503 Service Unavailable, no webhook ID to verify the event with yet, see WebhookConfig
+	WEBHOOK_NOT_SUBSCRIBED = api.MessageResponse(api.ERROR, "WEBHOOK_NOT_SUBSCRIBED")
+
+	// 429 Too Many Requests, see AbuseProtectionConfig
+	RATE_LIMITED = api.MessageResponse(api.ERROR, "RATE_LIMITED")
+
+	// 404 Not Found
+	CHECKOUT_NOT_FOUND = api.MessageResponse(api.ERROR, "CHECKOUT_NOT_FOUND")
+
 	// 409 Conflict
 	PAYMENT_NOT_APPROVED = api.MessageResponse(api.ERROR, "PAYMENT_NOT_APPROVED")
 
+	// 409 Conflict
+	PAYMENT_ALREADY_PAID = api.MessageResponse(api.ERROR, "PAYMENT_ALREADY_PAID")
+
+	// 402 Payment Required, see ThreeDSPolicy
+	CARD_AUTHENTICATION_FAILED = api.MessageResponse(api.ERROR, "CARD_AUTHENTICATION_FAILED")
+
+	// 202 Accepted, captured but held by a risk rule
+	PAYMENT_UNDER_REVIEW = api.MessageResponse(api.ERROR, "PAYMENT_UNDER_REVIEW")
+
+	// 403 Forbidden, captured and refunded by a risk rule
+	PAYMENT_REJECTED = api.MessageResponse(api.ERROR, "PAYMENT_REJECTED")
+
+	// 409 Conflict, captured but failed verification and refunded, see AutoRefundPolicy
+	PAYMENT_REFUNDED = api.MessageResponse(api.ERROR, "PAYMENT_REFUNDED")
+
+	// 200 OK, a duplicate payment kept as credit, see DuplicateAction
+	PAYMENT_CREDITED = api.MessageResponse(api.SUCCESS, "PAYMENT_CREDITED")
+
+	// 410 Gone
+	PAYMENT_LINK_EXPIRED = api.MessageResponse(api.ERROR, "PAYMENT_LINK_EXPIRED")
+
 	// 500 Internal Server Error
 	SERVER_BAD_DATABASE = api.MessageResponse(api.ERROR, "SERVER_BAD_DATABASE")
 
+	// 500 Internal Server Error, e.g. the checkout page can't be rendered
+	SERVER_INTERNAL_ERROR = api.MessageResponse(api.ERROR, "SERVER_INTERNAL_ERROR")
+
 	// 500 Internal Server Error
 	SERVER_PAYPAL_BAD_AUTH = api.MessageResponse(api.ERROR, "SERVER_PAYPAL_BAD_AUTH")
 
+	// 503 Service Unavailable, PayPal is down or limiting the rate, try again later
+	SERVER_PAYPAL_UNAVAILABLE = api.MessageResponse(api.ERROR, "SERVER_PAYPAL_UNAVAILABLE")
+
 	// PayPal gives a bad order according to the user-reported order ID
 	// reason could be:
 	// - Can't get such order from PayPal (500)
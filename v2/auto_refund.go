@@ -0,0 +1,161 @@
+package paypal
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/TunnelWork/Ulysses.Lib/payment"
+	"github.com/TunnelWork/payment.PayPal/v2/internal/sqlwrapper"
+	"github.com/gin-gonic/gin"
+	pp "github.com/plutov/paypal/v4"
+)
+
+// Why a capture is refunded automatically
+const (
+	AutoRefundAmountMismatch      = "AMOUNT_MISMATCH"       // currency or amount differs from the record
+	AutoRefundUnknownReference    = "UNKNOWN_REFERENCE"     // no record of the ReferenceID
+	AutoRefundDuplicate           = "DUPLICATE_PAYMENT"     // the ReferenceID was paid by another capture already
+	AutoRefundLiabilityNotShifted = "LIABILITY_NOT_SHIFTED" // a card payment captured against the ThreeDSPolicy
+)
+
+// AutoRefundPolicy is the "autoRefund" initConf entry in JSON: which captures failing verification are
+// refunded in full right away instead of being reported UNKNOWN for someone to refund by hand.
+type AutoRefundPolicy struct {
+	AmountMismatch   bool `json:"amount_mismatch"`
+	UnknownReference bool `json:"unknown_reference"`
+
+	// Card payments captured outside of the card fields, e.g. by the JS SDK, whose 3-D Secure result the
+	// ThreeDSPolicy rejects.
+	LiabilityNotShifted bool `json:"liability_not_shifted"`
+
+	// Same as "duplicatePayment": "refund" in initConf, which takes precedence. See DuplicateAction.
+	Duplicate bool `json:"duplicate"`
+}
+
+func (p AutoRefundPolicy) enabled(reason string) bool {
+	switch reason {
+	case AutoRefundAmountMismatch:
+		return p.AmountMismatch
+	case AutoRefundUnknownReference:
+		return p.UnknownReference
+	case AutoRefundDuplicate:
+		return p.Duplicate
+	case AutoRefundLiabilityNotShifted:
+		return p.LiabilityNotShifted
+	}
+	return false
+}
+
+type AutoRefund = sqlwrapper.AutoRefundRecord
+
+// AutoRefunds() lists the captures refunded automatically for a ReferenceID.
+func (pg *PrepaidGateway) AutoRefunds(referenceID string) ([]AutoRefund, error) {
+	return sqlwrapper.SelectAutoRefunds(pg.db, pg.orderSqlTable, referenceID)
+}
+
+// orderCapture() finds captureID in the order, or nil if the capture isn't part of it.
+func orderCapture(order *pp.Order, captureID string) *pp.CaptureAmount {
+	if captureID == "" {
+		return nil
+	}
+	for _, unit := range order.PurchaseUnits {
+		if unit.Payments == nil {
+			continue
+		}
+		for i := range unit.Payments.Captures {
+			if unit.Payments.Captures[i].ID == captureID {
+				return &unit.Payments.Captures[i]
+			}
+		}
+	}
+	return nil
+}
+
+// captureCompleted() asks PayPal if a capture is COMPLETED, which only then can be refunded. A PENDING one,
+// e.g. under review by PayPal, or a DECLINED one is not, nor is one whose status can't be told.
+func (pg *PrepaidGateway) captureCompleted(ctx context.Context, captureID string) bool {
+	detail, err := pg.client(ctx).CapturedDetail(ctx, captureID)
+	if err != nil {
+		pg.log.Warn("capture status unavailable", append(append([]interface{}{}, logFields(ctx)...), "CaptureID", captureID, "error", apiError(err))...)
+		return false
+	}
+	return detail.Status == "COMPLETED"
+}
+
+// autoRefund() refunds a capture failing verification in full if the policy says so, records why and
+// notifies UpdateHandler. ok is false if the policy doesn't cover reason, or the order isn't paid by the
+// completed capture, in which case nothing is done.
+func (pg *PrepaidGateway) autoRefund(ctx context.Context, reason, detail, ReferenceID string, order *pp.Order, capture *pp.CaptureAmount) (status int, resp gin.H, ok bool) {
+	if !pg.autoRefundPolicy.enabled(reason) || capture == nil {
+		return 0, nil, false
+	}
+	if (order.Status != "APPROVED" && order.Status != "COMPLETED") || !pg.captureCompleted(ctx, capture.ID) {
+		return 0, nil, false
+	}
+	status, resp, _ = pg.refundFailedCapture(ctx, reason, detail, ReferenceID, order.ID, capture)
+	return status, resp, true
+}
+
+// refundFailedCapture() refunds a capture in full, records why and notifies UpdateHandler.
+// refunded is false if the refund failed, in which case nothing is recorded.
+func (pg *PrepaidGateway) refundFailedCapture(ctx context.Context, reason, detail, ReferenceID, OrderID string, capture *pp.CaptureAmount) (status int, resp gin.H, refunded bool) {
+	record := AutoRefund{
+		ReferenceID: ReferenceID,
+		OrderID:     OrderID,
+		CaptureID:   capture.ID,
+		Reason:      reason,
+		Detail:      detail,
+	}
+	if capture.Amount != nil {
+		record.Currency = capture.Amount.Currency
+		record.Amount, _ = strconv.ParseFloat(capture.Amount.Value, 64)
+	}
+
+	// Verifying the same capture again must not refund twice
+	done := pg.observeDB(ctx, "SelectAutoRefundByCapture", "CaptureID", capture.ID)
+	_, err := sqlwrapper.SelectAutoRefundByCapture(pg.db, pg.orderSqlTable, capture.ID)
+	done(err)
+	if err == nil {
+		return http.StatusConflict, PAYMENT_REFUNDED, true
+	}
+
+	// No amount means the full capture
+	refundResp, err := pg.refundCapture(ctx, capture.ID, pp.RefundCaptureRequest{})
+	pg.metrics.refunded("automatic", refundResp.Status, err)
+	if err != nil {
+		if pg.UpdateHandler != nil {
+			(*pg.UpdateHandler)(
+				ReferenceID,
+				payment.PaymentResult{
+					Status: payment.UNKNOWN,
+					Msg:    fmt.Sprintf("(Verified)ReferenceID %s: capture %s should be refunded for %s (%s), but refund failed: %s", ReferenceID, capture.ID, reason, detail, err),
+				},
+			)
+		}
+		return http.StatusInternalServerError, SERVER_PAYPAL_BAD_ORDER, false
+	}
+	record.RefundID = refundResp.ID
+	record.Status = refundResp.Status
+
+	var recordMsg string
+	done = pg.observeDB(ctx, "InsertAutoRefund", "ReferenceID", ReferenceID, "OrderID", OrderID, "CaptureID", capture.ID, "RefundID", record.RefundID, "reason", reason)
+	err = sqlwrapper.InsertAutoRefund(pg.db, pg.orderSqlTable, record)
+	done(err)
+	if err != nil {
+		recordMsg = fmt.Sprintf(" Refund not saved: %s", err)
+	}
+
+	if pg.UpdateHandler != nil {
+		(*pg.UpdateHandler)(
+			ReferenceID,
+			payment.PaymentResult{
+				Status: payment.UNPAID,
+				Msg: fmt.Sprintf("(Refunded)ReferenceID %s: capture %s of %s %s automatically refunded for %s (%s), refund %s is %s.%s",
+					ReferenceID, capture.ID, formatAmount(record.Amount, record.Currency), record.Currency, reason, detail, refundResp.ID, refundResp.Status, recordMsg),
+			},
+		)
+	}
+	return http.StatusConflict, PAYMENT_REFUNDED, true
+}
@@ -0,0 +1,308 @@
+package paypal
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/TunnelWork/Ulysses.Lib/payment"
+	pp "github.com/plutov/paypal/v4"
+)
+
+// fakeDriver is a database/sql driver whose databases answer queries with a func, keyed by DSN. See newFakeDB.
+type fakeDriver struct{}
+
+// fakeQuery answers a query, matching it by substring. Exec ignores the rows.
+type fakeQuery func(query string, args []driver.Value) ([][]driver.Value, error)
+
+var fakeDBs sync.Map
+
+func init() {
+	sql.Register("paypal_fake", fakeDriver{})
+}
+
+func (fakeDriver) Open(name string) (driver.Conn, error) {
+	q, ok := fakeDBs.Load(name)
+	if !ok {
+		return nil, sql.ErrConnDone
+	}
+	return fakeConn{q.(fakeQuery)}, nil
+}
+
+type fakeConn struct{ q fakeQuery }
+
+func (c fakeConn) Prepare(query string) (driver.Stmt, error) { return fakeStmt{c.q, query}, nil }
+func (c fakeConn) Close() error                              { return nil }
+func (c fakeConn) Begin() (driver.Tx, error)                 { return fakeTx{}, nil }
+
+type fakeTx struct{}
+
+func (fakeTx) Commit() error   { return nil }
+func (fakeTx) Rollback() error { return nil }
+
+type fakeStmt struct {
+	q     fakeQuery
+	query string
+}
+
+func (s fakeStmt) Close() error  { return nil }
+func (s fakeStmt) NumInput() int { return -1 }
+
+func (s fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	_, err := s.q(s.query, args)
+	return driver.RowsAffected(1), err
+}
+
+func (s fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	rows, err := s.q(s.query, args)
+	if err != nil {
+		return nil, err
+	}
+	return &fakeRows{rows: rows}, nil
+}
+
+type fakeRows struct{ rows [][]driver.Value }
+
+func (r *fakeRows) Columns() []string {
+	if len(r.rows) == 0 {
+		return nil
+	}
+	return make([]string, len(r.rows[0]))
+}
+
+func (r *fakeRows) Close() error { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+func newFakeDB(t *testing.T, q fakeQuery) *sql.DB {
+	t.Helper()
+	fakeDBs.Store(t.Name(), q)
+	db, err := sql.Open("paypal_fake", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+		fakeDBs.Delete(t.Name())
+	})
+	return db
+}
+
+// fakeCaptures remembers the auto refunds and duplicates saved, keyed by CaptureID, for the fake database.
+type fakeCaptures struct {
+	mu          sync.Mutex
+	autoRefunds map[string]bool
+	duplicates  map[string]string // Action
+}
+
+func newFakeCaptures() *fakeCaptures {
+	return &fakeCaptures{autoRefunds: map[string]bool{}, duplicates: map[string]string{}}
+}
+
+func (f *fakeCaptures) query(query string, args []driver.Value) ([][]driver.Value, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case strings.Contains(query, "INSERT INTO pp_auto_refunds"):
+		f.autoRefunds[args[2].(string)] = true
+	case strings.Contains(query, "FROM pp_auto_refunds WHERE CaptureID"):
+		if f.autoRefunds[args[0].(string)] {
+			return [][]driver.Value{{"", "", args[0], "", "", "", 0.0, "", "", ""}}, nil
+		}
+	case strings.Contains(query, "INSERT INTO pp_duplicates"):
+		f.duplicates[args[2].(string)] = args[6].(string)
+	case strings.Contains(query, "FROM pp_duplicates WHERE CaptureID"):
+		if action, ok := f.duplicates[args[0].(string)]; ok {
+			return [][]driver.Value{{"", "", args[0], "", "", 0.0, action, ""}}, nil
+		}
+	}
+	return nil, nil
+}
+
+// fakePayPal serves the capture detail and refund APIs for captures by ID.
+type fakePayPal struct {
+	mu         sync.Mutex
+	status     map[string]string // Of captures, COMPLETED if not set
+	refundFail bool
+	refunds    []string // CaptureIDs
+}
+
+func newFakePayPal(t *testing.T) (*fakePayPal, *httptest.Server) {
+	f := &fakePayPal{status: map[string]string{}}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		path := strings.TrimPrefix(r.URL.Path, "/v2/payments/captures/")
+		switch {
+		case r.Method == http.MethodGet:
+			status, ok := f.status[path]
+			if !ok {
+				status = "COMPLETED"
+			}
+			json.NewEncoder(w).Encode(map[string]string{"id": path, "status": status})
+		case r.Method == http.MethodPost && strings.HasSuffix(path, "/refund"):
+			if f.refundFail {
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(map[string]string{"name": "INTERNAL_SERVER_ERROR", "message": "An internal server error has occurred."})
+				return
+			}
+			captureID := strings.TrimSuffix(path, "/refund")
+			f.refunds = append(f.refunds, captureID)
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(map[string]string{"id": "R-" + captureID, "status": "COMPLETED"})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return f, srv
+}
+
+func (f *fakePayPal) refunded() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.refunds...)
+}
+
+// newTestGateway() is a PrepaidGateway on db, whose default account calls srv, and whose UpdateHandler
+// results are collected.
+func newTestGateway(t *testing.T, db *sql.DB, srv *httptest.Server) (*PrepaidGateway, *[]payment.PaymentResult) {
+	t.Helper()
+	client, err := pp.NewClient("client", "secret", srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := &[]payment.PaymentResult{}
+	handler := func(referenceID string, result payment.PaymentResult) {
+		*results = append(*results, result)
+	}
+	pg := &PrepaidGateway{
+		db:            db,
+		orderSqlTable: "pp",
+		accounts:      map[string]*merchantAccount{"": {client: client}},
+		tracer:        newTracer(nil),
+		UpdateHandler: &handler,
+	}
+	return pg, results
+}
+
+func testCapture(id string) *pp.CaptureAmount {
+	return &pp.CaptureAmount{ID: id, Amount: &pp.PurchaseUnitAmount{Currency: "USD", Value: "10.00"}}
+}
+
+func TestAutoRefundPolicyEnabled(t *testing.T) {
+	p := AutoRefundPolicy{AmountMismatch: true, LiabilityNotShifted: true}
+	tests := []struct {
+		reason string
+		want   bool
+	}{
+		{AutoRefundAmountMismatch, true},
+		{AutoRefundUnknownReference, false},
+		{AutoRefundDuplicate, false},
+		{AutoRefundLiabilityNotShifted, true},
+		{"SOMETHING_ELSE", false},
+	}
+	for _, tt := range tests {
+		if got := p.enabled(tt.reason); got != tt.want {
+			t.Errorf("enabled(%s) = %v, want %v", tt.reason, got, tt.want)
+		}
+	}
+}
+
+func TestAutoRefund(t *testing.T) {
+	tests := []struct {
+		name          string
+		policy        AutoRefundPolicy
+		orderStatus   string
+		captureStatus string
+		capture       bool
+		wantOK        bool
+		wantStatus    int
+	}{
+		{"refunded", AutoRefundPolicy{AmountMismatch: true}, "COMPLETED", "COMPLETED", true, true, http.StatusConflict},
+		{"approved order refunded", AutoRefundPolicy{AmountMismatch: true}, "APPROVED", "COMPLETED", true, true, http.StatusConflict},
+		{"policy disabled", AutoRefundPolicy{UnknownReference: true}, "COMPLETED", "COMPLETED", true, false, 0},
+		{"no capture", AutoRefundPolicy{AmountMismatch: true}, "COMPLETED", "COMPLETED", false, false, 0},
+		{"order not paid", AutoRefundPolicy{AmountMismatch: true}, "VOIDED", "COMPLETED", true, false, 0},
+		{"capture pending", AutoRefundPolicy{AmountMismatch: true}, "COMPLETED", "PENDING", true, false, 0},
+		{"capture declined", AutoRefundPolicy{AmountMismatch: true}, "COMPLETED", "DECLINED", true, false, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			paypal, srv := newFakePayPal(t)
+			paypal.status["CAP-1"] = tt.captureStatus
+			pg, results := newTestGateway(t, newFakeDB(t, newFakeCaptures().query), srv)
+			pg.autoRefundPolicy = tt.policy
+
+			var capture *pp.CaptureAmount
+			if tt.capture {
+				capture = testCapture("CAP-1")
+			}
+			order := &pp.Order{ID: "ORDER-1", Status: tt.orderStatus}
+			status, _, ok := pg.autoRefund(context.Background(), AutoRefundAmountMismatch, "10.00 USD, want 20.00 USD", "REF-1", order, capture)
+			if ok != tt.wantOK || status != tt.wantStatus {
+				t.Fatalf("autoRefund() = %d, %v, want %d, %v", status, ok, tt.wantStatus, tt.wantOK)
+			}
+			refunds := paypal.refunded()
+			if tt.wantOK != (len(refunds) == 1) {
+				t.Fatalf("refunded %v", refunds)
+			}
+			if tt.wantOK && (len(*results) != 1 || (*results)[0].Status != payment.UNPAID) {
+				t.Fatalf("UpdateHandler got %+v, want one UNPAID", *results)
+			}
+		})
+	}
+}
+
+func TestAutoRefundOncePerCapture(t *testing.T) {
+	paypal, srv := newFakePayPal(t)
+	pg, _ := newTestGateway(t, newFakeDB(t, newFakeCaptures().query), srv)
+	pg.autoRefundPolicy = AutoRefundPolicy{UnknownReference: true}
+	order := &pp.Order{ID: "ORDER-1", Status: "COMPLETED"}
+
+	for i := 0; i < 3; i++ {
+		status, resp, ok := pg.autoRefund(context.Background(), AutoRefundUnknownReference, "", "REF-1", order, testCapture("CAP-1"))
+		if !ok || status != http.StatusConflict || !reflect.DeepEqual(resp, PAYMENT_REFUNDED) {
+			t.Fatalf("autoRefund() #%d = %d, %v, %v", i, status, resp, ok)
+		}
+	}
+	pg.autoRefund(context.Background(), AutoRefundUnknownReference, "", "REF-1", order, testCapture("CAP-2"))
+	if refunds := paypal.refunded(); len(refunds) != 2 || refunds[0] != "CAP-1" || refunds[1] != "CAP-2" {
+		t.Fatalf("refunded %v, want CAP-1 and CAP-2 once each", refunds)
+	}
+}
+
+func TestAutoRefundFailed(t *testing.T) {
+	paypal, srv := newFakePayPal(t)
+	paypal.refundFail = true
+	captures := newFakeCaptures()
+	pg, results := newTestGateway(t, newFakeDB(t, captures.query), srv)
+	pg.autoRefundPolicy = AutoRefundPolicy{AmountMismatch: true}
+
+	status, _, ok := pg.autoRefund(context.Background(), AutoRefundAmountMismatch, "", "REF-1", &pp.Order{ID: "ORDER-1", Status: "COMPLETED"}, testCapture("CAP-1"))
+	if !ok || status != http.StatusInternalServerError {
+		t.Fatalf("autoRefund() = %d, %v, want %d, true", status, ok, http.StatusInternalServerError)
+	}
+	if captures.autoRefunds["CAP-1"] {
+		t.Fatal("failed refund saved")
+	}
+	if len(*results) != 1 || (*results)[0].Status != payment.UNKNOWN {
+		t.Fatalf("UpdateHandler got %+v, want one UNKNOWN", *results)
+	}
+}
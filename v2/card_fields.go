@@ -0,0 +1,334 @@
+package paypal
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/TunnelWork/Ulysses.Lib/payment"
+	"github.com/TunnelWork/payment.PayPal/v2/internal/sqlwrapper"
+	"github.com/gin-gonic/gin"
+	pp "github.com/plutov/paypal/v4"
+)
+
+// ThreeDSPolicy decides which card payments are captured, judging by the 3-D Secure authentication_result.
+// https://developer.paypal.com/docs/checkout/advanced/customize/3d-secure/response-parameters/
+type ThreeDSPolicy string
+
+const (
+	// Capture regardless of the 3-D Secure outcome.
+	ThreeDSAcceptAll ThreeDSPolicy = "accept_all"
+
+	// Don't capture when 3-D Secure was attempted but failed, was rejected, or the result is unknown.
+	// Cards not enrolled in 3-D Secure are still captured without liability shift. This is the default.
+	ThreeDSRejectFailed ThreeDSPolicy = "reject_failed"
+
+	// Only capture when the liability has shifted to the card issuer.
+	ThreeDSRequireLiabilityShift ThreeDSPolicy = "require_liability_shift"
+)
+
+const (
+	// Card verification methods, 3-D Secure is only triggered by PayPal when required, or always.
+	CardVerificationSCAWhenRequired = "SCA_WHEN_REQUIRED"
+	CardVerificationSCAAlways       = "SCA_ALWAYS"
+)
+
+var (
+	ErrBadThreeDSPolicy    error = errors.New("paypal: unknown 3-D Secure policy")
+	ErrNoClientToken       error = errors.New("paypal: PayPal returned no client token")
+	ErrLiabilityNotShifted error = errors.New("paypal: card payment rejected by 3-D Secure policy")
+	ErrNoCardFields        error = errors.New("paypal: card fields are not enabled")
+)
+
+type authenticationResult struct {
+	LiabilityShift string `json:"liability_shift"` // POSSIBLE, NO, UNKNOWN, (YES, for saved cards)
+	ThreeDSecure   *struct {
+		EnrollmentStatus     string `json:"enrollment_status"`     // Y, N, U, B
+		AuthenticationStatus string `json:"authentication_status"` // Y, N, R, A, U, C, I, D
+	} `json:"three_d_secure,omitempty"`
+}
+
+func (p ThreeDSPolicy) valid() bool {
+	switch p {
+	case ThreeDSAcceptAll, ThreeDSRejectFailed, ThreeDSRequireLiabilityShift:
+		return true
+	}
+	return false
+}
+
+// allows() tells if a card payment with the authentication result may be captured.
+// result is nil when no 3-D Secure was performed at all.
+func (p ThreeDSPolicy) allows(result *authenticationResult) bool {
+	switch p {
+	case ThreeDSAcceptAll:
+		return true
+	case ThreeDSRequireLiabilityShift:
+		return result != nil && (result.LiabilityShift == "POSSIBLE" || result.LiabilityShift == "YES")
+	default: // ThreeDSRejectFailed
+		if result == nil {
+			return true
+		}
+		switch result.LiabilityShift {
+		case "POSSIBLE", "YES":
+			return true
+		case "NO":
+			// Not enrolled, unavailable or bypassed: 3-D Secure couldn't be done, nobody failed it
+			return result.ThreeDSecure == nil || result.ThreeDSecure.EnrollmentStatus != "Y"
+		default:
+			return false
+		}
+	}
+}
+
+func (r *authenticationResult) String() string {
+	if r == nil {
+		return "no 3-D Secure"
+	}
+	if r.ThreeDSecure == nil {
+		return fmt.Sprintf("liability shift %s", r.LiabilityShift)
+	}
+	return fmt.Sprintf("liability shift %s, enrollment %s, authentication %s", r.LiabilityShift, r.ThreeDSecure.EnrollmentStatus, r.ThreeDSecure.AuthenticationStatus)
+}
+
+// cardFieldsEnabled() tells if the JS SDK loads the card fields, either the current or the legacy hosted ones.
+func cardFieldsEnabled(sdkOptions SDKOptions) bool {
+	for _, component := range sdkOptions.Components {
+		if component == "card-fields" || component == "hosted-fields" {
+			return true
+		}
+	}
+	return false
+}
+
+// generateClientToken() asks PayPal for a client token identifying the buyer to the card fields.
+// It is short-lived and should be generated for each checkout.
+func (pg *PrepaidGateway) generateClientToken(ctx context.Context) (string, error) {
+	var token struct {
+		ClientToken string `json:"client_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+
+	req, err := pg.client(ctx).NewRequest(ctx, http.MethodPost, fmt.Sprintf("%s/v1/identity/generate-token", pg.client(ctx).APIBase), nil)
+	if err != nil {
+		return "", err
+	}
+
+	err = apiError(pg.client(ctx).SendWithAuth(req, &token))
+	if err != nil {
+		return "", err
+	}
+	if token.ClientToken == "" {
+		return "", ErrNoClientToken
+	}
+	return token.ClientToken, nil
+}
+
+// handlerCardCreateOrder creates the order for card fields of a pending ReferenceID, since
+// card payments can't be created by the JS SDK itself. Responds with the order ID.
+// The card is saved in PayPal Vault if the checkout is from VaultCheckoutForm().
+func (pg *PrepaidGateway) handlerCardCreateOrder(c *gin.Context) {
+	ctx := c.Request.Context()
+	ReferenceID := c.Param("ref_id")
+
+	done := pg.observeDB(ctx, "SelectPaymentRequest", "ReferenceID", ReferenceID)
+	pr, err := sqlwrapper.SelectPaymentRequest(pg.db, pg.orderSqlTable, ReferenceID)
+	done(err)
+	if err != nil {
+		if err == sql.ErrNoRows || err == sqlwrapper.ErrNilPointer {
+			c.JSON(http.StatusNotFound, CHECKOUT_NOT_FOUND)
+			return
+		}
+		c.JSON(http.StatusInternalServerError, SERVER_BAD_DATABASE)
+		return
+	}
+	done = pg.observeDB(ctx, "SelectCaptureID", "ReferenceID", ReferenceID)
+	captureID, err := sqlwrapper.SelectCaptureID(pg.db, pg.orderSqlTable, ReferenceID)
+	done(err)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, SERVER_BAD_DATABASE)
+		return
+	}
+	if ctx, err = pg.referenceAccount(ctx, ReferenceID); err != nil {
+		c.JSON(http.StatusInternalServerError, SERVER_BAD_DATABASE)
+		return
+	}
+	if captureID != "" {
+		c.JSON(http.StatusConflict, PAYMENT_ALREADY_PAID)
+		return
+	}
+
+	done = pg.observeDB(ctx, "SelectVaultCustomerID", "ReferenceID", ReferenceID)
+	customerID, err := sqlwrapper.SelectVaultCustomerID(pg.db, pg.orderSqlTable, ReferenceID)
+	done(err)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, SERVER_BAD_DATABASE)
+		return
+	}
+
+	attributes := map[string]interface{}{
+		"verification": map[string]interface{}{"method": pg.cardVerification},
+	}
+	// Set by VaultCheckoutForm(), the card is saved once the order is captured
+	if customerID != "" {
+		for key, value := range vaultRequestAttributes(pg.paypalCustomerID(ctx, customerID)) {
+			attributes[key] = value
+		}
+	}
+
+	order, err := pg.createOrderWithSource(ctx, pr, "", map[string]interface{}{
+		"card": map[string]interface{}{
+			"attributes": attributes,
+			"experience_context": map[string]interface{}{
+				"return_url": pg.callbackURL("return"),
+				"cancel_url": pg.callbackURL("cancel"),
+			},
+		},
+	})
+	if err != nil {
+		c.JSON(paypalFailure(err, http.StatusInternalServerError, SERVER_PAYPAL_BAD_ORDER))
+		return
+	}
+
+	done = pg.observeDB(ctx, "UpdatePendingOrderID", "ReferenceID", ReferenceID, "OrderID", order.ID)
+	err = sqlwrapper.UpdatePendingOrderID(pg.db, pg.orderSqlTable, ReferenceID, order.ID)
+	done(err)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, SERVER_BAD_DATABASE)
+		return
+	}
+
+	pg.metrics.checkoutCreated("card_fields")
+	c.JSON(http.StatusOK, gin.H{"id": order.ID})
+}
+
+// handlerCardCapture checks the 3-D Secure result of an order approved in the card fields against
+// the ThreeDSPolicy, then captures and verifies it like onApprove. _verifyApproval() checks it again
+// for card payments captured by other means.
+func (pg *PrepaidGateway) handlerCardCapture(c *gin.Context) {
+	ctx := c.Request.Context()
+	ReferenceID := c.Param("ref_id")
+	OrderID := c.PostForm("order_id")
+	if OrderID == "" {
+		pg.respondCallback(c, "card_capture", http.StatusBadRequest, BAD_REQUEST)
+		return
+	}
+
+	done := pg.observeDB(ctx, "SelectOrderByOrderID", "OrderID", OrderID)
+	record, err := sqlwrapper.SelectOrderByOrderID(pg.db, pg.orderSqlTable, OrderID)
+	done(err)
+	if err != nil || record.ReferenceID != ReferenceID {
+		pg.respondCallback(c, "card_capture", http.StatusBadRequest, BAD_REQUEST)
+		return
+	}
+	if !record.Active {
+		pg.respondCallback(c, "card_capture", http.StatusConflict, PAYMENT_ALREADY_PAID)
+		return
+	}
+	if ctx, err = pg.recordAccount(ctx, record); err != nil {
+		pg.respondCallback(c, "card_capture", http.StatusInternalServerError, SERVER_BAD_DATABASE)
+		return
+	}
+
+	// Checked before capturing too, so a rejected payment isn't captured only to be refunded
+	order, err := pg.getCardOrder(ctx, OrderID)
+	if err != nil {
+		status, resp := paypalFailure(err, http.StatusInternalServerError, SERVER_PAYPAL_BAD_ORDER)
+		pg.respondCallback(c, "card_capture", status, resp)
+		return
+	}
+	if result, _ := order.card(); !pg.threeDSPolicy.allows(result) {
+		status, resp := pg.rejectCardPayment(ctx, ReferenceID, &order.Order, nil, result)
+		pg.respondCallback(c, "card_capture", status, resp)
+		return
+	}
+
+	CaptureID, err := pg.captureOrder(ctx, OrderID)
+	if err != nil {
+		if pg.UpdateHandler != nil {
+			(*pg.UpdateHandler)(
+				ReferenceID,
+				payment.PaymentResult{
+					Status: payment.UNKNOWN,
+					Msg:    fmt.Sprintf("(Unverified)ReferenceID %s: pp.client.CaptureOrder() failed: %s", ReferenceID, err),
+				},
+			)
+		}
+		status, resp := paypalFailure(err, http.StatusInternalServerError, SERVER_PAYPAL_BAD_ORDER)
+		pg.respondCallback(c, "card_capture", status, resp)
+		return
+	}
+
+	status, resp := pg._verifyApproval(ctx, OrderID, ReferenceID, CaptureID)
+	pg.respondCallback(c, "card_capture", status, resp)
+}
+
+// cardOrder is a pp.Order with the card of its payment_source, which pp.Order doesn't have.
+type cardOrder struct {
+	pp.Order
+	PaymentSource *struct {
+		Card *struct {
+			AuthenticationResult *authenticationResult `json:"authentication_result,omitempty"`
+		} `json:"card,omitempty"`
+	} `json:"payment_source,omitempty"`
+}
+
+// card() is the 3-D Secure result of the order, ok is false if it isn't paid by card.
+func (o *cardOrder) card() (result *authenticationResult, ok bool) {
+	if o.PaymentSource == nil || o.PaymentSource.Card == nil {
+		return nil, false
+	}
+	return o.PaymentSource.Card.AuthenticationResult, true
+}
+
+// getCardOrder() is pp.Client.GetOrder(), keeping the card of the payment_source.
+func (pg *PrepaidGateway) getCardOrder(ctx context.Context, orderID string) (*cardOrder, error) {
+	order := &cardOrder{}
+
+	req, err := pg.client(ctx).NewRequest(ctx, http.MethodGet, fmt.Sprintf("%s/v2/checkout/orders/%s", pg.client(ctx).APIBase, orderID), nil)
+	if err != nil {
+		return order, err
+	}
+
+	err = pg.client(ctx).SendWithAuth(req, order)
+	return order, apiError(err)
+}
+
+// savedChargeKey marks the context of ChargeSaved(), made without the buyer so without 3-D Secure.
+type savedChargeKey struct{}
+
+// rejectCardPayment() turns down a card payment the ThreeDSPolicy doesn't allow. One captured already,
+// e.g. by the JS SDK before posting to onClose, is refunded if the AutoRefundPolicy says so, or
+// reported UNKNOWN for someone to look into.
+func (pg *PrepaidGateway) rejectCardPayment(ctx context.Context, ReferenceID string, order *pp.Order, capture *pp.CaptureAmount, result *authenticationResult) (int, gin.H) {
+	pg.metrics.verificationFailed("liability_not_shifted")
+	if status, resp, ok := pg.autoRefund(ctx, AutoRefundLiabilityNotShifted, result.String(), ReferenceID, order, capture); ok {
+		return status, resp
+	}
+
+	status := payment.UNPAID
+	msg := fmt.Sprintf("(Verified)ReferenceID %s: card payment not captured, %s: %s", ReferenceID, ErrLiabilityNotShifted, result)
+	if capture != nil {
+		status = payment.UNKNOWN
+		msg = fmt.Sprintf("(Verified)ReferenceID %s: card payment captured by %s, %s: %s", ReferenceID, capture.ID, ErrLiabilityNotShifted, result)
+	}
+	if pg.UpdateHandler != nil {
+		(*pg.UpdateHandler)(
+			ReferenceID,
+			payment.PaymentResult{
+				Status: status,
+				Msg:    msg,
+			},
+		)
+	}
+	return http.StatusPaymentRequired, CARD_AUTHENTICATION_FAILED
+}
+
+// cardRenderParams() adds what the card fields need to formRenderParams.
+func (pg *PrepaidGateway) cardRenderParams(params map[string]interface{}, referenceID string) {
+	params["card_fields"] = true
+	params["card_order_url"] = pg.callbackURL("card/" + url.PathEscape(referenceID) + "/order")
+	params["card_capture_url"] = pg.callbackURL("card/" + url.PathEscape(referenceID) + "/capture")
+}
@@ -0,0 +1,163 @@
+package paypal
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestThreeDSPolicyAllows(t *testing.T) {
+	// authentication_result as PayPal sends it, "null" when no 3-D Secure was performed
+	results := map[string]*authenticationResult{}
+	for name, body := range map[string]string{
+		"none":         `null`,
+		"shifted":      `{"liability_shift":"POSSIBLE","three_d_secure":{"enrollment_status":"Y","authentication_status":"Y"}}`,
+		"saved card":   `{"liability_shift":"YES"}`,
+		"not enrolled": `{"liability_shift":"NO","three_d_secure":{"enrollment_status":"N"}}`,
+		"bypassed":     `{"liability_shift":"NO"}`,
+		"failed":       `{"liability_shift":"NO","three_d_secure":{"enrollment_status":"Y","authentication_status":"N"}}`,
+		"unknown":      `{"liability_shift":"UNKNOWN","three_d_secure":{"enrollment_status":"U"}}`,
+		"empty":        `{}`,
+	} {
+		var result *authenticationResult
+		if err := json.Unmarshal([]byte(body), &result); err != nil {
+			t.Fatal(err)
+		}
+		results[name] = result
+	}
+	tests := []struct {
+		policy ThreeDSPolicy
+		allows []string
+		denies []string
+	}{
+		{ThreeDSAcceptAll, []string{"none", "shifted", "saved card", "not enrolled", "bypassed", "failed", "unknown", "empty"}, nil},
+		{ThreeDSRejectFailed, []string{"none", "shifted", "saved card", "not enrolled", "bypassed"}, []string{"failed", "unknown", "empty"}},
+		{"", []string{"none", "shifted", "not enrolled"}, []string{"failed", "unknown"}}, // The default
+		{ThreeDSRequireLiabilityShift, []string{"shifted", "saved card"}, []string{"none", "not enrolled", "bypassed", "failed", "unknown", "empty"}},
+	}
+	for _, tt := range tests {
+		for _, name := range tt.allows {
+			if !tt.policy.allows(results[name]) {
+				t.Errorf("%q.allows(%s) = false, want true", tt.policy, name)
+			}
+		}
+		for _, name := range tt.denies {
+			if tt.policy.allows(results[name]) {
+				t.Errorf("%q.allows(%s) = true, want false", tt.policy, name)
+			}
+		}
+	}
+}
+
+func TestCardOrder(t *testing.T) {
+	tests := []struct {
+		body      string
+		wantCard  bool
+		wantShift string
+	}{
+		{`{"id":"O1","status":"COMPLETED"}`, false, ""},
+		{`{"id":"O1","payment_source":{"paypal":{"email_address":"a@b.c"}}}`, false, ""},
+		{`{"id":"O1","payment_source":{"card":{"last_digits":"1111"}}}`, true, ""},
+		{`{"id":"O1","payment_source":{"card":{"authentication_result":{"liability_shift":"POSSIBLE"}}}}`, true, "POSSIBLE"},
+	}
+	for _, tt := range tests {
+		var order cardOrder
+		if err := json.Unmarshal([]byte(tt.body), &order); err != nil {
+			t.Fatal(err)
+		}
+		if order.ID != "O1" {
+			t.Errorf("%s: ID = %q, pp.Order not decoded", tt.body, order.ID)
+		}
+		result, ok := order.card()
+		if ok != tt.wantCard {
+			t.Errorf("%s: card() ok = %v, want %v", tt.body, ok, tt.wantCard)
+		}
+		if shift := ""; result != nil {
+			if shift = result.LiabilityShift; shift != tt.wantShift {
+				t.Errorf("%s: liability shift = %q, want %q", tt.body, shift, tt.wantShift)
+			}
+		} else if tt.wantShift != "" {
+			t.Errorf("%s: no authentication result, want liability shift %q", tt.body, tt.wantShift)
+		}
+	}
+}
+
+func TestCardCreateOrderVaults(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tests := []struct {
+		name           string
+		customerID     string
+		wantVault      bool
+		wantCustomerID string
+	}{
+		{"plain checkout", "", false, ""},
+		{"vault checkout", "cust-1", true, "PPC-1"},
+		{"vault checkout of new customer", "cust-2", true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sent struct {
+				PaymentSource struct {
+					Card struct {
+						Attributes struct {
+							Verification map[string]string `json:"verification"`
+							Vault        map[string]string `json:"vault"`
+							Customer     map[string]string `json:"customer"`
+						} `json:"attributes"`
+					} `json:"card"`
+				} `json:"payment_source"`
+			}
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				json.NewDecoder(r.Body).Decode(&sent)
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusCreated)
+				w.Write([]byte(`{"id":"ORDER-1","status":"CREATED"}`))
+			}))
+			defer srv.Close()
+
+			var savedOrderID string
+			db := newFakeDB(t, func(query string, args []driver.Value) ([][]driver.Value, error) {
+				switch {
+				case strings.Contains(query, "SELECT ReferenceID, Currency, Total"):
+					return [][]driver.Value{{"REF-1", "USD", 10.0}}, nil
+				case strings.Contains(query, "SELECT CaptureID"):
+					return [][]driver.Value{{""}}, nil
+				case strings.Contains(query, "SELECT VaultCustomerID"):
+					return [][]driver.Value{{tt.customerID}}, nil
+				case strings.Contains(query, "_vault WHERE CustomerID") && args[0] == "cust-1":
+					return [][]driver.Value{{"cust-1", "TOKEN-1", "PPC-1", "card", "VISA 1111", "", ""}}, nil
+				case strings.Contains(query, "SET OrderID = ?"):
+					savedOrderID = args[0].(string)
+				}
+				return nil, nil
+			})
+			pg, _ := newTestGateway(t, db, srv)
+			pg.cardVerification = CardVerificationSCAWhenRequired
+
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest(http.MethodPost, "/card/REF-1/order", nil)
+			c.Params = gin.Params{{Key: "ref_id", Value: "REF-1"}}
+			pg.handlerCardCreateOrder(c)
+
+			if w.Code != http.StatusOK || savedOrderID != "ORDER-1" {
+				t.Fatalf("handlerCardCreateOrder() = %d %s, saved order %q", w.Code, w.Body, savedOrderID)
+			}
+			attributes := sent.PaymentSource.Card.Attributes
+			if attributes.Verification["method"] != CardVerificationSCAWhenRequired {
+				t.Fatalf("verification = %v", attributes.Verification)
+			}
+			if tt.wantVault != (attributes.Vault["store_in_vault"] == "ON_SUCCESS") {
+				t.Fatalf("vault = %v, want vaulting %v", attributes.Vault, tt.wantVault)
+			}
+			if attributes.Customer["id"] != tt.wantCustomerID {
+				t.Fatalf("customer = %v, want %q", attributes.Customer, tt.wantCustomerID)
+			}
+		})
+	}
+}
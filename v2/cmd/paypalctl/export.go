@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/TunnelWork/payment.PayPal/v2/internal/sqlwrapper"
+)
+
+func runExport(args []string) error {
+	var gf globalFlags
+	var from, to, format, out string
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	gf.register(fs)
+	fs.StringVar(&from, "from", "", "first day, e.g. 2021-10-01")
+	fs.StringVar(&to, "to", "", "last day (inclusive), e.g. 2021-10-31")
+	fs.StringVar(&format, "format", "csv", "csv or json")
+	fs.StringVar(&out, "out", "", "output file, defaults to stdout")
+	fs.Parse(args)
+
+	if format != "csv" && format != "json" {
+		return fmt.Errorf("unknown format %q", format)
+	}
+	start, end, err := parseDateRange(from, to)
+	if err != nil {
+		return err
+	}
+
+	db, err := gf.openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	records, err := sqlwrapper.ListOrders(db, gf.orderSqlTable(), start, end)
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if out != "" {
+		f, err := os.Create(out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	if format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(records)
+	}
+	return writeCSV(w, records)
+}
+
+// writeCSV() leaves out OrderDetails, use JSON export for the full order.
+func writeCSV(w io.Writer, records []sqlwrapper.OrderRecord) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"id", "order_id", "reference_id", "gateway_type", "currency", "total", "refunded", "capture_id", "created_at", "closed_at", "active", "gross", "fee", "net", "receivable_amount", "receivable_currency", "exchange_rate", "payer_id", "payer_email", "payer_name", "payer_country", "account"})
+	for _, r := range records {
+		cw.Write([]string{
+			strconv.FormatUint(r.ID, 10),
+			r.OrderID,
+			r.ReferenceID,
+			strconv.FormatUint(uint64(r.GatewayType), 10),
+			r.Currency,
+			strconv.FormatFloat(r.Total, 'f', -1, 64),
+			strconv.FormatFloat(r.Refunded, 'f', -1, 64),
+			r.CaptureID,
+			r.CreatedAt,
+			r.ClosedAt,
+			strconv.FormatBool(r.Active),
+			strconv.FormatFloat(r.Gross, 'f', -1, 64),
+			strconv.FormatFloat(r.Fee, 'f', -1, 64),
+			strconv.FormatFloat(r.Net, 'f', -1, 64),
+			strconv.FormatFloat(r.ReceivableAmount, 'f', -1, 64),
+			r.ReceivableCurrency,
+			strconv.FormatFloat(r.ExchangeRate, 'f', -1, 64),
+			r.PayerID,
+			r.Email,
+			r.Name,
+			r.Country,
+			r.Account,
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
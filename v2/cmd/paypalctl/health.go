@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	paypal "github.com/TunnelWork/payment.PayPal/v2"
+)
+
+func runHealth(args []string) error {
+	var gf globalFlags
+	fs := flag.NewFlagSet("health", flag.ExitOnError)
+	gf.register(fs)
+	fs.Parse(args)
+
+	db, err := gf.openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	initConf, err := gf.initConf(db)
+	if err != nil {
+		return err
+	}
+	// The schema version is reported, not migrated. PayPal failing is reported too, not an error.
+	pg, err := paypal.New(db, gf.instanceID, paypal.GatewayConfig{InitConf: initConf, NoStartup: true})
+	if err != nil {
+		return err
+	}
+	pg.CheckOAuth()
+
+	health := pg.Health()
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err = enc.Encode(health); err != nil {
+		return err
+	}
+	if health.Status != paypal.HealthOK {
+		return fmt.Errorf("gateway is %s", health.Status)
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/TunnelWork/payment.PayPal/v2/internal/sqlwrapper"
+)
+
+func runInspect(args []string) error {
+	var gf globalFlags
+	var referenceID, orderID string
+	var remote bool
+	fs := flag.NewFlagSet("inspect", flag.ExitOnError)
+	gf.register(fs)
+	fs.StringVar(&referenceID, "ref", "", "ReferenceID to look up")
+	fs.StringVar(&orderID, "order", "", "PayPal OrderID to look up")
+	fs.BoolVar(&remote, "remote", false, "also fetch the order from PayPal")
+	fs.Parse(args)
+
+	if (referenceID == "") == (orderID == "") {
+		return fmt.Errorf("exactly one of -ref or -order is required")
+	}
+
+	db, err := gf.openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var record sqlwrapper.OrderRecord
+	if referenceID != "" {
+		record, err = sqlwrapper.SelectOrder(db, gf.orderSqlTable(), referenceID)
+	} else {
+		record, err = sqlwrapper.SelectOrderByOrderID(db, gf.orderSqlTable(), orderID)
+	}
+	if err != nil {
+		return err
+	}
+
+	out := map[string]interface{}{
+		"local": record,
+	}
+
+	if remote {
+		if record.OrderID == "" {
+			return fmt.Errorf("ReferenceID %s has no OrderID associated", record.ReferenceID)
+		}
+		conf, err := gf.loadConfig(db)
+		if err != nil {
+			return err
+		}
+		c, err := newPayPalClient(conf, record.Account)
+		if err != nil {
+			return err
+		}
+		order, err := c.GetOrder(context.Background(), record.OrderID)
+		if err != nil {
+			return err
+		}
+		out["remote"] = order
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(out)
+}
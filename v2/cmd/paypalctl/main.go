@@ -0,0 +1,203 @@
+// paypalctl is an operator tool for the PayPal prepaid gateway.
+// It works directly on the same config and orders tables used by the gateway.
+//
+//	paypalctl <command> [flags]
+//
+// Run `paypalctl <command> -h` for the flags of each command.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	paypal "github.com/TunnelWork/payment.PayPal/v2"
+	"github.com/TunnelWork/payment.PayPal/v2/internal/sqlwrapper"
+	_ "github.com/go-sql-driver/mysql"
+	pp "github.com/plutov/paypal/v4"
+)
+
+type command struct {
+	name  string
+	usage string
+	run   func(args []string) error
+}
+
+var commands = []command{
+	{"migrate", "create or upgrade the orders table", runMigrate},
+	{"inspect", "show an order by ReferenceID or OrderID", runInspect},
+	{"reconcile", "compare orders in a date range against PayPal", runReconcile},
+	{"refund", "refund a paid order", runRefund},
+	{"replay", "replay recorded callbacks from a file", runReplay},
+	{"export", "export orders in a date range to CSV or JSON", runExport},
+	{"health", "check PayPal OAuth and the database, as the gateway sees them", runHealth},
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	for _, cmd := range commands {
+		if cmd.name == os.Args[1] {
+			if err := cmd.run(os.Args[2:]); err != nil {
+				fmt.Fprintf(os.Stderr, "paypalctl %s: %s\n", cmd.name, err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
+	usage()
+	os.Exit(2)
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: paypalctl <command> [flags]")
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "commands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", cmd.name, cmd.usage)
+	}
+}
+
+// globalFlags are accepted by every command which touches the database.
+type globalFlags struct {
+	dsn        string
+	tblPrefix  string
+	instanceID string
+	orderTbl   string
+}
+
+func (gf *globalFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&gf.dsn, "dsn", os.Getenv("PAYPALCTL_DSN"), "MySQL DSN, defaults to $PAYPALCTL_DSN")
+	fs.StringVar(&gf.tblPrefix, "prefix", "", "Ulysses table prefix")
+	fs.StringVar(&gf.instanceID, "instance", "", "gateway instance ID")
+	fs.StringVar(&gf.orderTbl, "table", "", "orders table, defaults to <prefix>payment_paypal_prepaid_orders")
+}
+
+func (gf *globalFlags) orderSqlTable() string {
+	if gf.orderTbl != "" {
+		return gf.orderTbl
+	}
+	return gf.tblPrefix + `payment_paypal_prepaid_orders`
+}
+
+func (gf *globalFlags) openDB() (*sql.DB, error) {
+	if gf.dsn == "" {
+		return nil, fmt.Errorf("no DSN given, use -dsn or $PAYPALCTL_DSN")
+	}
+	db, err := sql.Open("mysql", gf.dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err = db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// loadConfig() reads the gateway instance's PrepaidConfig from the config table.
+func (gf *globalFlags) loadConfig(db *sql.DB) (paypal.PrepaidConfig, error) {
+	if gf.instanceID == "" {
+		return paypal.PrepaidConfig{}, fmt.Errorf("no instance ID given, use -instance")
+	}
+	return paypal.LoadPrepaidConfig(db, gf.tblPrefix, gf.instanceID)
+}
+
+// newGateway() builds the gateway instance the same way Ulysses does, minus the callback and the startup:
+// the orders table must be migrated already by `paypalctl migrate`, and PayPal is only called when needed.
+func (gf *globalFlags) newGateway(db *sql.DB) (*paypal.PrepaidGateway, error) {
+	version, err := sqlwrapper.SchemaVersion(db, gf.orderSqlTable())
+	if err != nil {
+		return nil, err
+	}
+	if version != sqlwrapper.LatestSchemaVersion() {
+		return nil, fmt.Errorf("%s is at schema version %d, not %d, run paypalctl migrate first", gf.orderSqlTable(), version, sqlwrapper.LatestSchemaVersion())
+	}
+
+	initConf, err := gf.initConf(db)
+	if err != nil {
+		return nil, err
+	}
+	return paypal.New(db, gf.instanceID, paypal.GatewayConfig{InitConf: initConf, NoStartup: true})
+}
+
+// initConf() is the initConf of the gateway instance, built from its PrepaidConfig.
+func (gf *globalFlags) initConf(db *sql.DB) (map[string]string, error) {
+	conf, err := gf.loadConfig(db)
+	if err != nil {
+		return nil, err
+	}
+	initConf := map[string]string{
+		"clientID":      conf.ClientID,
+		"secretID":      conf.SecretID,
+		"apiBase":       conf.ApiBase,
+		"orderSqlTable": gf.orderSqlTable(),
+		"callbackBase":  "",
+	}
+	if len(conf.Accounts) > 0 {
+		accounts, err := json.Marshal(conf.Accounts)
+		if err != nil {
+			return nil, err
+		}
+		initConf["accounts"] = string(accounts)
+	}
+	if conf.AccountRouting != nil {
+		routing, err := json.Marshal(conf.AccountRouting)
+		if err != nil {
+			return nil, err
+		}
+		initConf["accountRouting"] = string(routing)
+	}
+	return initConf, nil
+}
+
+// newPayPalClient() logs in to the merchant account an order was saved with, the default one if account is empty.
+func newPayPalClient(conf paypal.PrepaidConfig, account string) (*pp.Client, error) {
+	clientID, secretID, apiBase := conf.ClientID, conf.SecretID, conf.ApiBase
+	if account != "" {
+		ma, ok := conf.Accounts[account]
+		if !ok {
+			return nil, fmt.Errorf("%w: %q", paypal.ErrUnknownAccount, account)
+		}
+		clientID, secretID = ma.ClientID, ma.SecretID
+		if ma.ApiBase != "" {
+			apiBase = ma.ApiBase
+		}
+	}
+	c, err := pp.NewClient(clientID, secretID, apiBase)
+	if err != nil {
+		return nil, err
+	}
+	c.SetHTTPClient(&http.Client{Timeout: 30 * time.Second})
+	if _, err = c.GetAccessToken(context.Background()); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+const dateLayout = "2006-01-02"
+
+// parseDateRange() parses -from and -to as dates. -to is inclusive.
+func parseDateRange(from, to string) (time.Time, time.Time, error) {
+	if from == "" || to == "" {
+		return time.Time{}, time.Time{}, fmt.Errorf("both -from and -to are required (%s)", dateLayout)
+	}
+	start, err := time.ParseInLocation(dateLayout, from, time.Local)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	end, err := time.ParseInLocation(dateLayout, to, time.Local)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	return start, end.AddDate(0, 0, 1), nil
+}
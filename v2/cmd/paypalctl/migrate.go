@@ -0,0 +1,41 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/TunnelWork/payment.PayPal/v2/internal/sqlwrapper"
+)
+
+func runMigrate(args []string) error {
+	var gf globalFlags
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	gf.register(fs)
+	fs.Parse(args)
+
+	db, err := gf.openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	before, err := sqlwrapper.SchemaVersion(db, gf.orderSqlTable())
+	if err != nil {
+		return err
+	}
+	after, err := sqlwrapper.Migrate(db, gf.orderSqlTable())
+	if err != nil {
+		return fmt.Errorf("migration stopped at version %d: %w", after, err)
+	}
+
+	fmt.Printf("%s: schema version %d -> %d\n", gf.orderSqlTable(), before, after)
+
+	backfilled, err := sqlwrapper.BackfillPayers(db, gf.orderSqlTable())
+	if err != nil {
+		return fmt.Errorf("backfilling payers: %w", err)
+	}
+	if backfilled > 0 {
+		fmt.Printf("%s: payer of %d orders backfilled\n", gf.orderSqlTable(), backfilled)
+	}
+	return nil
+}
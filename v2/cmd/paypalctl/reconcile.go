@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	paypal "github.com/TunnelWork/payment.PayPal/v2"
+	"github.com/TunnelWork/payment.PayPal/v2/internal/sqlwrapper"
+	pp "github.com/plutov/paypal/v4"
+)
+
+func runReconcile(args []string) error {
+	var gf globalFlags
+	var from, to, reportFile string
+	var search bool
+	fs := flag.NewFlagSet("reconcile", flag.ExitOnError)
+	gf.register(fs)
+	fs.StringVar(&from, "from", "", "first day, e.g. 2021-10-01")
+	fs.StringVar(&to, "to", "", "last day (inclusive), e.g. 2021-10-31")
+	fs.BoolVar(&search, "search", false, "reconcile against the Transaction Search API instead of each order")
+	fs.StringVar(&reportFile, "report", "", "reconcile against a downloaded STL/TRR settlement report (CSV)")
+	fs.Parse(args)
+
+	start, end, err := parseDateRange(from, to)
+	if err != nil {
+		return err
+	}
+
+	db, err := gf.openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if search || reportFile != "" {
+		return reconcileSettlement(&gf, db, start, end, search, reportFile)
+	}
+
+	conf, err := gf.loadConfig(db)
+	if err != nil {
+		return err
+	}
+	records, err := sqlwrapper.ListOrders(db, gf.orderSqlTable(), start, end)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "REFERENCE_ID\tORDER_ID\tISSUE")
+	var pending, matched, mismatched int
+	clients := map[string]*pp.Client{} // By merchant account
+	for _, record := range records {
+		if record.OrderID == "" {
+			pending++
+			continue
+		}
+
+		c, ok := clients[record.Account]
+		if !ok {
+			if c, err = newPayPalClient(conf, record.Account); err != nil {
+				return err
+			}
+			clients[record.Account] = c
+		}
+		order, err := c.GetOrder(context.Background(), record.OrderID)
+		if err != nil {
+			mismatched++
+			fmt.Fprintf(tw, "%s\t%s\tcan't get order from PayPal: %s\n", record.ReferenceID, record.OrderID, err)
+			continue
+		}
+
+		var issues []string
+		if len(order.PurchaseUnits) != 1 {
+			issues = append(issues, fmt.Sprintf("%d purchase units", len(order.PurchaseUnits)))
+		} else {
+			unit := order.PurchaseUnits[0]
+			if unit.ReferenceID != record.ReferenceID {
+				issues = append(issues, fmt.Sprintf("reference_id is %s at PayPal", unit.ReferenceID))
+			}
+			if unit.Amount != nil {
+				paid, _ := strconv.ParseFloat(unit.Amount.Value, 64)
+				if unit.Amount.Currency != record.Currency || paid != record.Total {
+					issues = append(issues, fmt.Sprintf("amount %s %s at PayPal, %.2f %s on record", unit.Amount.Value, unit.Amount.Currency, record.Total, record.Currency))
+				}
+			}
+			if unit.Payments != nil && len(unit.Payments.Captures) > 0 && unit.Payments.Captures[0].ID != record.CaptureID {
+				issues = append(issues, fmt.Sprintf("capture %s at PayPal, %q on record", unit.Payments.Captures[0].ID, record.CaptureID))
+			}
+		}
+		paid := order.Status == "APPROVED" || order.Status == "COMPLETED"
+		if paid == record.Active {
+			issues = append(issues, fmt.Sprintf("status %s at PayPal, active=%t on record", order.Status, record.Active))
+		}
+
+		if len(issues) == 0 {
+			matched++
+			continue
+		}
+		mismatched++
+		for _, issue := range issues {
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", record.ReferenceID, record.OrderID, issue)
+		}
+	}
+	tw.Flush()
+
+	fmt.Printf("\n%d orders: %d matched, %d mismatched, %d pending without OrderID\n", len(records), matched, mismatched, pending)
+	return nil
+}
+
+func reconcileSettlement(gf *globalFlags, db *sql.DB, start, end time.Time, search bool, reportFile string) error {
+	pg, err := gf.newGateway(db)
+	if err != nil {
+		return err
+	}
+
+	var txns []paypal.SettlementTransaction
+	if search {
+		txns, err = pg.SearchTransactions(start, end)
+	} else {
+		var f *os.File
+		f, err = os.Open(reportFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		txns, err = paypal.ParseSettlementReport(f)
+	}
+	if err != nil {
+		return err
+	}
+
+	report, err := pg.Reconcile(start, end, txns)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "KIND\tREFERENCE_ID\tTRANSACTION_ID\tDETAIL")
+	for _, d := range report.Discrepancies {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", d.Kind, d.ReferenceID, d.TransactionID, d.Detail)
+	}
+	tw.Flush()
+
+	fmt.Printf("\n%d transactions: %d matched, %d discrepancies\n", len(txns), report.Matched, len(report.Discrepancies))
+	currencies := map[string]bool{}
+	for _, totals := range []map[string]float64{report.GrossTotals, report.RefundTotals, report.FeeTotals} {
+		for currency := range totals {
+			currencies[currency] = true
+		}
+	}
+	for currency := range currencies {
+		fmt.Printf("%s: gross %.2f, refunded %.2f, fee %.2f\n", currency, report.GrossTotals[currency], report.RefundTotals[currency], report.FeeTotals[currency])
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/TunnelWork/Ulysses.Lib/payment"
+	"github.com/TunnelWork/payment.PayPal/v2/internal/sqlwrapper"
+)
+
+func runRefund(args []string) error {
+	var gf globalFlags
+	var referenceID, currency string
+	var amount float64
+	var yes bool
+	fs := flag.NewFlagSet("refund", flag.ExitOnError)
+	gf.register(fs)
+	fs.StringVar(&referenceID, "ref", "", "ReferenceID to refund")
+	fs.Float64Var(&amount, "amount", 0, "amount to refund, defaults to everything not yet refunded")
+	fs.StringVar(&currency, "currency", "", "currency of -amount, defaults to the order's currency")
+	fs.BoolVar(&yes, "yes", false, "don't ask for confirmation")
+	fs.Parse(args)
+
+	if referenceID == "" {
+		return fmt.Errorf("-ref is required")
+	}
+
+	db, err := gf.openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	record, err := sqlwrapper.SelectOrder(db, gf.orderSqlTable(), referenceID)
+	if err != nil {
+		return err
+	}
+	if amount == 0 {
+		amount = record.Total - record.Refunded
+	}
+	if currency == "" {
+		currency = record.Currency
+	}
+
+	pg, err := gf.newGateway(db)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("ReferenceID: %s\nOrderID:     %s\nCaptureID:   %s\nPaid:        %.2f %s\nRefunded:    %.2f %s\n",
+		record.ReferenceID, record.OrderID, record.CaptureID, record.Total, record.Currency, record.Refunded, record.Currency)
+	if !pg.IsRefundable(referenceID) {
+		return fmt.Errorf("ReferenceID %s is not refundable", referenceID)
+	}
+	if !yes && !confirm(fmt.Sprintf("Refund %.2f %s for ReferenceID %s?", amount, currency, referenceID)) {
+		fmt.Println("aborted")
+		return nil
+	}
+
+	err = pg.Refund(payment.RefundRequest{
+		Item: payment.PaymentUnit{
+			ReferenceID: referenceID,
+			Currency:    currency,
+			Price:       amount,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Println("refunded")
+	return nil
+}
+
+func confirm(question string) bool {
+	fmt.Printf("%s [y/N] ", question)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
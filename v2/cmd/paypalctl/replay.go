@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// runReplay() posts recorded onClose callbacks to the gateway again.
+// The file holds one JSON object of form fields per line, e.g.
+//
+//	{"action":"approve","ref_id":"B00B5-DEADBEEF","order_id":"5O190127TN364715T","capture_id":"3C679366HH908993F"}
+func runReplay(args []string) error {
+	var file, callbackBase, instanceID, endpoint string
+	var dryRun bool
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	fs.StringVar(&file, "file", "", "JSON lines file of recorded callbacks")
+	fs.StringVar(&callbackBase, "callback-base", "", "callbackBase of the gateway, e.g. https://ulysses.tunnel.work/api/payment/callback")
+	fs.StringVar(&instanceID, "instance", "", "gateway instance ID")
+	fs.StringVar(&endpoint, "url", "", "full callback URL, overrides -callback-base and -instance")
+	fs.BoolVar(&dryRun, "dry-run", false, "print the callbacks without sending them")
+	fs.Parse(args)
+
+	if file == "" {
+		return fmt.Errorf("-file is required")
+	}
+	if endpoint == "" {
+		if callbackBase == "" || instanceID == "" {
+			return fmt.Errorf("either -url or both -callback-base and -instance are required")
+		}
+		endpoint = fmt.Sprintf("%s/paypal/%s/onClose", strings.TrimSuffix(callbackBase, "/"), instanceID)
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		var fields map[string]string
+		if err := json.Unmarshal([]byte(line), &fields); err != nil {
+			return fmt.Errorf("line %d: %w", lineNo, err)
+		}
+		form := url.Values{}
+		for k, v := range fields {
+			form.Set(k, v)
+		}
+
+		if dryRun {
+			fmt.Printf("line %d: POST %s %s\n", lineNo, endpoint, form.Encode())
+			continue
+		}
+
+		resp, err := client.PostForm(endpoint, form)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", lineNo, err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		fmt.Printf("line %d: %s %s\n", lineNo, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,369 @@
+package paypal
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/TunnelWork/Ulysses.Lib/payment"
+	pp "github.com/plutov/paypal/v4"
+)
+
+var (
+	ErrBadCredentialRotationConfig error = errors.New("paypal: bad credential rotation config")
+	ErrNoCredentialSource          error = errors.New("paypal: no credential source configured")
+)
+
+// CredentialRotationConfig is the "credentialRotation" of initConf, in JSON.
+//
+// ReloadCredentials() loads the credentials from Source and switches each merchant account to its new ones
+// once PayPal accepts them, without a restart. For GracePeriod after, a request refused by PayPal with the
+// new credentials is sent again with the previous ones, so they can be revoked while the new ones spread.
+type CredentialRotationConfig struct {
+	// file: Path holds a PrepaidConfig in JSON, as the config table does.
+	// env: <EnvPrefix>_CLIENT_ID, <EnvPrefix>_SECRET_ID, <EnvPrefix>_API_BASE and <EnvPrefix>_ACCOUNTS, the latter in JSON.
+	// config_table: the PrepaidConfig of the gateway instance, see LoadPrepaidConfig().
+	Source      string `json:"source"`
+	Path        string `json:"path"`
+	EnvPrefix   string `json:"env_prefix"`   // Defaults to PAYPAL
+	TblPrefix   string `json:"tbl_prefix"`   // Of the config table, defaults to payment.TblPrefix()
+	Interval    string `json:"interval"`     // How often WatchCredentials() reloads them. Defaults to 1m.
+	GracePeriod string `json:"grace_period"` // Defaults to 15m.
+}
+
+// CredentialSource loads the current credentials: the default account's, and other merchant accounts' by name.
+// Accounts left out keep their credentials.
+type CredentialSource func(ctx context.Context) (PrepaidConfig, error)
+
+type credentialRotation struct {
+	source   CredentialSource // nil if not configured
+	interval time.Duration
+	grace    time.Duration
+}
+
+// build() validates the config and fills in the defaults. The source is nil if none is configured.
+func (c CredentialRotationConfig) build(db *sql.DB, instanceID string) (credentialRotation, error) {
+	rotation := credentialRotation{interval: time.Minute, grace: 15 * time.Minute}
+	switch c.Source {
+	case "":
+	case "file":
+		if c.Path == "" {
+			return rotation, fmt.Errorf("%w: file source without a path", ErrBadCredentialRotationConfig)
+		}
+		rotation.source = CredentialsFromFile(c.Path)
+	case "env":
+		if c.EnvPrefix == "" {
+			c.EnvPrefix = "PAYPAL"
+		}
+		rotation.source = CredentialsFromEnv(c.EnvPrefix)
+	case "config_table":
+		if c.TblPrefix == "" {
+			c.TblPrefix = payment.TblPrefix()
+		}
+		rotation.source = CredentialsFromConfigTable(db, c.TblPrefix, instanceID)
+	default:
+		return rotation, fmt.Errorf("%w: source %q", ErrBadCredentialRotationConfig, c.Source)
+	}
+	if err := parseConfigDuration(c.Interval, &rotation.interval); err != nil {
+		return rotation, fmt.Errorf("%w: interval %q", ErrBadCredentialRotationConfig, c.Interval)
+	}
+	if err := parseConfigDuration(c.GracePeriod, &rotation.grace); err != nil {
+		return rotation, fmt.Errorf("%w: grace_period %q", ErrBadCredentialRotationConfig, c.GracePeriod)
+	}
+	return rotation, nil
+}
+
+// CredentialsFromFile() reads a PrepaidConfig in JSON from path, every time.
+func CredentialsFromFile(path string) CredentialSource {
+	return func(ctx context.Context) (PrepaidConfig, error) {
+		var conf PrepaidConfig
+		configJson, err := ioutil.ReadFile(path)
+		if err != nil {
+			return conf, err
+		}
+		err = json.Unmarshal(configJson, &conf)
+		return conf, err
+	}
+}
+
+// CredentialsFromEnv() reads <prefix>_CLIENT_ID, <prefix>_SECRET_ID, <prefix>_API_BASE and <prefix>_ACCOUNTS,
+// the latter in JSON, as the "accounts" of initConf. Meant for secret managers updating the environment
+// of the process with os.Setenv().
+func CredentialsFromEnv(prefix string) CredentialSource {
+	return func(ctx context.Context) (PrepaidConfig, error) {
+		conf := PrepaidConfig{
+			ClientID: os.Getenv(prefix + "_CLIENT_ID"),
+			SecretID: os.Getenv(prefix + "_SECRET_ID"),
+			ApiBase:  os.Getenv(prefix + "_API_BASE"),
+		}
+		if accountsJson := os.Getenv(prefix + "_ACCOUNTS"); accountsJson != "" {
+			if err := json.Unmarshal([]byte(accountsJson), &conf.Accounts); err != nil {
+				return conf, fmt.Errorf("%s_ACCOUNTS: %w", prefix, err)
+			}
+		}
+		return conf, nil
+	}
+}
+
+// CredentialsFromConfigTable() reads the PrepaidConfig of instanceID with LoadPrepaidConfig().
+func CredentialsFromConfigTable(db *sql.DB, tblPrefix, instanceID string) CredentialSource {
+	return func(ctx context.Context) (PrepaidConfig, error) {
+		return LoadPrepaidConfig(db, tblPrefix, instanceID)
+	}
+}
+
+// ReloadCredentials() loads the credentials from the source of the "credentialRotation" of initConf, or
+// GatewayConfig.CredentialSource, and switches every merchant account whose credentials changed to them.
+// Credentials PayPal refuses are not switched to, and are reported by CredentialsHealth().
+// Merchant accounts can't be added without a restart.
+func (pg *PrepaidGateway) ReloadCredentials() error {
+	ctx, span := pg.startSpan("paypal.ReloadCredentials")
+	defer span.End()
+
+	if pg.credentials.source == nil {
+		return ErrNoCredentialSource
+	}
+	conf, err := pg.credentials.source(ctx)
+	if err != nil {
+		pg.log.Error("loading PayPal credentials failed", "error", err)
+		return err
+	}
+
+	credentials := map[string]MerchantAccount{}
+	for name, cred := range conf.Accounts {
+		if _, ok := pg.accounts[name]; !ok || name == "" {
+			pg.log.Warn("merchant account ignored until restart", "account", name)
+			continue
+		}
+		credentials[name] = cred
+	}
+	credentials[""] = MerchantAccount{ClientID: conf.ClientID, SecretID: conf.SecretID, ApiBase: conf.ApiBase}
+
+	var firstErr error
+	for _, name := range pg.accountNames() {
+		cred, ok := credentials[name]
+		if !ok || (cred.ClientID == "" && cred.SecretID == "") {
+			continue
+		}
+		account := pg.accounts[name]
+		if cred.ApiBase == "" {
+			cred.ApiBase = conf.ApiBase
+		}
+		if cred.ApiBase == "" {
+			cred.ApiBase = account.current().APIBase
+		}
+		if err := pg.rotateCredentials(withAccount(ctx, account), account, cred); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("account %q: %w", name, err)
+		}
+	}
+	return firstErr
+}
+
+// WatchCredentials() calls ReloadCredentials() every interval of the "credentialRotation" of initConf,
+// until ctx is done. Run it in its own goroutine. Failures are logged and tried again the next time.
+func (pg *PrepaidGateway) WatchCredentials(ctx context.Context) error {
+	if pg.credentials.source == nil {
+		return ErrNoCredentialSource
+	}
+	ticker := time.NewTicker(pg.credentials.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			pg.ReloadCredentials()
+		}
+	}
+}
+
+// rotateCredentials() switches account to cred if they changed and PayPal accepts them.
+func (pg *PrepaidGateway) rotateCredentials(ctx context.Context, account *merchantAccount, cred MerchantAccount) error {
+	current := account.current()
+	if cred.ClientID == current.ClientID && cred.SecretID == current.Secret && cred.ApiBase == current.APIBase {
+		return nil
+	}
+
+	var token *pp.TokenResponse
+	c, err := pp.NewClient(cred.ClientID, cred.SecretID, cred.ApiBase)
+	if err == nil {
+		c.SetHTTPClient(account.httpClient)
+		token, err = c.GetAccessToken(context.WithValue(ctx, noFallbackKey{}, true))
+		err = apiError(err)
+	}
+	if err != nil {
+		account.refuse(err)
+		pg.metrics.credentialsChanged(account.name, false)
+		pg.log.Error("new PayPal credentials refused, keeping the current ones", append(append([]interface{}{}, logFields(ctx)...), "clientID", cred.ClientID, "error", err)...)
+		return err
+	}
+
+	account.rotate(c, token, pg.credentials.grace)
+	pg.metrics.credentialsChanged(account.name, true)
+	pg.log.Info("PayPal credentials rotated", append(append([]interface{}{}, logFields(ctx)...), "clientID", cred.ClientID, "previousClientID", current.ClientID, "gracePeriod", pg.credentials.grace)...)
+
+	// Webhooks belong to the PayPal app, another one needs its own
+	if cred.ClientID != current.ClientID && pg.webhookEventTypes != nil {
+		account.forgetWebhook()
+		pg.syncWebhook(ctx, account) // Failures are reported by Health()
+	}
+	return nil
+}
+
+// current() is the client with the credentials in use.
+func (ma *merchantAccount) current() *pp.Client {
+	ma.mu.RLock()
+	defer ma.mu.RUnlock()
+	return ma.client
+}
+
+func (ma *merchantAccount) refuse(err error) {
+	ma.mu.Lock()
+	defer ma.mu.Unlock()
+	ma.refused = err
+}
+
+// rotate() switches to c and its token, keeping the client in use as the fallback for grace.
+func (ma *merchantAccount) rotate(c *pp.Client, token *pp.TokenResponse, grace time.Duration) {
+	ma.mu.Lock()
+	defer ma.mu.Unlock()
+	ma.previous, ma.previousUntil, ma.previousToken = ma.client, time.Now().Add(grace), nil
+	ma.client = c
+	ma.rotatedAt = time.Now()
+	ma.refused = nil
+	ma.fellBackAt = time.Time{}
+	ma.oauthErr = nil
+	ma.tokenExpiresAt = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+}
+
+// fallback() is the client with the previous credentials, nil once the grace period is over.
+func (ma *merchantAccount) fallback() *pp.Client {
+	ma.mu.RLock()
+	defer ma.mu.RUnlock()
+	if ma.previous == nil || time.Now().After(ma.previousUntil) {
+		return nil
+	}
+	return ma.previous
+}
+
+// fallbackToken() is an access token of the previous credentials, fetched again when close to expire.
+func (ma *merchantAccount) fallbackToken(ctx context.Context, previous *pp.Client) (string, error) {
+	ma.mu.Lock()
+	defer ma.mu.Unlock()
+	if ma.previousToken != nil && time.Until(ma.previousTokenExpiry) > pp.RequestNewTokenBeforeExpiresIn {
+		return ma.previousToken.Token, nil
+	}
+	token, err := previous.GetAccessToken(ctx)
+	if err != nil {
+		return "", err
+	}
+	ma.previousToken, ma.previousTokenExpiry = token, time.Now().Add(time.Duration(token.ExpiresIn)*time.Second)
+	return token.Token, nil
+}
+
+// fellBack() records the previous credentials were used. Tells if it is the first time since the rotation.
+func (ma *merchantAccount) fellBack() bool {
+	ma.mu.Lock()
+	defer ma.mu.Unlock()
+	first := ma.fellBackAt.IsZero()
+	ma.fellBackAt = time.Now()
+	return first
+}
+
+type noFallbackKey struct{}
+
+// credentialFallback sends a request PayPal refused with 401 again with the previous credentials of the account,
+// until the grace period after a rotation is over. An access token refused this way is fetched with the previous
+// credentials, and used by the client until it expires.
+type credentialFallback struct {
+	next    http.RoundTripper
+	account *merchantAccount
+	metrics *gatewayMetrics
+	log     *gatewayLogger
+}
+
+func (t *credentialFallback) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || req.Context().Value(noFallbackKey{}) != nil {
+		return resp, err
+	}
+	previous := t.account.fallback()
+	if previous == nil || (req.Body != nil && req.Body != http.NoBody && req.GetBody == nil) {
+		return resp, err
+	}
+
+	ctx := context.WithValue(req.Context(), noFallbackKey{}, true)
+	retry := req.Clone(ctx)
+	if req.GetBody != nil {
+		body, bodyErr := req.GetBody()
+		if bodyErr != nil {
+			return resp, err
+		}
+		retry.Body = body
+	}
+	if strings.HasSuffix(req.URL.Path, "/v1/oauth2/token") {
+		retry.SetBasicAuth(previous.ClientID, previous.Secret)
+	} else {
+		token, tokenErr := t.account.fallbackToken(ctx, previous)
+		if tokenErr != nil {
+			return resp, err
+		}
+		retry.Header.Set("Authorization", "Bearer "+token)
+	}
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, maxLoggedErrorBody))
+	resp.Body.Close()
+
+	if t.account.fellBack() {
+		t.metrics.credentialsChanged(t.account.name, false)
+		t.log.Error("new PayPal credentials refused, falling back to the previous ones", append(append([]interface{}{}, logFields(ctx)...),
+			"clientID", t.account.current().ClientID, "previousClientID", previous.ClientID, "endpoint", endpointLabel(req.URL.Path))...)
+	}
+	return t.next.RoundTrip(retry)
+}
+
+// CredentialStatus is the health of the credentials of a merchant account, see CredentialsHealth().
+type CredentialStatus struct {
+	Account    string    `json:"account"` // Empty for the default account
+	ClientID   string    `json:"client_id"`
+	RotatedAt  time.Time `json:"rotated_at"`        // Zero if never rotated
+	Refused    string    `json:"refused,omitempty"` // Why the last credentials loaded weren't switched to
+	FellBackAt time.Time `json:"fell_back_at"`      // Last time the previous credentials were used since the rotation
+	GraceUntil time.Time `json:"grace_until"`       // The previous credentials are tried until then
+}
+
+// Healthy() is false if the last credentials loaded were refused, or had to fall back to the previous ones.
+func (cs CredentialStatus) Healthy() bool {
+	return cs.Refused == "" && cs.FellBackAt.IsZero()
+}
+
+// CredentialsHealth() reports the credentials of every merchant account, the default one first.
+func (pg *PrepaidGateway) CredentialsHealth() []CredentialStatus {
+	statuses := make([]CredentialStatus, 0, len(pg.accounts))
+	for _, name := range pg.accountNames() {
+		account := pg.accounts[name]
+		account.mu.RLock()
+		status := CredentialStatus{
+			Account:    name,
+			ClientID:   account.client.ClientID,
+			RotatedAt:  account.rotatedAt,
+			FellBackAt: account.fellBackAt,
+		}
+		if account.refused != nil {
+			status.Refused = account.refused.Error()
+		}
+		if account.previous != nil {
+			status.GraceUntil = account.previousUntil
+		}
+		account.mu.RUnlock()
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
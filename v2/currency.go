@@ -0,0 +1,133 @@
+package paypal
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrUnsupportedCurrency error = errors.New("paypal: currency is not supported by PayPal")
+	ErrBadAmount           error = errors.New("paypal: amount must be positive")
+	ErrAmountTooSmall      error = errors.New("paypal: amount is below the minimum")
+	ErrAmountTooLarge      error = errors.New("paypal: amount is above the maximum")
+	ErrBadAmountLimit      error = errors.New("paypal: amount limit of a currency not supported by PayPal")
+)
+
+// supportedCurrencies are the currencies PayPal accepts for payments,
+// with the number of decimal places allowed for each.
+// https://developer.paypal.com/docs/reports/reference/paypal-supported-currencies/
+var supportedCurrencies = map[string]int{
+	"AUD": 2,
+	"BRL": 2,
+	"CAD": 2,
+	"CNY": 2,
+	"CZK": 2,
+	"DKK": 2,
+	"EUR": 2,
+	"HKD": 2,
+	"HUF": 0,
+	"ILS": 2,
+	"JPY": 0,
+	"MYR": 2,
+	"MXN": 2,
+	"TWD": 0,
+	"NZD": 2,
+	"NOK": 2,
+	"PHP": 2,
+	"PLN": 2,
+	"GBP": 2,
+	"RUB": 2,
+	"SGD": 2,
+	"SEK": 2,
+	"CHF": 2,
+	"THB": 2,
+	"USD": 2,
+}
+
+// AmountLimit bounds the price of a single payment in one currency. 0 means unbounded.
+type AmountLimit struct {
+	Min float64 `json:"min"`
+	Max float64 `json:"max"`
+}
+
+// buildAmountLimits() keys the "amountLimits" of initConf by upper case currency codes, all of which
+// must be supported by PayPal.
+func buildAmountLimits(limits map[string]AmountLimit) (map[string]AmountLimit, error) {
+	built := make(map[string]AmountLimit, len(limits))
+	for currency, limit := range limits {
+		currency = strings.ToUpper(currency)
+		if _, ok := supportedCurrencies[currency]; !ok {
+			return nil, fmt.Errorf("%w: %q", ErrBadAmountLimit, currency)
+		}
+		built[currency] = limit
+	}
+	return built, nil
+}
+
+// AmountError tells why an amount is refused. It unwraps to one of
+// ErrUnsupportedCurrency, ErrBadAmount, ErrAmountTooSmall or ErrAmountTooLarge.
+type AmountError struct {
+	Err      error
+	Currency string
+	Amount   float64
+	Limit    AmountLimit
+}
+
+func (e *AmountError) Error() string {
+	switch e.Err {
+	case ErrAmountTooSmall:
+		return fmt.Sprintf("%s: %s %s < %s", e.Err, formatAmount(e.Amount, e.Currency), e.Currency, formatAmount(e.Limit.Min, e.Currency))
+	case ErrAmountTooLarge:
+		return fmt.Sprintf("%s: %s %s > %s", e.Err, formatAmount(e.Amount, e.Currency), e.Currency, formatAmount(e.Limit.Max, e.Currency))
+	default:
+		return fmt.Sprintf("%s: %v %s", e.Err, e.Amount, e.Currency)
+	}
+}
+
+func (e *AmountError) Unwrap() error {
+	return e.Err
+}
+
+// currencyDecimals() is the number of decimal places PayPal accepts for a currency.
+func currencyDecimals(currency string) int {
+	if decimals, ok := supportedCurrencies[strings.ToUpper(currency)]; ok {
+		return decimals
+	}
+	return 2
+}
+
+func roundAmount(amount float64, currency string) float64 {
+	scale := math.Pow10(currencyDecimals(currency))
+	return math.Round(amount*scale) / scale
+}
+
+// formatAmount() renders an amount the way PayPal expects it in a money object, e.g. "12.05" or "1200".
+func formatAmount(amount float64, currency string) string {
+	return strconv.FormatFloat(roundAmount(amount, currency), 'f', currencyDecimals(currency), 64)
+}
+
+// validateAmount() rounds the amount to the decimal places of the currency
+// and checks it against the currency list and the configured limits.
+func (pg *PrepaidGateway) validateAmount(amount float64, currency string) (float64, error) {
+	currency = strings.ToUpper(currency)
+	if _, ok := supportedCurrencies[currency]; !ok {
+		return amount, &AmountError{Err: ErrUnsupportedCurrency, Currency: currency, Amount: amount}
+	}
+
+	amount = roundAmount(amount, currency)
+	if amount <= 0 {
+		return amount, &AmountError{Err: ErrBadAmount, Currency: currency, Amount: amount}
+	}
+
+	limit := pg.amountLimits[currency]
+	if limit.Min > 0 && amount < limit.Min {
+		return amount, &AmountError{Err: ErrAmountTooSmall, Currency: currency, Amount: amount, Limit: limit}
+	}
+	if limit.Max > 0 && amount > limit.Max {
+		return amount, &AmountError{Err: ErrAmountTooLarge, Currency: currency, Amount: amount, Limit: limit}
+	}
+	return amount, nil
+}
@@ -0,0 +1,88 @@
+package paypal
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestFormatAmount(t *testing.T) {
+	tests := []struct {
+		amount   float64
+		currency string
+		want     string
+	}{
+		{12.05, "USD", "12.05"},
+		{12.005, "USD", "12.01"},
+		{12, "EUR", "12.00"},
+		{0.1 + 0.2, "USD", "0.30"},
+		{1200, "JPY", "1200"},
+		{1200.4, "JPY", "1200"},
+		{1200.5, "JPY", "1201"},
+		{999.5, "HUF", "1000"},
+		{30.49, "TWD", "30"},
+		{30.5, "twd", "31"},
+		{5.123, "XXX", "5.12"}, // Unknown currencies take 2 decimals
+	}
+	for _, tt := range tests {
+		if got := formatAmount(tt.amount, tt.currency); got != tt.want {
+			t.Errorf("formatAmount(%v, %q) = %q, want %q", tt.amount, tt.currency, got, tt.want)
+		}
+	}
+}
+
+func TestValidateAmount(t *testing.T) {
+	pg := &PrepaidGateway{amountLimits: map[string]AmountLimit{
+		"USD": {Min: 1, Max: 500},
+		"JPY": {Min: 100},
+	}}
+	tests := []struct {
+		amount   float64
+		currency string
+		want     float64
+		wantErr  error
+	}{
+		{10, "USD", 10, nil},
+		{10.004, "usd", 10, nil},
+		{0.99, "USD", 0.99, ErrAmountTooSmall},
+		{500.004, "USD", 500, nil},
+		{500.01, "USD", 500.01, ErrAmountTooLarge},
+		{150.4, "JPY", 150, nil},
+		{99.6, "jpy", 100, nil},
+		{99.4, "JPY", 99, ErrAmountTooSmall},
+		{0.4, "HUF", 0, ErrBadAmount},
+		{1500.5, "HUF", 1501, nil},
+		{100.5, "TWD", 101, nil},
+		{-5, "EUR", -5, ErrBadAmount},
+		{0.004, "EUR", 0, ErrBadAmount},
+		{10, "XXX", 10, ErrUnsupportedCurrency},
+		{10, "", 10, ErrUnsupportedCurrency},
+	}
+	for _, tt := range tests {
+		got, err := pg.validateAmount(tt.amount, tt.currency)
+		if !errors.Is(err, tt.wantErr) || (err == nil) != (tt.wantErr == nil) {
+			t.Errorf("validateAmount(%v, %q) error = %v, want %v", tt.amount, tt.currency, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("validateAmount(%v, %q) = %v, want %v", tt.amount, tt.currency, got, tt.want)
+		}
+		var amountErr *AmountError
+		if err != nil && !errors.As(err, &amountErr) {
+			t.Errorf("validateAmount(%v, %q) error = %T, want *AmountError", tt.amount, tt.currency, err)
+		}
+	}
+}
+
+func TestBuildAmountLimits(t *testing.T) {
+	limits, err := buildAmountLimits(map[string]AmountLimit{"usd": {Min: 1}, "JPY": {Max: 10000}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limits["USD"].Min != 1 || limits["JPY"].Max != 10000 || len(limits) != 2 {
+		t.Fatalf("buildAmountLimits() = %v, want keyed by upper case currency", limits)
+	}
+
+	if _, err = buildAmountLimits(map[string]AmountLimit{"USD": {}, "BTC": {Min: 1}}); !errors.Is(err, ErrBadAmountLimit) {
+		t.Fatalf("buildAmountLimits() with BTC error = %v, want ErrBadAmountLimit", err)
+	}
+}
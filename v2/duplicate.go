@@ -0,0 +1,158 @@
+package paypal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/TunnelWork/Ulysses.Lib/payment"
+	"github.com/TunnelWork/payment.PayPal/v2/internal/sqlwrapper"
+	"github.com/gin-gonic/gin"
+	pp "github.com/plutov/paypal/v4"
+)
+
+// DuplicateAction is what to do with a second capture for a ReferenceID already paid,
+// e.g. the buyer paid in two browser tabs. Set by "duplicatePayment" in initConf.
+type DuplicateAction string
+
+const (
+	DuplicateRefund DuplicateAction = "refund" // Refund the second capture in full
+	DuplicateCredit DuplicateAction = "credit" // Keep it and report PAID with its amount, for Ulysses to credit the user
+	DuplicateFlag   DuplicateAction = "flag"   // Keep it and report UNKNOWN for someone to look into. The default.
+
+	// Only saved, for a capture to refund which isn't yet: not completed, or the refund failed.
+	// The refund is tried again when the capture is verified again, e.g. on a webhook redelivery.
+	DuplicateRefundFailed DuplicateAction = "refund_failed"
+)
+
+var (
+	ErrAlreadyPaid        error = errors.New("paypal: reference ID is paid already")
+	ErrBadDuplicateAction error = errors.New("paypal: unknown duplicate payment action")
+)
+
+type DuplicatePayment = sqlwrapper.DuplicateRecord
+
+func (a DuplicateAction) valid() bool {
+	return a == DuplicateRefund || a == DuplicateCredit || a == DuplicateFlag
+}
+
+// DuplicatePayments() lists the extra captures for a ReferenceID and what was done about them.
+func (pg *PrepaidGateway) DuplicatePayments(referenceID string) ([]DuplicatePayment, error) {
+	return sqlwrapper.SelectDuplicates(pg.db, pg.orderSqlTable, referenceID)
+}
+
+// savePending() saves a validated PaymentRequest as pending, reusing the pending row of the same ReferenceID.
+func (pg *PrepaidGateway) savePending(ctx context.Context, pr payment.PaymentRequest) error {
+	done := pg.observeDB(ctx, "PendingOrderID", "ReferenceID", pr.Item.ReferenceID, "account", pg.account(ctx).name)
+	err := sqlwrapper.PendingOrderID(pg.db, pg.orderSqlTable, pr, PREPAID_GATEWAY, pg.account(ctx).name)
+	done(err)
+	if err == sqlwrapper.ErrAlreadyPaid {
+		return ErrAlreadyPaid
+	}
+	return err
+}
+
+// handleDuplicate() deals with capture of a ReferenceID paid by paidCaptureID before, according to the DuplicateAction.
+// Handling the same capture again only gives the response, unless its refund is still due.
+func (pg *PrepaidGateway) handleDuplicate(ctx context.Context, ReferenceID, OrderID, paidCaptureID string, capture *pp.CaptureAmount) (int, gin.H) {
+	record := DuplicatePayment{
+		ReferenceID:   ReferenceID,
+		OrderID:       OrderID,
+		CaptureID:     capture.ID,
+		PaidCaptureID: paidCaptureID,
+	}
+	if capture.Amount != nil {
+		record.Currency = capture.Amount.Currency
+		record.Amount, _ = strconv.ParseFloat(capture.Amount.Value, 64)
+	}
+
+	done := pg.observeDB(ctx, "SelectDuplicateByCapture", "CaptureID", capture.ID)
+	handled, err := sqlwrapper.SelectDuplicateByCapture(pg.db, pg.orderSqlTable, capture.ID)
+	done(err)
+	if err == nil && DuplicateAction(handled.Action) != DuplicateRefundFailed {
+		return duplicateResponse(DuplicateAction(handled.Action))
+	}
+
+	record.Action = string(pg.duplicateAction)
+	if pg.duplicateAction == DuplicateRefund {
+		// Saved as refunded only once it is. Until then it is saved as DuplicateRefundFailed, e.g. while
+		// the capture is PENDING or PayPal fails, and refunding is tried again when it is verified again.
+		if pg.captureCompleted(ctx, capture.ID) {
+			status, resp, refunded := pg.refundFailedCapture(ctx, AutoRefundDuplicate, fmt.Sprintf("already paid by capture %s", paidCaptureID), ReferenceID, OrderID, capture)
+			if !refunded {
+				record.Action = string(DuplicateRefundFailed)
+			}
+			pg.saveDuplicate(ctx, record)
+			return status, resp
+		}
+		record.Action = string(DuplicateRefundFailed)
+	}
+
+	var recordMsg string
+	if err = pg.saveDuplicate(ctx, record); err != nil {
+		recordMsg = fmt.Sprintf(" Duplicate not saved: %s", err)
+	}
+
+	switch DuplicateAction(record.Action) {
+	case DuplicateCredit:
+		if pg.UpdateHandler != nil {
+			(*pg.UpdateHandler)(
+				ReferenceID,
+				payment.PaymentResult{
+					Status: payment.PAID,
+					Unit: payment.PaymentUnit{
+						ReferenceID: ReferenceID,
+						Currency:    record.Currency,
+						Price:       record.Amount,
+					},
+					Msg: fmt.Sprintf("(Credit)ReferenceID %s: duplicate capture %s of %s %s kept as credit, already paid by capture %s.%s",
+						ReferenceID, capture.ID, formatAmount(record.Amount, record.Currency), record.Currency, paidCaptureID, recordMsg),
+				},
+			)
+		}
+	case DuplicateRefundFailed:
+		if pg.UpdateHandler != nil {
+			(*pg.UpdateHandler)(
+				ReferenceID,
+				payment.PaymentResult{
+					Status: payment.UNKNOWN,
+					Msg: fmt.Sprintf("(Verified)ReferenceID %s: duplicate payment, capture %s of pp.Order %s, already paid by capture %s, not completed yet to be refunded.%s",
+						ReferenceID, capture.ID, OrderID, paidCaptureID, recordMsg),
+				},
+			)
+		}
+	default:
+		if pg.UpdateHandler != nil {
+			(*pg.UpdateHandler)(
+				ReferenceID,
+				payment.PaymentResult{
+					Status: payment.UNKNOWN,
+					Msg: fmt.Sprintf("(Verified)ReferenceID %s: duplicate payment, capture %s of pp.Order %s, already paid by capture %s.%s",
+						ReferenceID, capture.ID, OrderID, paidCaptureID, recordMsg),
+				},
+			)
+		}
+	}
+	return duplicateResponse(DuplicateAction(record.Action))
+}
+
+// saveDuplicate() saves what was done about a duplicate capture, updating the action if it is saved already.
+func (pg *PrepaidGateway) saveDuplicate(ctx context.Context, record DuplicatePayment) error {
+	done := pg.observeDB(ctx, "InsertDuplicate", "ReferenceID", record.ReferenceID, "OrderID", record.OrderID, "CaptureID", record.CaptureID, "action", record.Action)
+	err := sqlwrapper.InsertDuplicate(pg.db, pg.orderSqlTable, record)
+	done(err)
+	return err
+}
+
+func duplicateResponse(action DuplicateAction) (int, gin.H) {
+	switch action {
+	case DuplicateRefund:
+		return http.StatusConflict, PAYMENT_REFUNDED
+	case DuplicateCredit:
+		return http.StatusOK, PAYMENT_CREDITED
+	default:
+		return http.StatusConflict, PAYMENT_ALREADY_PAID
+	}
+}
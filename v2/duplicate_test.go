@@ -0,0 +1,111 @@
+package paypal
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/TunnelWork/Ulysses.Lib/payment"
+	"github.com/gin-gonic/gin"
+)
+
+func TestHandleDuplicate(t *testing.T) {
+	tests := []struct {
+		name          string
+		action        DuplicateAction
+		captureStatus string
+		refundFail    bool
+		wantStatus    int
+		wantResp      gin.H
+		wantSaved     DuplicateAction
+		wantRefunds   int
+		wantResult    payment.PaymentStatus
+	}{
+		{"flag", DuplicateFlag, "COMPLETED", false, http.StatusConflict, PAYMENT_ALREADY_PAID, DuplicateFlag, 0, payment.UNKNOWN},
+		{"credit", DuplicateCredit, "COMPLETED", false, http.StatusOK, PAYMENT_CREDITED, DuplicateCredit, 0, payment.PAID},
+		{"refund", DuplicateRefund, "COMPLETED", false, http.StatusConflict, PAYMENT_REFUNDED, DuplicateRefund, 1, payment.UNPAID},
+		{"refund failed", DuplicateRefund, "COMPLETED", true, http.StatusInternalServerError, SERVER_PAYPAL_BAD_ORDER, DuplicateRefundFailed, 0, payment.UNKNOWN},
+		{"refund of pending capture", DuplicateRefund, "PENDING", false, http.StatusConflict, PAYMENT_ALREADY_PAID, DuplicateRefundFailed, 0, payment.UNKNOWN},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			paypal, srv := newFakePayPal(t)
+			paypal.status["CAP-2"] = tt.captureStatus
+			paypal.refundFail = tt.refundFail
+			captures := newFakeCaptures()
+			pg, results := newTestGateway(t, newFakeDB(t, captures.query), srv)
+			pg.duplicateAction = tt.action
+
+			status, resp := pg.handleDuplicate(context.Background(), "REF-1", "ORDER-2", "CAP-1", testCapture("CAP-2"))
+			if status != tt.wantStatus || !reflect.DeepEqual(resp, tt.wantResp) {
+				t.Fatalf("handleDuplicate() = %d, %v, want %d, %v", status, resp, tt.wantStatus, tt.wantResp)
+			}
+			if saved := DuplicateAction(captures.duplicates["CAP-2"]); saved != tt.wantSaved {
+				t.Fatalf("saved %q, want %q", saved, tt.wantSaved)
+			}
+			if refunds := paypal.refunded(); len(refunds) != tt.wantRefunds {
+				t.Fatalf("refunded %v, want %d refunds", refunds, tt.wantRefunds)
+			}
+			if len(*results) != 1 || (*results)[0].Status != tt.wantResult {
+				t.Fatalf("UpdateHandler got %+v, want one %v", *results, tt.wantResult)
+			}
+		})
+	}
+}
+
+func TestHandleDuplicateAgain(t *testing.T) {
+	tests := []struct {
+		name        string
+		action      DuplicateAction
+		wantRefunds int
+	}{
+		{"flagged only responds", DuplicateFlag, 0},
+		{"refunded only responds", DuplicateRefund, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			paypal, srv := newFakePayPal(t)
+			pg, results := newTestGateway(t, newFakeDB(t, newFakeCaptures().query), srv)
+			pg.duplicateAction = tt.action
+
+			first, firstResp := pg.handleDuplicate(context.Background(), "REF-1", "ORDER-2", "CAP-1", testCapture("CAP-2"))
+			again, againResp := pg.handleDuplicate(context.Background(), "REF-1", "ORDER-2", "CAP-1", testCapture("CAP-2"))
+			if first != again || !reflect.DeepEqual(firstResp, againResp) {
+				t.Fatalf("handleDuplicate() again = %d, %v, want %d, %v", again, againResp, first, firstResp)
+			}
+			if refunds := paypal.refunded(); len(refunds) != tt.wantRefunds {
+				t.Fatalf("refunded %v, want %d refunds", refunds, tt.wantRefunds)
+			}
+			if len(*results) != 1 {
+				t.Fatalf("UpdateHandler got %+v, want only the first", *results)
+			}
+		})
+	}
+}
+
+func TestHandleDuplicateRetriesFailedRefund(t *testing.T) {
+	paypal, srv := newFakePayPal(t)
+	paypal.refundFail = true
+	captures := newFakeCaptures()
+	pg, _ := newTestGateway(t, newFakeDB(t, captures.query), srv)
+	pg.duplicateAction = DuplicateRefund
+
+	if status, _ := pg.handleDuplicate(context.Background(), "REF-1", "ORDER-2", "CAP-1", testCapture("CAP-2")); status != http.StatusInternalServerError {
+		t.Fatalf("handleDuplicate() = %d, want %d", status, http.StatusInternalServerError)
+	}
+
+	paypal.mu.Lock()
+	paypal.refundFail = false
+	paypal.mu.Unlock()
+	status, resp := pg.handleDuplicate(context.Background(), "REF-1", "ORDER-2", "CAP-1", testCapture("CAP-2"))
+	if status != http.StatusConflict || !reflect.DeepEqual(resp, PAYMENT_REFUNDED) {
+		t.Fatalf("handleDuplicate() retried = %d, %v, want %d, %v", status, resp, http.StatusConflict, PAYMENT_REFUNDED)
+	}
+	if saved := DuplicateAction(captures.duplicates["CAP-2"]); saved != DuplicateRefund {
+		t.Fatalf("saved %q, want %q", saved, DuplicateRefund)
+	}
+	if refunds := paypal.refunded(); len(refunds) != 1 || refunds[0] != "CAP-2" {
+		t.Fatalf("refunded %v, want CAP-2", refunds)
+	}
+}
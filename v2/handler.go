@@ -0,0 +1,172 @@
+package paypal
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/TunnelWork/Ulysses.Lib/api"
+	"github.com/TunnelWork/Ulysses.Lib/payment"
+	"github.com/gin-gonic/gin"
+)
+
+// route is an endpoint of the gateway. path is relative to callbackBase + "/paypal/<instanceID>".
+type route struct {
+	method  string
+	path    string
+	handler *func(*gin.Context)
+}
+
+// routes() lists the endpoints of the gateway, whose URLs callbackURL() gives to PayPal and the buyer.
+func (pg *PrepaidGateway) routes() []route {
+	routes := []route{
+		// PayPal JS SDK callbacks
+		{http.MethodPost, "/onClose", &pg.onClose},
+		{http.MethodGet, "/checkout/:ref_id", &pg.onCheckoutPage},
+
+		// Checkout without JavaScript, the order is only created by the POST of the page
+		{http.MethodGet, "/redirect/:ref_id", &pg.onRedirectPage},
+		{http.MethodPost, "/redirect/:ref_id", &pg.onRedirect},
+
+		// Card fields: orders are created and captured on the server
+		{http.MethodPost, "/card/:ref_id/order", &pg.onCardOrder},
+		{http.MethodPost, "/card/:ref_id/capture", &pg.onCardCapture},
+
+		// return_url and cancel_url of orders created on the server, e.g. payment links and redirect checkout
+		{http.MethodGet, "/return", &pg.onReturn},
+		{http.MethodGet, "/cancel", &pg.onCancel},
+	}
+	if pg.healthToken != "" {
+		routes = append(routes, route{http.MethodGet, "/health", &pg.onHealth})
+	}
+	if pg.webhookEventTypes != nil {
+		// Webhook events, "/webhook" for the default account
+		routes = append(routes, route{http.MethodPost, "/webhook", &pg.onWebhook}, route{http.MethodPost, "/webhook/:account", &pg.onWebhook})
+	}
+	return routes
+}
+
+// newRouter() serves routes on their own, for Handler(). X-Forwarded-For is only trusted from trustedProxies.
+func newRouter(routes []route, trustedProxies []string) (http.Handler, error) {
+	proxies, err := parseTrustedProxies(trustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	router := gin.New()
+	for _, r := range routes {
+		handler := r.handler
+		router.Handle(r.method, r.path, func(c *gin.Context) { (*handler)(c) })
+	}
+	return proxies.forwarded(router), nil
+}
+
+type trustedProxies []*net.IPNet
+
+func parseTrustedProxies(list []string) (trustedProxies, error) {
+	var proxies trustedProxies
+	for _, proxy := range list {
+		if !strings.Contains(proxy, "/") {
+			if ip := net.ParseIP(proxy); ip != nil && ip.To4() != nil {
+				proxy += "/32"
+			} else {
+				proxy += "/128"
+			}
+		}
+		_, cidr, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("%w: trusted proxy %q", ErrBadInitConf, proxy)
+		}
+		proxies = append(proxies, cidr)
+	}
+	return proxies, nil
+}
+
+func (tp trustedProxies) trusted(ip net.IP) bool {
+	for _, cidr := range tp {
+		if cidr.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwarded() sets the RemoteAddr of requests through trusted proxies to the client IP they forwarded:
+// the last one of X-Forwarded-For not a trusted proxy itself. gin.Context.ClientIP() then gives it.
+func (tp trustedProxies) forwarded(next http.Handler) http.Handler {
+	if len(tp) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil || !tp.trusted(net.ParseIP(host)) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			ip := net.ParseIP(strings.TrimSpace(hops[i]))
+			if ip == nil {
+				break
+			}
+			if !tp.trusted(ip) {
+				r = r.WithContext(r.Context()) // A shallow copy, the caller's request is left as is
+				r.RemoteAddr = net.JoinHostPort(ip.String(), "0")
+				break
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Handler() serves every endpoint of the gateway as a net/http handler, at paths relative to
+// callbackBase + "/paypal/<instanceID>", which is where PayPal and the buyer are sent. E.g. with
+// callbackBase https://example.com/api/payment/callback and instance ID 1:
+//
+//	prefix := "/api/payment/callback/paypal/1"
+//	mux.Handle(prefix+"/", http.StripPrefix(prefix, pg.Handler()))
+func (pg *PrepaidGateway) Handler() http.Handler {
+	return pg.router
+}
+
+// RegisterRoutes() registers every endpoint of the gateway on a gin router, at paypal/<instanceID>/...
+// relative to r, which must be served at the path of callbackBase.
+func (pg *PrepaidGateway) RegisterRoutes(r gin.IRouter) {
+	for _, route := range pg.routes() {
+		handler := route.handler
+		r.Handle(route.method, fmt.Sprintf("paypal/%s%s", pg.instanceID, route.path), func(c *gin.Context) { (*handler)(c) })
+	}
+}
+
+// registerUlyssesRoutes() registers every endpoint of the gateway on the payment callback router of Ulysses.
+func (pg *PrepaidGateway) registerUlyssesRoutes() {
+	for _, route := range pg.routes() {
+		// e.g. https://ulysses.tunnel.work/api/payment/callback/paypal/$id/onClose
+		path := fmt.Sprintf("paypal/%s%s", pg.instanceID, route.path)
+		switch route.method {
+		case http.MethodGet:
+			api.CGET(api.PaymentCallback, path, (*gin.HandlerFunc)(route.handler))
+		case http.MethodPost:
+			api.CPOST(api.PaymentCallback, path, (*gin.HandlerFunc)(route.handler))
+		}
+	}
+}
+
+// SetUpdateHandler() sets the func notified of payment results, as OnStatusChange() does without
+// registering the endpoints with Ulysses.
+func (pg *PrepaidGateway) SetUpdateHandler(UpdateHandler *func(referenceID string, newResult payment.PaymentResult)) {
+	if UpdateHandler != nil && pg.log != nil {
+		// Results reported are logged too, UNKNOWN ones need a look
+		handler := *UpdateHandler
+		logged := func(referenceID string, newResult payment.PaymentResult) {
+			log := pg.log.Info
+			if newResult.Status == payment.UNKNOWN {
+				log = pg.log.Warn
+			}
+			log("payment result reported", "ReferenceID", referenceID, "status", newResult.Status, "message", newResult.Msg)
+			handler(referenceID, newResult)
+		}
+		UpdateHandler = &logged
+	}
+	pg.UpdateHandler = UpdateHandler
+}
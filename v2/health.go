@@ -0,0 +1,246 @@
+package paypal
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/TunnelWork/payment.PayPal/v2/internal/sqlwrapper"
+	"github.com/gin-gonic/gin"
+	pp "github.com/plutov/paypal/v4"
+)
+
+type HealthStatus string
+
+const (
+	HealthOK       HealthStatus = "ok"
+	HealthDegraded HealthStatus = "degraded" // Payments may fail for some merchant accounts, or soon
+	HealthDown     HealthStatus = "down"     // Payments can't be taken
+)
+
+// Health is a snapshot of what the gateway depends on, see Health().
+type Health struct {
+	Status          HealthStatus    `json:"status"`
+	Mode            string          `json:"mode"`             // sandbox or live, of the default account
+	PayPalAvailable bool            `json:"paypal_available"` // false while the circuit breaker fails PayPal calls fast
+	Database        DatabaseHealth  `json:"database"`
+	Accounts        []AccountHealth `json:"accounts"` // The default one first
+	Webhooks        WebhookHealth   `json:"webhooks"`
+	CheckedAt       time.Time       `json:"checked_at"`
+}
+
+type DatabaseHealth struct {
+	Reachable           bool   `json:"reachable"`
+	Error               string `json:"error,omitempty"`
+	SchemaVersion       int    `json:"schema_version"`
+	LatestSchemaVersion int    `json:"latest_schema_version"` // A lower SchemaVersion needs migrating, see paypalctl migrate
+}
+
+type AccountHealth struct {
+	Account        string           `json:"account"` // Empty for the default account
+	Mode           string           `json:"mode"`    // sandbox or live
+	OAuth          string           `json:"oauth"`   // ok, failing, or pending before the first access token is asked for
+	OAuthError     string           `json:"oauth_error,omitempty"`
+	TokenExpiresAt time.Time        `json:"token_expires_at"` // Zero without an access token. Renewed on use, so it may lapse while idle.
+	Credentials    CredentialStatus `json:"credentials"`
+	Webhook        WebhookHealth    `json:"webhook"`
+}
+
+// WebhookHealth tells if PayPal sends the gateway webhook events: not_configured, unless the "webhooks" of
+// initConf is set, subscribed, pending before the first subscription, or failing. Payments are learnt of
+// through the callbacks of the buyer's browser, so webhooks failing only degrade the gateway.
+type WebhookHealth struct {
+	Status    string `json:"status"`
+	WebhookID string `json:"webhook_id,omitempty"` // Still used to verify events while failing, if subscribed before
+	URL       string `json:"url,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+var webhookSeverity = map[string]int{"not_configured": 0, "subscribed": 1, "pending": 2, "failing": 3}
+
+// Health() checks the database and reports the last known state of PayPal OAuth for every merchant account,
+// without calling PayPal. Cheap enough for a liveness probe.
+func (pg *PrepaidGateway) Health() Health {
+	ctx, span := pg.startSpan("paypal.Health")
+	defer span.End()
+
+	health := Health{
+		Mode:            apiMode(pg.accounts[""].current().APIBase),
+		PayPalAvailable: pg.PayPalAvailable(),
+		Database:        pg.databaseHealth(ctx),
+		Webhooks:        WebhookHealth{Status: "not_configured"},
+		CheckedAt:       time.Now(),
+	}
+	credentials := pg.CredentialsHealth()
+	failing := 0
+	degraded := health.Database.SchemaVersion != health.Database.LatestSchemaVersion
+	for i, name := range pg.accountNames() {
+		account := pg.accounts[name]
+		account.mu.RLock()
+		ah := AccountHealth{
+			Account:        name,
+			Mode:           apiMode(account.client.APIBase),
+			OAuth:          "pending",
+			TokenExpiresAt: account.tokenExpiresAt,
+			Credentials:    credentials[i],
+			Webhook:        pg.webhookHealth(account),
+		}
+		if account.oauthErr != nil {
+			ah.OAuth, ah.OAuthError = "failing", account.oauthErr.Error()
+		} else if !account.tokenExpiresAt.IsZero() {
+			ah.OAuth = "ok"
+		}
+		account.mu.RUnlock()
+
+		if ah.OAuth == "failing" {
+			failing++
+		}
+		if ah.OAuth != "ok" || !ah.Credentials.Healthy() || ah.Webhook.Status == "failing" || ah.Webhook.Status == "pending" {
+			degraded = true
+		}
+		if webhookSeverity[ah.Webhook.Status] > webhookSeverity[health.Webhooks.Status] {
+			health.Webhooks.Status = ah.Webhook.Status // The worst of the accounts
+		}
+		health.Accounts = append(health.Accounts, ah)
+	}
+
+	switch {
+	case !health.Database.Reachable, !health.PayPalAvailable, failing == len(health.Accounts):
+		health.Status = HealthDown
+	case degraded:
+		health.Status = HealthDegraded
+	default:
+		health.Status = HealthOK
+	}
+	return health
+}
+
+// CheckOAuth() asks PayPal for an access token of every merchant account, for Health() to report
+// the state of accounts not used since a start without OAuth, see NoStartup of GatewayConfig.
+func (pg *PrepaidGateway) CheckOAuth() {
+	for _, name := range pg.accountNames() {
+		ctx := withLogFields(context.Background(), "account", name)
+		pg.accounts[name].current().GetAccessToken(ctx) // Recorded by tokenTransport
+	}
+}
+
+func (pg *PrepaidGateway) databaseHealth(ctx context.Context) DatabaseHealth {
+	dh := DatabaseHealth{LatestSchemaVersion: sqlwrapper.LatestSchemaVersion()}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	done := pg.observeDB(ctx, "Ping")
+	err := pg.db.PingContext(ctx)
+	done(err)
+	if err == nil {
+		done = pg.observeDB(ctx, "SchemaVersion")
+		dh.SchemaVersion, err = sqlwrapper.SchemaVersion(pg.db, pg.orderSqlTable)
+		done(err)
+	}
+	if err != nil {
+		dh.Error = err.Error()
+		return dh
+	}
+	dh.Reachable = true
+	return dh
+}
+
+func apiMode(apiBase string) string {
+	if strings.Contains(apiBase, "sandbox") {
+		return "sandbox"
+	}
+	return "live"
+}
+
+// handlerHealth() serves Health() to requests bearing the healthToken of initConf, with 503 if down.
+func (pg *PrepaidGateway) handlerHealth(c *gin.Context) {
+	if subtle.ConstantTimeCompare([]byte(c.GetHeader("Authorization")), []byte("Bearer "+pg.healthToken)) != 1 {
+		c.JSON(http.StatusUnauthorized, UNAUTHORIZED)
+		return
+	}
+	health := pg.Health()
+	status := http.StatusOK
+	if health.Status == HealthDown {
+		status = http.StatusServiceUnavailable
+	}
+	c.JSON(status, health)
+}
+
+// tokenTransport keeps track of the access tokens of an account, and fetches one before the first call
+// if the gateway started without, see the lazyStartup of initConf.
+type tokenTransport struct {
+	next    http.RoundTripper
+	account *merchantAccount
+}
+
+func (t *tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !strings.HasSuffix(req.URL.Path, "/v1/oauth2/token") {
+		if req.Header.Get("Authorization") != "" {
+			return t.next.RoundTrip(req)
+		}
+		token, err := t.account.lazyToken(req.Context())
+		if err != nil {
+			return nil, err
+		}
+		req = req.Clone(req.Context()) // A RoundTripper must not modify the request
+		req.Header.Set("Authorization", "Bearer "+token)
+		return t.next.RoundTrip(req)
+	}
+
+	// Tokens asked for with other credentials, e.g. while rotating, are not the account's yet
+	clientID, _, _ := req.BasicAuth()
+	if clientID != t.account.current().ClientID {
+		return t.next.RoundTrip(req)
+	}
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		t.account.tokenFailed(apiError(err))
+		return resp, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		t.account.tokenFailed(&APIError{Method: req.Method, Endpoint: endpointLabel(req.URL.Path), StatusCode: resp.StatusCode})
+		return resp, err
+	}
+
+	// Read to learn when it expires, and put back for pp.Client
+	body, readErr := ioutil.ReadAll(io.LimitReader(resp.Body, maxLoggedErrorBody))
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	var token pp.TokenResponse
+	if readErr == nil && json.Unmarshal(body, &token) == nil && token.Token != "" {
+		t.account.tokenIssued(&token)
+	}
+	return resp, err
+}
+
+// lazyToken() is the access token of the client in use, asked for if there is none yet.
+func (ma *merchantAccount) lazyToken(ctx context.Context) (string, error) {
+	c := ma.current()
+	c.Lock() // As pp.Client.SendWithAuth() does before renewing its token
+	defer c.Unlock()
+	if c.Token == nil {
+		if _, err := c.GetAccessToken(ctx); err != nil {
+			return "", apiError(err)
+		}
+	}
+	return c.Token.Token, nil
+}
+
+func (ma *merchantAccount) tokenIssued(token *pp.TokenResponse) {
+	ma.mu.Lock()
+	defer ma.mu.Unlock()
+	ma.oauthErr = nil
+	ma.tokenExpiresAt = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+}
+
+func (ma *merchantAccount) tokenFailed(err error) {
+	ma.mu.Lock()
+	defer ma.mu.Unlock()
+	ma.oauthErr = err
+}
@@ -0,0 +1,146 @@
+package sqlwrapper
+
+import (
+	"database/sql"
+)
+
+// AutoRefundRecord is a capture refunded in full because it failed verification.
+// Unlike RefundRecord, it doesn't count towards the Refunded amount of the order.
+type AutoRefundRecord struct {
+	ReferenceID string  `json:"reference_id"`
+	OrderID     string  `json:"order_id"`
+	CaptureID   string  `json:"capture_id"`
+	Reason      string  `json:"reason"`
+	Detail      string  `json:"detail"`
+	Currency    string  `json:"currency"`
+	Amount      float64 `json:"amount"`
+	RefundID    string  `json:"refund_id"`
+	Status      string  `json:"status"`
+	CreatedAt   string  `json:"created_at"`
+}
+
+func InsertAutoRefund(db *sql.DB, tbl string, record AutoRefundRecord) error {
+	if db == nil || record.CaptureID == "" {
+		return ErrNilPointer
+	}
+
+	stmtInsertAutoRefund, err := db.Prepare(`INSERT INTO ` + tbl + `_auto_refunds (
+        ReferenceID, OrderID, CaptureID, Reason, Detail, Currency, Amount, RefundID, Status, CreatedAt
+    ) VALUE(?, ?, ?, ?, ?, ?, ?, ?, ?, NOW());`)
+	if err != nil {
+		return err
+	}
+	defer stmtInsertAutoRefund.Close()
+
+	detail := record.Detail
+	if len(detail) > 255 {
+		detail = detail[:255]
+	}
+	_, err = stmtInsertAutoRefund.Exec(
+		record.ReferenceID,
+		record.OrderID,
+		record.CaptureID,
+		record.Reason,
+		detail,
+		record.Currency,
+		record.Amount,
+		record.RefundID,
+		record.Status,
+	)
+	return err
+}
+
+// SelectAutoRefundByCapture() tells if a capture has been refunded automatically already.
+func SelectAutoRefundByCapture(db *sql.DB, tbl, captureID string) (AutoRefundRecord, error) {
+	if db == nil || captureID == "" {
+		return AutoRefundRecord{}, ErrNilPointer
+	}
+
+	stmtSelectAutoRefund, err := db.Prepare(`SELECT ReferenceID, OrderID, CaptureID, Reason, Detail, Currency, Amount, RefundID, Status, CreatedAt FROM ` + tbl + `_auto_refunds WHERE CaptureID = ?;`)
+	if err != nil {
+		return AutoRefundRecord{}, err
+	}
+	defer stmtSelectAutoRefund.Close()
+
+	var record AutoRefundRecord
+	err = stmtSelectAutoRefund.QueryRow(captureID).Scan(
+		&record.ReferenceID,
+		&record.OrderID,
+		&record.CaptureID,
+		&record.Reason,
+		&record.Detail,
+		&record.Currency,
+		&record.Amount,
+		&record.RefundID,
+		&record.Status,
+		&record.CreatedAt,
+	)
+	return record, err
+}
+
+func SelectAutoRefunds(db *sql.DB, tbl, referenceID string) ([]AutoRefundRecord, error) {
+	if db == nil || referenceID == "" {
+		return nil, ErrNilPointer
+	}
+
+	stmtSelectAutoRefunds, err := db.Prepare(`SELECT ReferenceID, OrderID, CaptureID, Reason, Detail, Currency, Amount, RefundID, Status, CreatedAt FROM ` + tbl + `_auto_refunds WHERE ReferenceID = ? ORDER BY ID ASC;`)
+	if err != nil {
+		return nil, err
+	}
+	defer stmtSelectAutoRefunds.Close()
+
+	rows, err := stmtSelectAutoRefunds.Query(referenceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := []AutoRefundRecord{}
+	for rows.Next() {
+		var record AutoRefundRecord
+		err = rows.Scan(
+			&record.ReferenceID,
+			&record.OrderID,
+			&record.CaptureID,
+			&record.Reason,
+			&record.Detail,
+			&record.Currency,
+			&record.Amount,
+			&record.RefundID,
+			&record.Status,
+			&record.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
+
+// SelectAutoRefundsByCaptures() returns the automatic refunds of any of captureIDs.
+func SelectAutoRefundsByCaptures(db *sql.DB, tbl string, captureIDs []string) ([]AutoRefundRecord, error) {
+	if db == nil {
+		return nil, ErrNilPointer
+	}
+
+	var records []AutoRefundRecord
+	err := queryByCaptureIDs(db, `SELECT ReferenceID, OrderID, CaptureID, Reason, Detail, Currency, Amount, RefundID, Status, CreatedAt FROM `+tbl+`_auto_refunds WHERE CaptureID IN (%s);`, captureIDs, func(rows *sql.Rows) error {
+		var record AutoRefundRecord
+		err := rows.Scan(
+			&record.ReferenceID,
+			&record.OrderID,
+			&record.CaptureID,
+			&record.Reason,
+			&record.Detail,
+			&record.Currency,
+			&record.Amount,
+			&record.RefundID,
+			&record.Status,
+			&record.CreatedAt,
+		)
+		records = append(records, record)
+		return err
+	})
+	return records, err
+}
@@ -0,0 +1,175 @@
+package sqlwrapper
+
+import (
+	"database/sql"
+)
+
+// Breakdown is what the merchant actually receives for a capture, or gives back for a refund.
+// Gross, Fee and Net are in the currency of the order.
+type Breakdown struct {
+	Gross              float64 `json:"gross"`
+	Fee                float64 `json:"fee"`
+	Net                float64 `json:"net"`
+	ReceivableAmount   float64 `json:"receivable_amount"`
+	ReceivableCurrency string  `json:"receivable_currency"`
+	ExchangeRate       float64 `json:"exchange_rate"`
+}
+
+type RefundRecord struct {
+	RefundID    string `json:"refund_id"`
+	CaptureID   string `json:"capture_id"`
+	ReferenceID string `json:"reference_id"`
+	Status      string `json:"status"`
+	Currency    string `json:"currency"`
+	Breakdown
+	CreatedAt string `json:"created_at"`
+}
+
+func UpdateCaptureBreakdown(db *sql.DB, tbl, referenceID string, breakdown Breakdown) error {
+	if db == nil || referenceID == "" {
+		return ErrNilPointer
+	}
+
+	stmtUpdateBreakdown, err := db.Prepare(`
+    UPDATE ` + tbl + ` 
+    SET 
+    GrossAmount = ?,
+    PayPalFee = ?,
+    NetAmount = ?,
+    ReceivableAmount = ?,
+    ReceivableCurrency = ?,
+    ExchangeRate = ? 
+    WHERE 
+    ReferenceID = ?;`)
+	if err != nil {
+		return err
+	}
+	defer stmtUpdateBreakdown.Close()
+
+	_, err = stmtUpdateBreakdown.Exec(
+		breakdown.Gross,
+		breakdown.Fee,
+		breakdown.Net,
+		breakdown.ReceivableAmount,
+		breakdown.ReceivableCurrency,
+		breakdown.ExchangeRate,
+		referenceID,
+	)
+	return err
+}
+
+func SelectCaptureBreakdown(db *sql.DB, tbl, referenceID string) (Breakdown, error) {
+	if db == nil || referenceID == "" {
+		return Breakdown{}, ErrNilPointer
+	}
+
+	var breakdown Breakdown
+	stmtSelectBreakdown, err := db.Prepare(`SELECT GrossAmount, PayPalFee, NetAmount, ReceivableAmount, ReceivableCurrency, ExchangeRate FROM ` + tbl + ` WHERE ReferenceID = ?;`)
+	if err != nil {
+		return breakdown, err
+	}
+	defer stmtSelectBreakdown.Close()
+
+	err = stmtSelectBreakdown.QueryRow(referenceID).Scan(
+		&breakdown.Gross,
+		&breakdown.Fee,
+		&breakdown.Net,
+		&breakdown.ReceivableAmount,
+		&breakdown.ReceivableCurrency,
+		&breakdown.ExchangeRate,
+	)
+	return breakdown, err
+}
+
+// InsertRefund() records a refund and adds its gross amount to the order's Refunded total.
+func InsertRefund(db *sql.DB, tbl string, refund RefundRecord) error {
+	if db == nil || refund.ReferenceID == "" {
+		return ErrNilPointer
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`INSERT INTO `+tbl+`_refunds (
+		RefundID,
+		CaptureID,
+		ReferenceID,
+		Status,
+		Currency,
+		GrossAmount,
+		PayPalFee,
+		NetAmount,
+		CreatedAt
+	) VALUE(
+		?,
+		?,
+		?,
+		?,
+		?,
+		?,
+		?,
+		?,
+		NOW()
+	);`,
+		refund.RefundID,
+		refund.CaptureID,
+		refund.ReferenceID,
+		refund.Status,
+		refund.Currency,
+		refund.Gross,
+		refund.Fee,
+		refund.Net,
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`UPDATE `+tbl+` SET Refunded = Refunded + ? WHERE ReferenceID = ?;`, refund.Gross, refund.ReferenceID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func SelectRefunds(db *sql.DB, tbl, referenceID string) ([]RefundRecord, error) {
+	if db == nil || referenceID == "" {
+		return nil, ErrNilPointer
+	}
+
+	stmtSelectRefunds, err := db.Prepare(`SELECT RefundID, CaptureID, ReferenceID, Status, Currency, GrossAmount, PayPalFee, NetAmount, CreatedAt FROM ` + tbl + `_refunds WHERE ReferenceID = ? ORDER BY ID ASC;`)
+	if err != nil {
+		return nil, err
+	}
+	defer stmtSelectRefunds.Close()
+
+	rows, err := stmtSelectRefunds.Query(referenceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var refunds []RefundRecord
+	for rows.Next() {
+		var refund RefundRecord
+		err = rows.Scan(
+			&refund.RefundID,
+			&refund.CaptureID,
+			&refund.ReferenceID,
+			&refund.Status,
+			&refund.Currency,
+			&refund.Gross,
+			&refund.Fee,
+			&refund.Net,
+			&refund.CreatedAt,
+		)
+		if err != nil {
+			return refunds, err
+		}
+		refunds = append(refunds, refund)
+	}
+	return refunds, rows.Err()
+}
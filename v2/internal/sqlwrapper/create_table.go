@@ -3,7 +3,6 @@ package sqlwrapper
 import (
 	"database/sql"
 	"errors"
-	"strings"
 )
 
 // InitializeTables() is not responsible to close the input *sql.DB
@@ -12,20 +11,6 @@ func InitializeTables(db *sql.DB, tbl string) error {
 		return errors.New("sqlhelper: nil db, no installation could be done")
 	}
 
-	var ordersTblCreationQuery string = ordersTblCreation
-	ordersTblCreationQuery = strings.ReplaceAll(ordersTblCreationQuery, "paypal_orders", tbl)
-
-	// orders
-	stmtOrdersTblCreation, err := db.Prepare(ordersTblCreationQuery)
-	if err != nil {
-		return err
-	}
-	defer stmtOrdersTblCreation.Close()
-
-	_, err = stmtOrdersTblCreation.Exec()
-	if err != nil {
-		return nil
-	}
-
-	return nil
+	_, err := Migrate(db, tbl)
+	return err
 }
@@ -0,0 +1,119 @@
+package sqlwrapper
+
+import (
+	"database/sql"
+)
+
+// DuplicateRecord is a second capture for a ReferenceID already paid, and what was done about it.
+type DuplicateRecord struct {
+	ReferenceID   string  `json:"reference_id"`
+	OrderID       string  `json:"order_id"`
+	CaptureID     string  `json:"capture_id"`
+	PaidCaptureID string  `json:"paid_capture_id"`
+	Currency      string  `json:"currency"`
+	Amount        float64 `json:"amount"`
+	Action        string  `json:"action"`
+	CreatedAt     string  `json:"created_at"`
+}
+
+const selectDuplicateRecord = `SELECT ReferenceID, OrderID, CaptureID, PaidCaptureID, Currency, Amount, Action, CreatedAt FROM `
+
+func scanDuplicateRecord(row interface{ Scan(...interface{}) error }) (DuplicateRecord, error) {
+	var record DuplicateRecord
+	err := row.Scan(
+		&record.ReferenceID,
+		&record.OrderID,
+		&record.CaptureID,
+		&record.PaidCaptureID,
+		&record.Currency,
+		&record.Amount,
+		&record.Action,
+		&record.CreatedAt,
+	)
+	return record, err
+}
+
+// InsertDuplicate() saves a duplicate capture. Saving the same capture again only updates its action.
+func InsertDuplicate(db *sql.DB, tbl string, record DuplicateRecord) error {
+	if db == nil || record.CaptureID == "" {
+		return ErrNilPointer
+	}
+
+	stmtInsertDuplicate, err := db.Prepare(`INSERT INTO ` + tbl + `_duplicates (
+        ReferenceID, OrderID, CaptureID, PaidCaptureID, Currency, Amount, Action, CreatedAt
+    ) VALUE(?, ?, ?, ?, ?, ?, ?, NOW())
+    ON DUPLICATE KEY UPDATE Action = VALUES(Action);`)
+	if err != nil {
+		return err
+	}
+	defer stmtInsertDuplicate.Close()
+
+	_, err = stmtInsertDuplicate.Exec(
+		record.ReferenceID,
+		record.OrderID,
+		record.CaptureID,
+		record.PaidCaptureID,
+		record.Currency,
+		record.Amount,
+		record.Action,
+	)
+	return err
+}
+
+// SelectDuplicateByCapture() tells if a capture has been handled as a duplicate already.
+func SelectDuplicateByCapture(db *sql.DB, tbl, captureID string) (DuplicateRecord, error) {
+	if db == nil || captureID == "" {
+		return DuplicateRecord{}, ErrNilPointer
+	}
+
+	stmtSelectDuplicate, err := db.Prepare(selectDuplicateRecord + tbl + `_duplicates WHERE CaptureID = ?;`)
+	if err != nil {
+		return DuplicateRecord{}, err
+	}
+	defer stmtSelectDuplicate.Close()
+
+	return scanDuplicateRecord(stmtSelectDuplicate.QueryRow(captureID))
+}
+
+func SelectDuplicates(db *sql.DB, tbl, referenceID string) ([]DuplicateRecord, error) {
+	if db == nil || referenceID == "" {
+		return nil, ErrNilPointer
+	}
+
+	stmtSelectDuplicates, err := db.Prepare(selectDuplicateRecord + tbl + `_duplicates WHERE ReferenceID = ? ORDER BY ID ASC;`)
+	if err != nil {
+		return nil, err
+	}
+	defer stmtSelectDuplicates.Close()
+
+	rows, err := stmtSelectDuplicates.Query(referenceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := []DuplicateRecord{}
+	for rows.Next() {
+		record, err := scanDuplicateRecord(rows)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
+
+// SelectDuplicatesByCaptures() returns the duplicate payments made by any of captureIDs.
+func SelectDuplicatesByCaptures(db *sql.DB, tbl string, captureIDs []string) ([]DuplicateRecord, error) {
+	if db == nil {
+		return nil, ErrNilPointer
+	}
+
+	var records []DuplicateRecord
+	err := queryByCaptureIDs(db, selectDuplicateRecord+tbl+`_duplicates WHERE CaptureID IN (%s);`, captureIDs, func(rows *sql.Rows) error {
+		record, err := scanDuplicateRecord(rows)
+		records = append(records, record)
+		return err
+	})
+	return records, err
+}
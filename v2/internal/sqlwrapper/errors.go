@@ -5,4 +5,5 @@ import "errors"
 var (
 	ErrNilPointer     = errors.New("sqlwrapper: illegal nil pointer")
 	ErrBundledPayment = errors.New("sqlweapper: unexpected bundled order")
+	ErrAlreadyPaid    = errors.New("sqlwrapper: reference ID is paid already")
 )
@@ -0,0 +1,90 @@
+package sqlwrapper
+
+import (
+	"database/sql"
+	"strings"
+)
+
+// ordersTblMigrations are applied in order, each one bumping the schema version
+// of the orders table by 1. Never edit or reorder an entry once released, only append.
+// "paypal_orders" in each statement is replaced with the actual table name.
+var ordersTblMigrations = []string{
+	ordersTblCreation,          // v1
+	ordersTblAddBreakdown,      // v2
+	refundsTblCreation,         // v3
+	ordersTblAddPaymentLink,    // v4
+	vaultTblCreation,           // v5
+	ordersTblAddVaultCustomer,  // v6
+	ordersTblAddPayer,          // v7
+	riskTblCreation,            // v8
+	autoRefundsTblCreation,     // v9
+	duplicatesTblCreation,      // v10
+	ordersTblAddAccount,        // v11
+	vaultTblAddAccount,         // v12
+	webhooksTblCreation,        // v13
+	ordersTblAddChargeAttempts, // v14
+}
+
+// LatestSchemaVersion() is the version Migrate() brings the orders table to.
+func LatestSchemaVersion() int {
+	return len(ordersTblMigrations)
+}
+
+// SchemaVersion() reads the current schema version of the orders table.
+// A table created before the versioning was introduced reports 0.
+func SchemaVersion(db *sql.DB, tbl string) (int, error) {
+	if db == nil {
+		return 0, ErrNilPointer
+	}
+
+	if err := initSchemaTbl(db, tbl); err != nil {
+		return 0, err
+	}
+
+	var version int
+	err := db.QueryRow(`SELECT Version FROM ` + tbl + `_schema WHERE ID = 1;`).Scan(&version)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return version, err
+}
+
+// Migrate() applies all pending migrations to the orders table and returns the schema version afterwards.
+func Migrate(db *sql.DB, tbl string) (int, error) {
+	version, err := SchemaVersion(db, tbl)
+	if err != nil {
+		return 0, err
+	}
+
+	for version < len(ordersTblMigrations) {
+		query := strings.ReplaceAll(ordersTblMigrations[version], "paypal_orders", tbl)
+		stmtMigrate, err := db.Prepare(query)
+		if err != nil {
+			return version, err
+		}
+		_, err = stmtMigrate.Exec()
+		stmtMigrate.Close()
+		if err != nil {
+			return version, err
+		}
+
+		version++
+		_, err = db.Exec(`INSERT INTO `+tbl+`_schema (ID, Version) VALUE(1, ?) ON DUPLICATE KEY UPDATE Version = ?;`, version, version)
+		if err != nil {
+			return version, err
+		}
+	}
+
+	return version, nil
+}
+
+func initSchemaTbl(db *sql.DB, tbl string) error {
+	stmtSchemaTblCreation, err := db.Prepare(strings.ReplaceAll(schemaTblCreation, "paypal_orders", tbl))
+	if err != nil {
+		return err
+	}
+	defer stmtSchemaTblCreation.Close()
+
+	_, err = stmtSchemaTblCreation.Exec()
+	return err
+}
@@ -8,45 +8,79 @@ import (
 	pp "github.com/plutov/paypal/v4"
 )
 
-func PendingOrderID(db *sql.DB, tbl string, request payment.PaymentRequest, gatewayType uint) error {
+// PendingOrderID() saves a PaymentRequest to be paid with the merchant account. A pending row of the same
+// ReferenceID is reused, with the amount and account updated and any order created for it before forgotten.
+// Returns ErrAlreadyPaid if the ReferenceID is paid.
+func PendingOrderID(db *sql.DB, tbl string, request payment.PaymentRequest, gatewayType uint, account string) error {
 	if db == nil {
 		return ErrNilPointer
 	}
 
-	// Check if there's such ReferenceID on record (and no known payment)
-	captureId, captureErr := SelectCaptureID(db, tbl, request.Item.ReferenceID)
-	if captureErr == nil && captureId != "" { // Have such line, and captureId already filled
-		// Don't insert new
-	} else {
-		stmtInsertOrder, err := db.Prepare(`INSERT INTO ` + tbl + ` (
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Lock the row so two checkouts of the same ReferenceID at once don't race
+	var active bool
+	err = tx.QueryRow(`SELECT Active FROM `+tbl+` WHERE ReferenceID = ? FOR UPDATE;`, request.Item.ReferenceID).Scan(&active)
+	switch {
+	case err == sql.ErrNoRows:
+		_, err = tx.Exec(`INSERT INTO `+tbl+` (
 			ReferenceID, 
 			GatewayType,
 			Currency,
 			Total,
+			Account,
+			OrderDetails,
 			CreatedAt
 		) VALUE(
 			?,
 			?,
 			?,
 			?,
+			?,
+			'',
 			NOW()
-		);`)
-		if err != nil {
-			return err
-		}
-		defer stmtInsertOrder.Close()
-
-		_, err = stmtInsertOrder.Exec(
+		);`,
 			request.Item.ReferenceID,
 			gatewayType,
 			request.Item.Currency,
 			request.Item.Price,
+			account,
+		)
+	case err != nil:
+		return err
+	case !active:
+		return ErrAlreadyPaid
+	default:
+		_, err = tx.Exec(`UPDATE `+tbl+` 
+    SET 
+    GatewayType = ?,
+    Currency = ?,
+    Total = ?,
+    Account = ?,
+    OrderID = '',
+    LinkExpiresAt = 0,
+    VaultCustomerID = '' 
+    WHERE 
+    ReferenceID = ? AND Active = TRUE;`,
+			gatewayType,
+			request.Item.Currency,
+			request.Item.Price,
+			account,
+			request.Item.ReferenceID,
 		)
+	}
+	if err != nil {
 		return err
 	}
-	return nil
+	return tx.Commit()
 }
 
+// AppendOrderInfo() finalizes the pending row of the order's ReferenceID as paid by captureID.
+// Returns ErrAlreadyPaid if no row is pending, e.g. another capture finalized it first.
 func AppendOrderInfo(db *sql.DB, tbl string, order *pp.Order, captureID string) error {
 	if db == nil || order == nil {
 		return ErrNilPointer
@@ -71,6 +105,10 @@ func AppendOrderInfo(db *sql.DB, tbl string, order *pp.Order, captureID string)
     OrderID = ?,
     OrderDetails = ?, 
 	CaptureID = ?,
+    PayerID = ?,
+    PayerEmail = ?,
+    PayerName = ?,
+    PayerCountry = ?,
     ClosedAt = NOW(),
     Active = FALSE 
     WHERE 
@@ -85,14 +123,30 @@ func AppendOrderInfo(db *sql.DB, tbl string, order *pp.Order, captureID string)
 		return err
 	}
 
-	_, err = stmtAppendOrderID.Exec(
+	payer := PayerOf(order)
+	result, err := stmtAppendOrderID.Exec(
 		orderID,
 		string(orderDetails),
 		captureID,
+		payer.PayerID,
+		payer.Email,
+		payer.Name,
+		payer.Country,
 		refID,
 	)
+	if err != nil {
+		return err
+	}
 
-	return err
+	// Active changes on every row matched, so none affected means none was pending
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrAlreadyPaid
+	}
+	return nil
 }
 
 func SelectOrderID(db *sql.DB, tbl, referenceID string) (orderID string, err error) {
@@ -186,3 +240,21 @@ func SelectCaptureID(db *sql.DB, tbl, referenceID string) (string, error) {
 
 	return CaptureID, err
 }
+
+// SelectAccount() returns the merchant account a ReferenceID is paid with, empty for the default one.
+func SelectAccount(db *sql.DB, tbl, referenceID string) (string, error) {
+	if db == nil || referenceID == "" {
+		return "", ErrNilPointer
+	}
+
+	var Account string
+
+	stmtSelectAccount, err := db.Prepare(`SELECT Account FROM ` + tbl + ` WHERE ReferenceID = ?;`)
+	if err != nil {
+		return Account, err
+	}
+	defer stmtSelectAccount.Close()
+	err = stmtSelectAccount.QueryRow(referenceID).Scan(&Account)
+
+	return Account, err
+}
@@ -0,0 +1,228 @@
+package sqlwrapper
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// OrderRecord is a full row in the orders table.
+// Timestamps are kept as returned by the database so no DSN option (parseTime) is required.
+type OrderRecord struct {
+	ID           uint64  `json:"id"`
+	OrderID      string  `json:"order_id"`
+	ReferenceID  string  `json:"reference_id"`
+	GatewayType  uint    `json:"gateway_type"`
+	Currency     string  `json:"currency"`
+	Total        float64 `json:"total"`
+	Refunded     float64 `json:"refunded"`
+	OrderDetails string  `json:"order_details"`
+	CaptureID    string  `json:"capture_id"`
+	CreatedAt    string  `json:"created_at"`
+	ClosedAt     string  `json:"closed_at"`
+	Active       bool    `json:"active"`
+	Breakdown
+	LinkExpiresAt   string `json:"link_expires_at"`
+	VaultCustomerID string `json:"vault_customer_id"`
+	Payer
+	Account string `json:"account"` // Merchant account, empty for the default one
+}
+
+const selectOrderRecord = `SELECT 
+    ID, 
+    OrderID, 
+    ReferenceID, 
+    GatewayType, 
+    Currency, 
+    Total, 
+    Refunded, 
+    OrderDetails, 
+    CaptureID, 
+    CreatedAt, 
+    ClosedAt, 
+    Active, 
+    GrossAmount, 
+    PayPalFee, 
+    NetAmount, 
+    ReceivableAmount, 
+    ReceivableCurrency, 
+    ExchangeRate, 
+    LinkExpiresAt, 
+    VaultCustomerID, 
+    PayerID, 
+    PayerEmail, 
+    PayerName, 
+    PayerCountry, 
+    Account 
+    FROM `
+
+func scanOrderRecord(row interface{ Scan(...interface{}) error }) (OrderRecord, error) {
+	var record OrderRecord
+	err := row.Scan(
+		&record.ID,
+		&record.OrderID,
+		&record.ReferenceID,
+		&record.GatewayType,
+		&record.Currency,
+		&record.Total,
+		&record.Refunded,
+		&record.OrderDetails,
+		&record.CaptureID,
+		&record.CreatedAt,
+		&record.ClosedAt,
+		&record.Active,
+		&record.Gross,
+		&record.Fee,
+		&record.Net,
+		&record.ReceivableAmount,
+		&record.ReceivableCurrency,
+		&record.ExchangeRate,
+		&record.LinkExpiresAt,
+		&record.VaultCustomerID,
+		&record.PayerID,
+		&record.Email,
+		&record.Name,
+		&record.Country,
+		&record.Account,
+	)
+	return record, err
+}
+
+func SelectOrder(db *sql.DB, tbl, referenceID string) (OrderRecord, error) {
+	if db == nil || referenceID == "" {
+		return OrderRecord{}, ErrNilPointer
+	}
+
+	stmtSelectOrder, err := db.Prepare(selectOrderRecord + tbl + ` WHERE ReferenceID = ?;`)
+	if err != nil {
+		return OrderRecord{}, err
+	}
+	defer stmtSelectOrder.Close()
+
+	return scanOrderRecord(stmtSelectOrder.QueryRow(referenceID))
+}
+
+func SelectOrderByOrderID(db *sql.DB, tbl, orderID string) (OrderRecord, error) {
+	if db == nil || orderID == "" {
+		return OrderRecord{}, ErrNilPointer
+	}
+
+	stmtSelectOrder, err := db.Prepare(selectOrderRecord + tbl + ` WHERE OrderID = ?;`)
+	if err != nil {
+		return OrderRecord{}, err
+	}
+	defer stmtSelectOrder.Close()
+
+	return scanOrderRecord(stmtSelectOrder.QueryRow(orderID))
+}
+
+// ListOrders() returns all orders created in [from, to), oldest first.
+func ListOrders(db *sql.DB, tbl string, from, to time.Time) ([]OrderRecord, error) {
+	if db == nil {
+		return nil, ErrNilPointer
+	}
+
+	stmtListOrders, err := db.Prepare(selectOrderRecord + tbl + ` WHERE CreatedAt >= ? AND CreatedAt < ? ORDER BY CreatedAt ASC;`)
+	if err != nil {
+		return nil, err
+	}
+	defer stmtListOrders.Close()
+
+	rows, err := stmtListOrders.Query(from.Format(sqlTimeLayout), to.Format(sqlTimeLayout))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []OrderRecord
+	for rows.Next() {
+		record, err := scanOrderRecord(rows)
+		if err != nil {
+			return records, err
+		}
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
+
+// ListClosedOrders() returns the orders paid in [from, to), by ClosedAt, oldest first.
+func ListClosedOrders(db *sql.DB, tbl string, from, to time.Time) ([]OrderRecord, error) {
+	if db == nil {
+		return nil, ErrNilPointer
+	}
+
+	stmtListClosedOrders, err := db.Prepare(selectOrderRecord + tbl + ` WHERE CaptureID != '' AND ClosedAt >= ? AND ClosedAt < ? ORDER BY ClosedAt ASC;`)
+	if err != nil {
+		return nil, err
+	}
+	defer stmtListClosedOrders.Close()
+
+	rows, err := stmtListClosedOrders.Query(from.Format(sqlTimeLayout), to.Format(sqlTimeLayout))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []OrderRecord
+	for rows.Next() {
+		record, err := scanOrderRecord(rows)
+		if err != nil {
+			return records, err
+		}
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
+
+// SelectOrdersByCaptureIDs() returns the orders paid by any of captureIDs.
+func SelectOrdersByCaptureIDs(db *sql.DB, tbl string, captureIDs []string) ([]OrderRecord, error) {
+	if db == nil {
+		return nil, ErrNilPointer
+	}
+
+	var records []OrderRecord
+	err := queryByCaptureIDs(db, selectOrderRecord+tbl+` WHERE CaptureID IN (%s);`, captureIDs, func(rows *sql.Rows) error {
+		record, err := scanOrderRecord(rows)
+		records = append(records, record)
+		return err
+	})
+	return records, err
+}
+
+// Capture IDs per query of queryByCaptureIDs()
+const captureIDsPerQuery = 500
+
+// queryByCaptureIDs() runs query, whose %s is replaced by the placeholders of an IN list, for captureIDs
+// a batch at a time, and scans every row.
+func queryByCaptureIDs(db *sql.DB, query string, captureIDs []string, scan func(*sql.Rows) error) error {
+	for len(captureIDs) > 0 {
+		batch := captureIDs
+		if len(batch) > captureIDsPerQuery {
+			batch = batch[:captureIDsPerQuery]
+		}
+		captureIDs = captureIDs[len(batch):]
+
+		args := make([]interface{}, len(batch))
+		for i, captureID := range batch {
+			args[i] = captureID
+		}
+		rows, err := db.Query(strings.Replace(query, "%s", strings.TrimSuffix(strings.Repeat("?, ", len(batch)), ", "), 1), args...)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			if err = scan(rows); err != nil {
+				rows.Close()
+				return err
+			}
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const sqlTimeLayout = "2006-01-02 15:04:05"
@@ -0,0 +1,130 @@
+package sqlwrapper
+
+import (
+	"database/sql"
+	"encoding/json"
+	"strings"
+
+	pp "github.com/plutov/paypal/v4"
+)
+
+// Payer is who paid for an order, as reported by PayPal.
+type Payer struct {
+	PayerID string `json:"payer_id"`
+	Email   string `json:"payer_email"`
+	Name    string `json:"payer_name"`
+	Country string `json:"payer_country"` // ISO 3166-1 alpha-2
+}
+
+// PayerOf() extracts the payer of an order. Fields PayPal didn't share are left empty.
+func PayerOf(order *pp.Order) Payer {
+	var payer Payer
+	if order == nil || order.Payer == nil {
+		return payer
+	}
+
+	payer.PayerID = order.Payer.PayerID
+	payer.Email = order.Payer.EmailAddress
+	if order.Payer.Name != nil {
+		payer.Name = strings.TrimSpace(order.Payer.Name.GivenName + " " + order.Payer.Name.Surname)
+	}
+	if order.Payer.Address != nil {
+		payer.Country = order.Payer.Address.CountryCode
+	}
+	return payer
+}
+
+func SelectPayer(db *sql.DB, tbl, referenceID string) (Payer, error) {
+	if db == nil || referenceID == "" {
+		return Payer{}, ErrNilPointer
+	}
+
+	var payer Payer
+	stmtSelectPayer, err := db.Prepare(`SELECT PayerID, PayerEmail, PayerName, PayerCountry FROM ` + tbl + ` WHERE ReferenceID = ?;`)
+	if err != nil {
+		return payer, err
+	}
+	defer stmtSelectPayer.Close()
+
+	err = stmtSelectPayer.QueryRow(referenceID).Scan(&payer.PayerID, &payer.Email, &payer.Name, &payer.Country)
+	return payer, err
+}
+
+// SelectOrdersByPayer() returns all orders paid by the PayPal account with the payer ID or email, oldest first.
+// Email is matched case-insensitively.
+func SelectOrdersByPayer(db *sql.DB, tbl, payerIDOrEmail string) ([]OrderRecord, error) {
+	if db == nil || payerIDOrEmail == "" {
+		return nil, ErrNilPointer
+	}
+
+	stmtSelectOrdersByPayer, err := db.Prepare(selectOrderRecord + tbl + ` WHERE PayerID = ? OR PayerEmail = ? ORDER BY ClosedAt ASC;`)
+	if err != nil {
+		return nil, err
+	}
+	defer stmtSelectOrdersByPayer.Close()
+
+	rows, err := stmtSelectOrdersByPayer.Query(payerIDOrEmail, payerIDOrEmail)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []OrderRecord
+	for rows.Next() {
+		record, err := scanOrderRecord(rows)
+		if err != nil {
+			return records, err
+		}
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
+
+// BackfillPayers() fills the payer columns of orders closed before they existed, from the saved OrderDetails.
+// Returns the number of orders updated.
+func BackfillPayers(db *sql.DB, tbl string) (int, error) {
+	if db == nil {
+		return 0, ErrNilPointer
+	}
+
+	rows, err := db.Query(`SELECT ReferenceID, OrderDetails FROM ` + tbl + ` WHERE Active = FALSE AND PayerID = '' AND OrderDetails != '';`)
+	if err != nil {
+		return 0, err
+	}
+	orderDetails := map[string]string{}
+	for rows.Next() {
+		var referenceID, details string
+		if err = rows.Scan(&referenceID, &details); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		orderDetails[referenceID] = details
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	stmtUpdatePayer, err := db.Prepare(`UPDATE ` + tbl + ` SET PayerID = ?, PayerEmail = ?, PayerName = ?, PayerCountry = ? WHERE ReferenceID = ?;`)
+	if err != nil {
+		return 0, err
+	}
+	defer stmtUpdatePayer.Close()
+
+	var updated int
+	for referenceID, details := range orderDetails {
+		var order pp.Order
+		if json.Unmarshal([]byte(details), &order) != nil {
+			continue
+		}
+		payer := PayerOf(&order)
+		if payer.PayerID == "" {
+			continue
+		}
+		if _, err = stmtUpdatePayer.Exec(payer.PayerID, payer.Email, payer.Name, payer.Country, referenceID); err != nil {
+			return updated, err
+		}
+		updated++
+	}
+	return updated, nil
+}
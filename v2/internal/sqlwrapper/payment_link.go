@@ -0,0 +1,57 @@
+package sqlwrapper
+
+import (
+	"database/sql"
+	"time"
+)
+
+// UpdatePaymentLink() saves the PayPal order created for a payment link on a pending row.
+// The link expires ttl from now, by the database clock.
+func UpdatePaymentLink(db *sql.DB, tbl, referenceID, orderID string, ttl time.Duration) error {
+	if db == nil || referenceID == "" {
+		return ErrNilPointer
+	}
+
+	stmtUpdatePaymentLink, err := db.Prepare(`UPDATE ` + tbl + ` SET OrderID = ?, LinkExpiresAt = NOW() + INTERVAL ? SECOND WHERE ReferenceID = ? AND Active = TRUE;`)
+	if err != nil {
+		return err
+	}
+	defer stmtUpdatePaymentLink.Close()
+
+	_, err = stmtUpdatePaymentLink.Exec(orderID, int64(ttl/time.Second), referenceID)
+	return err
+}
+
+// SelectLinkExpired() tells if the payment link of a ReferenceID has expired.
+// A row without payment link never expires.
+func SelectLinkExpired(db *sql.DB, tbl, referenceID string) (bool, error) {
+	if db == nil || referenceID == "" {
+		return false, ErrNilPointer
+	}
+
+	var expired bool
+	stmtSelectLinkExpired, err := db.Prepare(`SELECT LinkExpiresAt > 0 AND LinkExpiresAt < NOW() FROM ` + tbl + ` WHERE ReferenceID = ?;`)
+	if err != nil {
+		return false, err
+	}
+	defer stmtSelectLinkExpired.Close()
+
+	err = stmtSelectLinkExpired.QueryRow(referenceID).Scan(&expired)
+	return expired, err
+}
+
+// UpdatePendingOrderID() saves the PayPal order created on the server for a pending row.
+func UpdatePendingOrderID(db *sql.DB, tbl, referenceID, orderID string) error {
+	if db == nil || referenceID == "" {
+		return ErrNilPointer
+	}
+
+	stmtUpdatePendingOrderID, err := db.Prepare(`UPDATE ` + tbl + ` SET OrderID = ? WHERE ReferenceID = ? AND Active = TRUE;`)
+	if err != nil {
+		return err
+	}
+	defer stmtUpdatePendingOrderID.Close()
+
+	_, err = stmtUpdatePendingOrderID.Exec(orderID, referenceID)
+	return err
+}
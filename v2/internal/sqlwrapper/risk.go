@@ -0,0 +1,100 @@
+package sqlwrapper
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// RiskRecord is a decision made by the risk rules, or by hand, on a captured payment.
+type RiskRecord struct {
+	ReferenceID string `json:"reference_id"`
+	Decision    string `json:"decision"`
+	Rule        string `json:"rule"`
+	Reason      string `json:"reason"`
+	CreatedAt   string `json:"created_at"`
+}
+
+func InsertRiskDecision(db *sql.DB, tbl string, record RiskRecord) error {
+	if db == nil || record.ReferenceID == "" {
+		return ErrNilPointer
+	}
+
+	stmtInsertRiskDecision, err := db.Prepare(`INSERT INTO ` + tbl + `_risk (ReferenceID, Decision, Rule, Reason, CreatedAt) VALUE(?, ?, ?, ?, NOW());`)
+	if err != nil {
+		return err
+	}
+	defer stmtInsertRiskDecision.Close()
+
+	reason := record.Reason
+	if len(reason) > 255 {
+		reason = reason[:255]
+	}
+	_, err = stmtInsertRiskDecision.Exec(record.ReferenceID, record.Decision, record.Rule, reason)
+	return err
+}
+
+// SelectRiskDecisions() returns the decisions on a ReferenceID, the latest last.
+func SelectRiskDecisions(db *sql.DB, tbl, referenceID string) ([]RiskRecord, error) {
+	if db == nil || referenceID == "" {
+		return nil, ErrNilPointer
+	}
+
+	stmtSelectRiskDecisions, err := db.Prepare(`SELECT ReferenceID, Decision, Rule, Reason, CreatedAt FROM ` + tbl + `_risk WHERE ReferenceID = ? ORDER BY ID ASC;`)
+	if err != nil {
+		return nil, err
+	}
+	defer stmtSelectRiskDecisions.Close()
+
+	rows, err := stmtSelectRiskDecisions.Query(referenceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := []RiskRecord{}
+	for rows.Next() {
+		var record RiskRecord
+		if err = rows.Scan(&record.ReferenceID, &record.Decision, &record.Rule, &record.Reason, &record.CreatedAt); err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
+
+// CountPaidByPayer() counts the payments made by a payer ID within the last window, by the database clock.
+func CountPaidByPayer(db *sql.DB, tbl, payerID string, window time.Duration) (int, error) {
+	if db == nil || payerID == "" {
+		return 0, ErrNilPointer
+	}
+
+	var count int
+	stmtCountPaidByPayer, err := db.Prepare(`SELECT COUNT(*) FROM ` + tbl + ` WHERE PayerID = ? AND CaptureID != '' AND ClosedAt >= NOW() - INTERVAL ? SECOND;`)
+	if err != nil {
+		return 0, err
+	}
+	defer stmtCountPaidByPayer.Close()
+
+	err = stmtCountPaidByPayer.QueryRow(payerID, int64(window/time.Second)).Scan(&count)
+	return count, err
+}
+
+// CountPaidByReferencePrefix() counts the payments for ReferenceIDs starting with prefix within the last window,
+// by the database clock.
+func CountPaidByReferencePrefix(db *sql.DB, tbl, prefix string, window time.Duration) (int, error) {
+	if db == nil || prefix == "" {
+		return 0, ErrNilPointer
+	}
+
+	var count int
+	stmtCountPaidByReferencePrefix, err := db.Prepare(`SELECT COUNT(*) FROM ` + tbl + ` WHERE ReferenceID LIKE ? AND CaptureID != '' AND ClosedAt >= NOW() - INTERVAL ? SECOND;`)
+	if err != nil {
+		return 0, err
+	}
+	defer stmtCountPaidByReferencePrefix.Close()
+
+	escaped := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(prefix)
+	err = stmtCountPaidByReferencePrefix.QueryRow(escaped+"%", int64(window/time.Second)).Scan(&count)
+	return count, err
+}
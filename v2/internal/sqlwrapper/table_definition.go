@@ -1,6 +1,7 @@
 package sqlwrapper
 
 const (
+	// TEXT columns take no DEFAULT before MySQL 8.0.13, so they are set on INSERT
 	ordersTblCreation = `CREATE TABLE IF NOT EXISTS paypal_orders(
         ID INT UNSIGNED NOT NULL AUTO_INCREMENT,
         OrderID VARCHAR(32) NOT NULL DEFAULT '',  
@@ -9,7 +10,7 @@ const (
         Currency VARCHAR(8) NOT NULL DEFAULT 'USD',
         Total FLOAT NOT NULL,
         Refunded FLOAT NOT NULL DEFAULT 0,
-        OrderDetails TEXT NOT NULL DEFAULT '',
+        OrderDetails TEXT NOT NULL,
         CaptureID VARCHAR(32) NOT NULL DEFAULT '',
         CreatedAt DATETIME NOT NULL DEFAULT 0,
         ClosedAt DATETIME NOT NULL DEFAULT 0,
@@ -19,3 +20,157 @@ const (
         UNIQUE (ReferenceID)
     ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci;`
 )
+
+const (
+	schemaTblCreation = `CREATE TABLE IF NOT EXISTS paypal_orders_schema(
+        ID INT UNSIGNED NOT NULL,
+        Version INT UNSIGNED NOT NULL DEFAULT 0,
+        PRIMARY KEY (ID)
+    ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci;`
+)
+
+const (
+	// v2
+	ordersTblAddBreakdown = `ALTER TABLE paypal_orders 
+        ADD COLUMN GrossAmount FLOAT NOT NULL DEFAULT 0,
+        ADD COLUMN PayPalFee FLOAT NOT NULL DEFAULT 0,
+        ADD COLUMN NetAmount FLOAT NOT NULL DEFAULT 0,
+        ADD COLUMN ReceivableAmount FLOAT NOT NULL DEFAULT 0,
+        ADD COLUMN ReceivableCurrency VARCHAR(8) NOT NULL DEFAULT '',
+        ADD COLUMN ExchangeRate DOUBLE NOT NULL DEFAULT 0;`
+
+	// v3
+	refundsTblCreation = `CREATE TABLE IF NOT EXISTS paypal_orders_refunds(
+        ID INT UNSIGNED NOT NULL AUTO_INCREMENT,
+        RefundID VARCHAR(32) NOT NULL,
+        CaptureID VARCHAR(32) NOT NULL,
+        ReferenceID VARCHAR(32) NOT NULL,
+        Status VARCHAR(32) NOT NULL DEFAULT '',
+        Currency VARCHAR(8) NOT NULL DEFAULT 'USD',
+        GrossAmount FLOAT NOT NULL DEFAULT 0,
+        PayPalFee FLOAT NOT NULL DEFAULT 0,
+        NetAmount FLOAT NOT NULL DEFAULT 0,
+        CreatedAt DATETIME NOT NULL DEFAULT 0,
+        PRIMARY KEY (ID),
+        INDEX (ReferenceID),
+        UNIQUE (RefundID)
+    ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci;`
+)
+
+const (
+	// v4
+	ordersTblAddPaymentLink = `ALTER TABLE paypal_orders 
+        ADD COLUMN LinkExpiresAt DATETIME NOT NULL DEFAULT 0;`
+)
+
+const (
+	// v5
+	vaultTblCreation = `CREATE TABLE IF NOT EXISTS paypal_orders_vault(
+        ID INT UNSIGNED NOT NULL AUTO_INCREMENT,
+        CustomerID VARCHAR(64) NOT NULL,
+        PaymentTokenID VARCHAR(64) NOT NULL,
+        PayPalCustomerID VARCHAR(64) NOT NULL DEFAULT '',
+        Source VARCHAR(16) NOT NULL,
+        Description VARCHAR(128) NOT NULL DEFAULT '',
+        CreatedAt DATETIME NOT NULL DEFAULT 0,
+        PRIMARY KEY (ID),
+        INDEX (CustomerID),
+        UNIQUE (PaymentTokenID)
+    ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci;`
+
+	// v6
+	ordersTblAddVaultCustomer = `ALTER TABLE paypal_orders 
+        ADD COLUMN VaultCustomerID VARCHAR(64) NOT NULL DEFAULT '';`
+)
+
+const (
+	// v7
+	ordersTblAddPayer = `ALTER TABLE paypal_orders 
+        ADD COLUMN PayerID VARCHAR(32) NOT NULL DEFAULT '',
+        ADD COLUMN PayerEmail VARCHAR(255) NOT NULL DEFAULT '',
+        ADD COLUMN PayerName VARCHAR(255) NOT NULL DEFAULT '',
+        ADD COLUMN PayerCountry VARCHAR(2) NOT NULL DEFAULT '',
+        ADD INDEX (PayerID),
+        ADD INDEX (PayerEmail);`
+)
+
+const (
+	// v8
+	riskTblCreation = `CREATE TABLE IF NOT EXISTS paypal_orders_risk(
+        ID INT UNSIGNED NOT NULL AUTO_INCREMENT,
+        ReferenceID VARCHAR(32) NOT NULL,
+        Decision VARCHAR(16) NOT NULL,
+        Rule VARCHAR(64) NOT NULL DEFAULT '',
+        Reason VARCHAR(255) NOT NULL DEFAULT '',
+        CreatedAt DATETIME NOT NULL DEFAULT 0,
+        PRIMARY KEY (ID),
+        INDEX (ReferenceID)
+    ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci;`
+)
+
+const (
+	// v9
+	autoRefundsTblCreation = `CREATE TABLE IF NOT EXISTS paypal_orders_auto_refunds(
+        ID INT UNSIGNED NOT NULL AUTO_INCREMENT,
+        ReferenceID VARCHAR(32) NOT NULL,
+        OrderID VARCHAR(32) NOT NULL,
+        CaptureID VARCHAR(32) NOT NULL,
+        Reason VARCHAR(32) NOT NULL,
+        Detail VARCHAR(255) NOT NULL DEFAULT '',
+        Currency VARCHAR(8) NOT NULL DEFAULT '',
+        Amount FLOAT NOT NULL DEFAULT 0,
+        RefundID VARCHAR(32) NOT NULL DEFAULT '',
+        Status VARCHAR(32) NOT NULL DEFAULT '',
+        CreatedAt DATETIME NOT NULL DEFAULT 0,
+        PRIMARY KEY (ID),
+        INDEX (ReferenceID),
+        UNIQUE (CaptureID)
+    ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci;`
+)
+
+const (
+	// v10
+	duplicatesTblCreation = `CREATE TABLE IF NOT EXISTS paypal_orders_duplicates(
+        ID INT UNSIGNED NOT NULL AUTO_INCREMENT,
+        ReferenceID VARCHAR(32) NOT NULL,
+        OrderID VARCHAR(32) NOT NULL,
+        CaptureID VARCHAR(32) NOT NULL,
+        PaidCaptureID VARCHAR(32) NOT NULL,
+        Currency VARCHAR(8) NOT NULL DEFAULT '',
+        Amount FLOAT NOT NULL DEFAULT 0,
+        Action VARCHAR(16) NOT NULL,
+        CreatedAt DATETIME NOT NULL DEFAULT 0,
+        PRIMARY KEY (ID),
+        INDEX (ReferenceID),
+        UNIQUE (CaptureID)
+    ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci;`
+)
+
+const (
+	// v11, empty for the default merchant account
+	ordersTblAddAccount = `ALTER TABLE paypal_orders 
+        ADD COLUMN Account VARCHAR(64) NOT NULL DEFAULT '';`
+
+	// v12
+	vaultTblAddAccount = `ALTER TABLE paypal_orders_vault 
+        ADD COLUMN Account VARCHAR(64) NOT NULL DEFAULT '';`
+)
+
+const (
+	// v13, the webhook subscription of each merchant account, whose ID verifies the signature of events
+	webhooksTblCreation = `CREATE TABLE IF NOT EXISTS paypal_orders_webhooks(
+        Account VARCHAR(64) NOT NULL,
+        ClientID VARCHAR(128) NOT NULL,
+        WebhookID VARCHAR(32) NOT NULL,
+        URL VARCHAR(512) NOT NULL,
+        EventTypes TEXT NOT NULL,
+        UpdatedAt DATETIME NOT NULL DEFAULT 0,
+        PRIMARY KEY (Account)
+    ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci;`
+)
+
+const (
+	// v14, charges of saved payment methods made for the row, so each one has its own PayPal-Request-Id
+	ordersTblAddChargeAttempts = `ALTER TABLE paypal_orders 
+        ADD COLUMN ChargeAttempts INT UNSIGNED NOT NULL DEFAULT 0;`
+)
@@ -0,0 +1,149 @@
+package sqlwrapper
+
+import (
+	"database/sql"
+)
+
+// VaultRecord is a payment token saved with PayPal for one of our customers.
+type VaultRecord struct {
+	CustomerID       string `json:"customer_id"`
+	PaymentTokenID   string `json:"payment_token_id"`
+	PayPalCustomerID string `json:"paypal_customer_id"`
+	Source           string `json:"source"`      // paypal or card
+	Description      string `json:"description"` // e.g. payer email or card brand and last digits
+	CreatedAt        string `json:"created_at"`
+	Account          string `json:"account"` // Merchant account the token is saved with, empty for the default one
+}
+
+// UpdateVaultPending() saves the PayPal order created on the server for a pending row,
+// whose payment method is to be saved for customerID once captured.
+func UpdateVaultPending(db *sql.DB, tbl, referenceID, orderID, customerID string) error {
+	if db == nil || referenceID == "" || customerID == "" {
+		return ErrNilPointer
+	}
+
+	stmtUpdateVaultPending, err := db.Prepare(`UPDATE ` + tbl + ` SET OrderID = ?, VaultCustomerID = ? WHERE ReferenceID = ? AND Active = TRUE;`)
+	if err != nil {
+		return err
+	}
+	defer stmtUpdateVaultPending.Close()
+
+	_, err = stmtUpdateVaultPending.Exec(orderID, customerID, referenceID)
+	return err
+}
+
+// SelectVaultCustomerID() returns the customer the payment method of a ReferenceID should be saved for,
+// or an empty string if it shouldn't be saved.
+func SelectVaultCustomerID(db *sql.DB, tbl, referenceID string) (string, error) {
+	if db == nil || referenceID == "" {
+		return "", ErrNilPointer
+	}
+
+	var customerID string
+	stmtSelectVaultCustomerID, err := db.Prepare(`SELECT VaultCustomerID FROM ` + tbl + ` WHERE ReferenceID = ?;`)
+	if err != nil {
+		return "", err
+	}
+	defer stmtSelectVaultCustomerID.Close()
+
+	err = stmtSelectVaultCustomerID.QueryRow(referenceID).Scan(&customerID)
+	return customerID, err
+}
+
+// NextChargeAttempt() counts one more charge of a saved payment method for the pending row of a ReferenceID,
+// and returns how many there have been with it. ErrAlreadyPaid is returned if the row is paid already.
+func NextChargeAttempt(db *sql.DB, tbl, referenceID string) (int64, error) {
+	if db == nil || referenceID == "" {
+		return 0, ErrNilPointer
+	}
+
+	// LAST_INSERT_ID(expr) hands the incremented value back without another query
+	stmtNextChargeAttempt, err := db.Prepare(`UPDATE ` + tbl + ` SET ChargeAttempts = LAST_INSERT_ID(ChargeAttempts + 1) WHERE ReferenceID = ? AND Active = TRUE;`)
+	if err != nil {
+		return 0, err
+	}
+	defer stmtNextChargeAttempt.Close()
+
+	result, err := stmtNextChargeAttempt.Exec(referenceID)
+	if err != nil {
+		return 0, err
+	}
+	if affected, err := result.RowsAffected(); err != nil {
+		return 0, err
+	} else if affected == 0 {
+		return 0, ErrAlreadyPaid
+	}
+	return result.LastInsertId()
+}
+
+// InsertVaultToken() saves a payment token. Saving the same token again only updates its description.
+func InsertVaultToken(db *sql.DB, tbl string, token VaultRecord) error {
+	if db == nil || token.CustomerID == "" || token.PaymentTokenID == "" {
+		return ErrNilPointer
+	}
+
+	stmtInsertVaultToken, err := db.Prepare(`INSERT INTO ` + tbl + `_vault (CustomerID, PaymentTokenID, PayPalCustomerID, Source, Description, Account, CreatedAt) VALUE(?, ?, ?, ?, ?, ?, NOW()) ON DUPLICATE KEY UPDATE Description = VALUES(Description);`)
+	if err != nil {
+		return err
+	}
+	defer stmtInsertVaultToken.Close()
+
+	_, err = stmtInsertVaultToken.Exec(token.CustomerID, token.PaymentTokenID, token.PayPalCustomerID, token.Source, token.Description, token.Account)
+	return err
+}
+
+// SelectVaultTokens() lists the payment tokens saved for a customer, the latest first.
+func SelectVaultTokens(db *sql.DB, tbl, customerID string) ([]VaultRecord, error) {
+	if db == nil || customerID == "" {
+		return nil, ErrNilPointer
+	}
+
+	stmtSelectVaultTokens, err := db.Prepare(`SELECT CustomerID, PaymentTokenID, PayPalCustomerID, Source, Description, CreatedAt, Account FROM ` + tbl + `_vault WHERE CustomerID = ? ORDER BY ID DESC;`)
+	if err != nil {
+		return nil, err
+	}
+	defer stmtSelectVaultTokens.Close()
+
+	rows, err := stmtSelectVaultTokens.Query(customerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []VaultRecord{}
+	for rows.Next() {
+		var token VaultRecord
+		err = rows.Scan(&token.CustomerID, &token.PaymentTokenID, &token.PayPalCustomerID, &token.Source, &token.Description, &token.CreatedAt, &token.Account)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, rows.Err()
+}
+
+// DeleteVaultToken() removes a payment token of a customer. Returns sql.ErrNoRows if the customer has no such token.
+func DeleteVaultToken(db *sql.DB, tbl, customerID, paymentTokenID string) error {
+	if db == nil || customerID == "" || paymentTokenID == "" {
+		return ErrNilPointer
+	}
+
+	stmtDeleteVaultToken, err := db.Prepare(`DELETE FROM ` + tbl + `_vault WHERE CustomerID = ? AND PaymentTokenID = ?;`)
+	if err != nil {
+		return err
+	}
+	defer stmtDeleteVaultToken.Close()
+
+	result, err := stmtDeleteVaultToken.Exec(customerID, paymentTokenID)
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package sqlwrapper
+
+import (
+	"database/sql"
+	"strings"
+)
+
+// WebhookRecord is the webhook subscription of a merchant account.
+// ClientID is of the PayPal app it belongs to, a rotation to another app needs another subscription.
+type WebhookRecord struct {
+	Account    string   `json:"account"`
+	ClientID   string   `json:"client_id"`
+	WebhookID  string   `json:"webhook_id"`
+	URL        string   `json:"url"`
+	EventTypes []string `json:"event_types"`
+	UpdatedAt  string   `json:"updated_at"`
+}
+
+// InsertWebhook() inserts or replaces the webhook subscription of record.Account.
+func InsertWebhook(db *sql.DB, tbl string, record WebhookRecord) error {
+	if db == nil || record.WebhookID == "" {
+		return ErrNilPointer
+	}
+
+	stmtInsertWebhook, err := db.Prepare(`INSERT INTO ` + tbl + `_webhooks (
+        Account, ClientID, WebhookID, URL, EventTypes, UpdatedAt
+    ) VALUE(?, ?, ?, ?, ?, NOW())
+    ON DUPLICATE KEY UPDATE ClientID = VALUES(ClientID), WebhookID = VALUES(WebhookID), URL = VALUES(URL),
+        EventTypes = VALUES(EventTypes), UpdatedAt = NOW();`)
+	if err != nil {
+		return err
+	}
+	defer stmtInsertWebhook.Close()
+
+	_, err = stmtInsertWebhook.Exec(
+		record.Account,
+		record.ClientID,
+		record.WebhookID,
+		record.URL,
+		strings.Join(record.EventTypes, ","),
+	)
+	return err
+}
+
+// SelectWebhooks() lists the webhook subscriptions saved, of every merchant account.
+func SelectWebhooks(db *sql.DB, tbl string) ([]WebhookRecord, error) {
+	if db == nil {
+		return nil, ErrNilPointer
+	}
+
+	stmtSelectWebhooks, err := db.Prepare(`SELECT Account, ClientID, WebhookID, URL, EventTypes, UpdatedAt FROM ` + tbl + `_webhooks;`)
+	if err != nil {
+		return nil, err
+	}
+	defer stmtSelectWebhooks.Close()
+
+	rows, err := stmtSelectWebhooks.Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := []WebhookRecord{}
+	for rows.Next() {
+		var record WebhookRecord
+		var eventTypes string
+		if err = rows.Scan(&record.Account, &record.ClientID, &record.WebhookID, &record.URL, &eventTypes, &record.UpdatedAt); err != nil {
+			return nil, err
+		}
+		if eventTypes != "" {
+			record.EventTypes = strings.Split(eventTypes, ",")
+		}
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
@@ -0,0 +1,251 @@
+package paypal
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Logger is a structured, leveled logger taking alternating keys and values after the message.
+// *slog.Logger satisfies it, zap's SugaredLogger does through Debugw, Infow, Warnw and Errorw.
+type Logger interface {
+	Debug(msg string, keysAndValues ...interface{})
+	Info(msg string, keysAndValues ...interface{})
+	Warn(msg string, keysAndValues ...interface{})
+	Error(msg string, keysAndValues ...interface{})
+}
+
+const redacted = "[REDACTED]"
+
+// Values logged under these keys never reach the Logger. Compared case-insensitively.
+var secretKeys = map[string]bool{
+	"secret":        true,
+	"secretid":      true,
+	"client_secret": true,
+	"access_token":  true,
+	"client_token":  true,
+	"authorization": true,
+	"password":      true,
+}
+
+// Error responses larger than this are not parsed for the PayPal error name
+const maxLoggedErrorBody = 64 << 10
+
+// gatewayLogger adds the instance ID to every entry and redacts secrets.
+// A nil *gatewayLogger logs nothing, so the gateway works the same without a Logger.
+type gatewayLogger struct {
+	logger     Logger
+	instanceID string
+}
+
+func newGatewayLogger(logger Logger, instanceID string) *gatewayLogger {
+	if logger == nil {
+		return nil
+	}
+	return &gatewayLogger{logger: logger, instanceID: instanceID}
+}
+
+func (l *gatewayLogger) Debug(msg string, keysAndValues ...interface{}) {
+	if l == nil {
+		return
+	}
+	l.logger.Debug(msg, l.fields(keysAndValues)...)
+}
+
+func (l *gatewayLogger) Info(msg string, keysAndValues ...interface{}) {
+	if l == nil {
+		return
+	}
+	l.logger.Info(msg, l.fields(keysAndValues)...)
+}
+
+func (l *gatewayLogger) Warn(msg string, keysAndValues ...interface{}) {
+	if l == nil {
+		return
+	}
+	l.logger.Warn(msg, l.fields(keysAndValues)...)
+}
+
+func (l *gatewayLogger) Error(msg string, keysAndValues ...interface{}) {
+	if l == nil {
+		return
+	}
+	l.logger.Error(msg, l.fields(keysAndValues)...)
+}
+
+// fields() prepends the instance ID and redacts secrets, never modifying keysAndValues.
+func (l *gatewayLogger) fields(keysAndValues []interface{}) []interface{} {
+	fields := make([]interface{}, 0, len(keysAndValues)+2)
+	fields = append(fields, "instance", l.instanceID)
+	for i := 0; i < len(keysAndValues); i += 2 {
+		key, value := keysAndValues[i], interface{}(nil)
+		if i+1 < len(keysAndValues) {
+			value = keysAndValues[i+1]
+		}
+		fields = append(fields, key, redact(key, value))
+	}
+	return fields
+}
+
+// redact() hides the value of a secret key, and any bearer or basic credentials in a string value.
+func redact(key, value interface{}) interface{} {
+	if k, ok := key.(string); ok && secretKeys[strings.ToLower(k)] {
+		return redacted
+	}
+	if s, ok := value.(string); ok {
+		lower := strings.ToLower(s)
+		if strings.HasPrefix(lower, "bearer ") || strings.HasPrefix(lower, "basic ") {
+			return redacted
+		}
+	}
+	return value
+}
+
+type logFieldsKey struct{}
+
+// withLogFields() attaches fields, e.g. "ReferenceID", ReferenceID, to the PayPal calls made with ctx.
+func withLogFields(ctx context.Context, keysAndValues ...interface{}) context.Context {
+	if parent, ok := ctx.Value(logFieldsKey{}).([]interface{}); ok {
+		keysAndValues = append(append([]interface{}{}, parent...), keysAndValues...)
+	}
+	return context.WithValue(ctx, logFieldsKey{}, keysAndValues)
+}
+
+func logFields(ctx context.Context) []interface{} {
+	fields, _ := ctx.Value(logFieldsKey{}).([]interface{})
+	return fields
+}
+
+// transport() logs every request to PayPal made through next, with the PayPal-Debug-Id to quote to PayPal support.
+// Neither headers nor bodies are logged, they carry credentials and personal data.
+func (l *gatewayLogger) transport(next http.RoundTripper) http.RoundTripper {
+	if l == nil {
+		return next
+	}
+	return &logTransport{next: next, log: l}
+}
+
+type logTransport struct {
+	next http.RoundTripper
+	log  *gatewayLogger
+}
+
+func (t *logTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+
+	fields := append([]interface{}{}, logFields(req.Context())...)
+	fields = append(fields, pathIDs(req.URL.Path, fields)...)
+	fields = append(fields,
+		"method", req.Method,
+		"endpoint", endpointLabel(req.URL.Path),
+		"duration", time.Since(start),
+	)
+	if err != nil {
+		t.log.Error("PayPal request failed", append(fields, "error", err)...)
+		return resp, err
+	}
+
+	fields = append(fields, "status", resp.StatusCode, "debug_id", resp.Header.Get("Paypal-Debug-Id"))
+	switch {
+	case resp.StatusCode >= http.StatusBadRequest:
+		if name, message := errorName(resp); name != "" {
+			fields = append(fields, "error_name", name, "error_message", message)
+		}
+		if resp.StatusCode >= http.StatusInternalServerError {
+			t.log.Error("PayPal request failed", fields...)
+		} else {
+			t.log.Warn("PayPal request rejected", fields...)
+		}
+	default:
+		t.log.Debug("PayPal request", fields...)
+	}
+	return resp, nil
+}
+
+// Keys of the IDs pathIDs() finds in an API path, by the segment preceding them
+var pathIDKeys = map[string]string{
+	"orders":         "OrderID",
+	"captures":       "CaptureID",
+	"authorizations": "AuthorizationID",
+	"refunds":        "RefundID",
+	"payment-tokens": "PaymentTokenID",
+}
+
+// pathIDs() finds the OrderID, CaptureID etc. an API path is about, unless they're among fields already.
+func pathIDs(path string, fields []interface{}) []interface{} {
+	known := map[interface{}]bool{}
+	for i := 0; i < len(fields); i += 2 {
+		known[fields[i]] = true
+	}
+
+	var ids []interface{}
+	segments := strings.Split(path, "/")
+	for i := 1; i < len(segments); i++ {
+		key, ok := pathIDKeys[segments[i-1]]
+		if ok && segments[i] != "" && !known[key] {
+			ids = append(ids, key, segments[i])
+		}
+	}
+	return ids
+}
+
+// errorName() reads the name and message of a PayPal error response, leaving the body to be read again.
+func errorName(resp *http.Response) (name, message string) {
+	if resp.Body == nil || resp.ContentLength > maxLoggedErrorBody {
+		return "", ""
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxLoggedErrorBody))
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return "", ""
+	}
+
+	var errResp struct {
+		Name    string `json:"name"`
+		Message string `json:"message"`
+		// The OAuth endpoint answers differently
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if json.Unmarshal(body, &errResp) != nil {
+		return "", ""
+	}
+	if errResp.Name == "" {
+		return errResp.Error, errResp.ErrorDescription
+	}
+	return errResp.Name, errResp.Message
+}
+
+// Database operations named so change data
+var dbWritePrefixes = []string{"Insert", "Update", "Append", "Delete", "PendingOrderID"}
+
+// observeDB() starts timing and tracing a database operation under ctx, the returned func ends it.
+// Writes and failures are logged with keysAndValues, e.g. "ReferenceID", ReferenceID.
+func (pg *PrepaidGateway) observeDB(ctx context.Context, op string, keysAndValues ...interface{}) func(error) {
+	observe := pg.metrics.observeDB(op)
+	endSpan := pg.traceDB(ctx, op, keysAndValues...)
+	return func(err error) {
+		observe(err)
+		endSpan(err)
+
+		fields := append([]interface{}{"op", op}, keysAndValues...)
+		if err != nil && err != sql.ErrNoRows {
+			pg.log.Error("database operation failed", append(fields, "error", err)...)
+			return
+		}
+		for _, prefix := range dbWritePrefixes {
+			if strings.HasPrefix(op, prefix) {
+				pg.log.Info("database write", fields...)
+				return
+			}
+		}
+	}
+}
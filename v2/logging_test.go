@@ -0,0 +1,48 @@
+package paypal
+
+import "testing"
+
+func TestRedact(t *testing.T) {
+	tests := []struct {
+		key   interface{}
+		value interface{}
+		want  interface{}
+	}{
+		{"ReferenceID", "ref-1", "ref-1"},
+		{"secretID", "s3cr3t", redacted},
+		{"SECRET", "s3cr3t", redacted},
+		{"access_token", "A21AA", redacted},
+		{"Authorization", "anything", redacted},
+		{"header", "Bearer A21AA", redacted},
+		{"header", "basic Y2xpZW50OnNlY3JldA==", redacted},
+		{"message", "Bearer-less value", "Bearer-less value"},
+		{"attempt", 2, 2},
+		{"password", nil, redacted},
+		{1, "Basic Y2xpZW50OnNlY3JldA==", redacted},
+		{1, "plain", "plain"},
+	}
+	for _, tt := range tests {
+		if got := redact(tt.key, tt.value); got != tt.want {
+			t.Errorf("redact(%v, %v) = %v, want %v", tt.key, tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestLoggerFieldsRedact(t *testing.T) {
+	l := &gatewayLogger{instanceID: "inst"}
+	keysAndValues := []interface{}{"clientID", "id", "secret", "s3cr3t", "dangling"}
+	fields := l.fields(keysAndValues)
+
+	want := []interface{}{"instance", "inst", "clientID", "id", "secret", redacted, "dangling", nil}
+	if len(fields) != len(want) {
+		t.Fatalf("fields() = %v, want %v", fields, want)
+	}
+	for i := range want {
+		if fields[i] != want[i] {
+			t.Fatalf("fields() = %v, want %v", fields, want)
+		}
+	}
+	if keysAndValues[3] != "s3cr3t" {
+		t.Fatal("fields() modified keysAndValues")
+	}
+}
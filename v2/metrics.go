@@ -0,0 +1,269 @@
+package paypal
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// gatewayMetrics are the Prometheus collectors of a gateway, labelled with its instance ID.
+// A nil *gatewayMetrics records nothing, so the gateway works the same without a Registerer.
+type gatewayMetrics struct {
+	checkouts            *prometheus.CounterVec
+	callbacks            *prometheus.CounterVec
+	verificationFailures *prometheus.CounterVec
+	refunds              *prometheus.CounterVec
+	paypalLatency        *prometheus.HistogramVec
+	dbLatency            *prometheus.HistogramVec
+	retries              *prometheus.CounterVec
+	circuitOpen          prometheus.Gauge
+	credentialsHealthy   *prometheus.GaugeVec
+}
+
+// newGatewayMetrics() creates and registers the collectors. Returns nil metrics if reg is nil.
+func newGatewayMetrics(reg prometheus.Registerer, instanceID string) (*gatewayMetrics, error) {
+	if reg == nil {
+		return nil, nil
+	}
+	constLabels := prometheus.Labels{"instance": instanceID}
+
+	m := &gatewayMetrics{
+		checkouts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   "paypal",
+			Name:        "checkouts_created_total",
+			Help:        "Checkouts created, by flow.",
+			ConstLabels: constLabels,
+		}, []string{"flow"}),
+		callbacks: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   "paypal",
+			Name:        "callbacks_total",
+			Help:        "Callbacks received from buyers and PayPal, by action and outcome (the response message).",
+			ConstLabels: constLabels,
+		}, []string{"action", "outcome"}),
+		verificationFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   "paypal",
+			Name:        "verification_failures_total",
+			Help:        "Captures failing verification against PayPal and the database, by reason.",
+			ConstLabels: constLabels,
+		}, []string{"reason"}),
+		refunds: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   "paypal",
+			Name:        "refunds_total",
+			Help:        "Refunds issued, by kind (requested, automatic) and status reported by PayPal, or error.",
+			ConstLabels: constLabels,
+		}, []string{"kind", "status"}),
+		paypalLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace:   "paypal",
+			Name:        "api_request_duration_seconds",
+			Help:        "PayPal REST API latency, by method, endpoint and HTTP status code.",
+			ConstLabels: constLabels,
+			Buckets:     []float64{.05, .1, .25, .5, 1, 2, 5, 10, 30},
+		}, []string{"method", "endpoint", "code"}),
+		dbLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace:   "paypal",
+			Name:        "db_query_duration_seconds",
+			Help:        "Database latency, by operation and whether it failed.",
+			ConstLabels: constLabels,
+			Buckets:     []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+		}, []string{"op", "error"}),
+		retries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   "paypal",
+			Name:        "api_retries_total",
+			Help:        "PayPal REST API requests retried, by endpoint and reason (HTTP status code or error).",
+			ConstLabels: constLabels,
+		}, []string{"endpoint", "reason"}),
+		circuitOpen: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   "paypal",
+			Name:        "circuit_open",
+			Help:        "1 while PayPal calls fail fast after repeated failures, 0 otherwise.",
+			ConstLabels: constLabels,
+		}),
+		credentialsHealthy: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace:   "paypal",
+			Name:        "credentials_healthy",
+			Help:        "0 while the last credentials loaded for a merchant account are refused, or the previous ones are fallen back to, 1 otherwise.",
+			ConstLabels: constLabels,
+		}, []string{"account"}),
+	}
+
+	// A gateway created again with the same instance ID keeps counting on the collectors registered before
+	var err error
+	for _, c := range []**prometheus.CounterVec{&m.checkouts, &m.callbacks, &m.verificationFailures, &m.refunds, &m.retries} {
+		if *c, err = registerCounterVec(reg, *c); err != nil {
+			return nil, err
+		}
+	}
+	for _, h := range []**prometheus.HistogramVec{&m.paypalLatency, &m.dbLatency} {
+		if *h, err = registerHistogramVec(reg, *h); err != nil {
+			return nil, err
+		}
+	}
+	if err = reg.Register(m.circuitOpen); err != nil {
+		var are prometheus.AlreadyRegisteredError
+		if !errors.As(err, &are) {
+			return nil, err
+		}
+		if existing, ok := are.ExistingCollector.(prometheus.Gauge); ok {
+			m.circuitOpen = existing
+		}
+	}
+	if err = reg.Register(m.credentialsHealthy); err != nil {
+		var are prometheus.AlreadyRegisteredError
+		if !errors.As(err, &are) {
+			return nil, err
+		}
+		if existing, ok := are.ExistingCollector.(*prometheus.GaugeVec); ok {
+			m.credentialsHealthy = existing
+		}
+	}
+	return m, nil
+}
+
+func registerCounterVec(reg prometheus.Registerer, c *prometheus.CounterVec) (*prometheus.CounterVec, error) {
+	err := reg.Register(c)
+	var are prometheus.AlreadyRegisteredError
+	if errors.As(err, &are) {
+		if existing, ok := are.ExistingCollector.(*prometheus.CounterVec); ok {
+			return existing, nil
+		}
+	}
+	return c, err
+}
+
+func registerHistogramVec(reg prometheus.Registerer, h *prometheus.HistogramVec) (*prometheus.HistogramVec, error) {
+	err := reg.Register(h)
+	var are prometheus.AlreadyRegisteredError
+	if errors.As(err, &are) {
+		if existing, ok := are.ExistingCollector.(*prometheus.HistogramVec); ok {
+			return existing, nil
+		}
+	}
+	return h, err
+}
+
+func (m *gatewayMetrics) checkoutCreated(flow string) {
+	if m == nil {
+		return
+	}
+	m.checkouts.WithLabelValues(flow).Inc()
+}
+
+func (m *gatewayMetrics) callback(action string, resp map[string]interface{}) {
+	if m == nil {
+		return
+	}
+	outcome, _ := resp["message"].(string)
+	m.callbacks.WithLabelValues(action, outcome).Inc()
+}
+
+func (m *gatewayMetrics) verificationFailed(reason string) {
+	if m == nil {
+		return
+	}
+	m.verificationFailures.WithLabelValues(reason).Inc()
+}
+
+func (m *gatewayMetrics) refunded(kind, status string, err error) {
+	if m == nil {
+		return
+	}
+	if err != nil && status == "" {
+		status = "error"
+	}
+	m.refunds.WithLabelValues(kind, status).Inc()
+}
+
+func (m *gatewayMetrics) retried(endpoint, reason string) {
+	if m == nil {
+		return
+	}
+	m.retries.WithLabelValues(endpoint, reason).Inc()
+}
+
+func (m *gatewayMetrics) circuitChanged(open bool) {
+	if m == nil {
+		return
+	}
+	if open {
+		m.circuitOpen.Set(1)
+	} else {
+		m.circuitOpen.Set(0)
+	}
+}
+
+func (m *gatewayMetrics) credentialsChanged(account string, healthy bool) {
+	if m == nil {
+		return
+	}
+	if healthy {
+		m.credentialsHealthy.WithLabelValues(account).Set(1)
+	} else {
+		m.credentialsHealthy.WithLabelValues(account).Set(0)
+	}
+}
+
+// observeDB() starts timing a database operation, the returned func stops it.
+// sql.ErrNoRows is an answer, not a failure.
+func (m *gatewayMetrics) observeDB(op string) func(error) {
+	if m == nil {
+		return func(error) {}
+	}
+	start := time.Now()
+	return func(err error) {
+		m.dbLatency.WithLabelValues(op, strconv.FormatBool(err != nil && err != sql.ErrNoRows)).Observe(time.Since(start).Seconds())
+	}
+}
+
+// transport() times every request to PayPal made through next.
+func (m *gatewayMetrics) transport(next http.RoundTripper) http.RoundTripper {
+	if m == nil {
+		return next
+	}
+	return &metricsTransport{next: next, latency: m.paypalLatency}
+}
+
+type metricsTransport struct {
+	next    http.RoundTripper
+	latency *prometheus.HistogramVec
+}
+
+func (t *metricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	t.latency.WithLabelValues(req.Method, endpointLabel(req.URL.Path), code).Observe(time.Since(start).Seconds())
+	return resp, err
+}
+
+// Path segments following these are resource IDs
+var idParents = map[string]bool{
+	"orders":             true,
+	"captures":           true,
+	"authorizations":     true,
+	"refunds":            true,
+	"payment-tokens":     true,
+	"webhooks":           true,
+	"webhooks-events":    true,
+	"setup-tokens":       true,
+	"billing-agreements": true,
+}
+
+// endpointLabel() replaces IDs in an API path, e.g. /v2/checkout/orders/{id}/capture, to keep the label cardinality low.
+func endpointLabel(path string) string {
+	segments := strings.Split(path, "/")
+	for i := 1; i < len(segments); i++ {
+		if idParents[segments[i-1]] && segments[i] != "" {
+			segments[i] = "{id}"
+		}
+	}
+	return strings.Join(segments, "/")
+}
@@ -0,0 +1,40 @@
+package paypal
+
+import (
+	"strings"
+
+	"github.com/TunnelWork/payment.PayPal/v2/internal/sqlwrapper"
+)
+
+// Payer is the PayPal account which paid for a ReferenceID: payer ID, email, name and country.
+type Payer = sqlwrapper.Payer
+
+// PayerOf() returns the payer of a paid ReferenceID. All fields are empty if it isn't paid yet.
+func (pg *PrepaidGateway) PayerOf(referenceID string) (Payer, error) {
+	return sqlwrapper.SelectPayer(pg.db, pg.orderSqlTable, referenceID)
+}
+
+// PaymentsByPayer() finds every payment made by a PayPal account, given its payer ID or email.
+func (pg *PrepaidGateway) PaymentsByPayer(payerIDOrEmail string) ([]PaymentDetail, error) {
+	ctx, span := pg.startSpan("paypal.PaymentsByPayer")
+	defer span.End()
+
+	done := pg.observeDB(ctx, "SelectOrdersByPayer")
+	records, err := sqlwrapper.SelectOrdersByPayer(pg.db, pg.orderSqlTable, strings.TrimSpace(payerIDOrEmail))
+	done(err)
+	if err != nil {
+		return nil, err
+	}
+
+	details := make([]PaymentDetail, 0, len(records))
+	for _, record := range records {
+		done := pg.observeDB(ctx, "SelectRefunds", "ReferenceID", record.ReferenceID)
+		refunds, err := sqlwrapper.SelectRefunds(pg.db, pg.orderSqlTable, record.ReferenceID)
+		done(err)
+		if err != nil {
+			return details, err
+		}
+		details = append(details, paymentDetail(record, refunds))
+	}
+	return details, nil
+}
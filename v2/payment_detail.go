@@ -0,0 +1,164 @@
+package paypal
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/TunnelWork/payment.PayPal/v2/internal/sqlwrapper"
+	pp "github.com/plutov/paypal/v4"
+)
+
+type (
+	// Breakdown is what the merchant actually receives for a capture, or gives back for a refund.
+	Breakdown = sqlwrapper.Breakdown
+
+	RefundDetail = sqlwrapper.RefundRecord
+
+	// PaymentDetail is the money actually moved for a ReferenceID, fees included.
+	PaymentDetail struct {
+		ReferenceID string         `json:"reference_id"`
+		OrderID     string         `json:"order_id"`
+		CaptureID   string         `json:"capture_id"`
+		Currency    string         `json:"currency"`
+		Total       float64        `json:"total"`
+		Refunded    float64        `json:"refunded"`
+		Payer       Payer          `json:"payer"`
+		Capture     Breakdown      `json:"capture"`
+		Refunds     []RefundDetail `json:"refunds"`
+	}
+)
+
+// PaymentDetail() reports gross, fee and net amounts of the capture and every refund of a ReferenceID.
+func (pg *PrepaidGateway) PaymentDetail(referenceID string) (PaymentDetail, error) {
+	ctx, span := pg.startSpan("paypal.PaymentDetail", "ReferenceID", referenceID)
+	defer span.End()
+
+	done := pg.observeDB(ctx, "SelectOrder", "ReferenceID", referenceID)
+	record, err := sqlwrapper.SelectOrder(pg.db, pg.orderSqlTable, referenceID)
+	done(err)
+	if err != nil {
+		return PaymentDetail{}, err
+	}
+	done = pg.observeDB(ctx, "SelectRefunds", "ReferenceID", referenceID)
+	refunds, err := sqlwrapper.SelectRefunds(pg.db, pg.orderSqlTable, referenceID)
+	done(err)
+	if err != nil {
+		return PaymentDetail{}, err
+	}
+
+	return paymentDetail(record, refunds), nil
+}
+
+func paymentDetail(record sqlwrapper.OrderRecord, refunds []RefundDetail) PaymentDetail {
+	return PaymentDetail{
+		ReferenceID: record.ReferenceID,
+		OrderID:     record.OrderID,
+		CaptureID:   record.CaptureID,
+		Currency:    record.Currency,
+		Total:       record.Total,
+		Refunded:    record.Refunded,
+		Payer:       record.Payer,
+		Capture:     record.Breakdown,
+		Refunds:     refunds,
+	}
+}
+
+// captureBreakdown() looks for the seller_receivable_breakdown of captureID in the order,
+// and asks PayPal for the capture details if the order doesn't carry it.
+func (pg *PrepaidGateway) captureBreakdown(ctx context.Context, order *pp.Order, captureID string) (Breakdown, error) {
+	for _, unit := range order.PurchaseUnits {
+		if unit.Payments == nil {
+			continue
+		}
+		for _, capture := range unit.Payments.Captures {
+			if capture.ID == captureID && capture.SellerReceivableBreakdown != nil {
+				return receivableBreakdown(capture.SellerReceivableBreakdown), nil
+			}
+		}
+	}
+
+	capture, err := pg.client(ctx).CapturedDetail(ctx, captureID)
+	if err != nil {
+		return Breakdown{}, apiError(err)
+	}
+	if capture.SellerReceivableBreakdown == nil {
+		return Breakdown{}, fmt.Errorf("%w: capture %s has no seller_receivable_breakdown", ErrPayPalUnexpectedResponse, captureID)
+	}
+	return receivableBreakdown(capture.SellerReceivableBreakdown), nil
+}
+
+func receivableBreakdown(srb *pp.SellerReceivableBreakdown) Breakdown {
+	var breakdown Breakdown
+	breakdown.Gross = moneyValue(srb.GrossAmount)
+	breakdown.Fee = moneyValue(srb.PaypalFee)
+	breakdown.Net = moneyValue(srb.NetAmount)
+	if srb.ReceivableAmount != nil {
+		breakdown.ReceivableAmount = moneyValue(srb.ReceivableAmount)
+		breakdown.ReceivableCurrency = srb.ReceivableAmount.Currency
+	} else if srb.NetAmount != nil {
+		breakdown.ReceivableAmount = breakdown.Net
+		breakdown.ReceivableCurrency = srb.NetAmount.Currency
+	}
+	if srb.ExchangeRate != nil {
+		breakdown.ExchangeRate, _ = strconv.ParseFloat(srb.ExchangeRate.Value, 64)
+	}
+	return breakdown
+}
+
+func moneyValue(m *pp.Money) float64 {
+	if m == nil {
+		return 0
+	}
+	value, _ := strconv.ParseFloat(m.Value, 64)
+	return value
+}
+
+// refundResponse is pp.RefundResponse with the seller_payable_breakdown,
+// which is only returned with the "Prefer: return=representation" header.
+type refundResponse struct {
+	ID                     string    `json:"id"`
+	Status                 string    `json:"status"`
+	Amount                 *pp.Money `json:"amount,omitempty"`
+	SellerPayableBreakdown *struct {
+		GrossAmount *pp.Money `json:"gross_amount,omitempty"`
+		PaypalFee   *pp.Money `json:"paypal_fee,omitempty"`
+		NetAmount   *pp.Money `json:"net_amount,omitempty"`
+	} `json:"seller_payable_breakdown,omitempty"`
+}
+
+// refundCapture() is pp.Client.RefundCapture() asking for the full representation.
+func (pg *PrepaidGateway) refundCapture(ctx context.Context, captureID string, refundRequest pp.RefundCaptureRequest) (*refundResponse, error) {
+	refund := &refundResponse{}
+
+	req, err := pg.client(ctx).NewRequest(ctx, http.MethodPost, fmt.Sprintf("%s/v2/payments/captures/%s/refund", pg.client(ctx).APIBase, captureID), refundRequest)
+	if err != nil {
+		return refund, err
+	}
+	req.Header.Set("Prefer", "return=representation")
+
+	err = pg.client(ctx).SendWithAuth(req, refund)
+	return refund, apiError(err)
+}
+
+func (rr *refundResponse) record(referenceID, captureID string) sqlwrapper.RefundRecord {
+	refund := sqlwrapper.RefundRecord{
+		RefundID:    rr.ID,
+		CaptureID:   captureID,
+		ReferenceID: referenceID,
+		Status:      rr.Status,
+	}
+	if rr.Amount != nil {
+		refund.Currency = rr.Amount.Currency
+		refund.Gross = moneyValue(rr.Amount)
+	}
+	if rr.SellerPayableBreakdown != nil {
+		refund.Fee = moneyValue(rr.SellerPayableBreakdown.PaypalFee)
+		refund.Net = moneyValue(rr.SellerPayableBreakdown.NetAmount)
+		if rr.SellerPayableBreakdown.GrossAmount != nil {
+			refund.Gross = moneyValue(rr.SellerPayableBreakdown.GrossAmount)
+		}
+	}
+	return refund
+}
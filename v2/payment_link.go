@@ -0,0 +1,296 @@
+package paypal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/TunnelWork/Ulysses.Lib/payment"
+	"github.com/TunnelWork/payment.PayPal/v2/internal/sqlwrapper"
+	"github.com/gin-gonic/gin"
+	pp "github.com/plutov/paypal/v4"
+)
+
+// PayPal voids an order not approved by the payer within 3 hours,
+// a payment link can't outlive its order.
+const MaxPaymentLinkTTL = 3 * time.Hour
+
+var (
+	ErrNoApproveLink error = errors.New("paypal: created order has no approve link")
+)
+
+type PaymentLink struct {
+	ReferenceID string    `json:"reference_id"`
+	OrderID     string    `json:"order_id"`
+	URL         string    `json:"url"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+// PaymentLink() creates a PayPal order on the server and returns the payer's approve link,
+// which can be sent to the customer over any channel. After approval, the customer is sent
+// back to the gateway which captures the order and redirects to returnURL.
+// ttl is capped at MaxPaymentLinkTTL, 0 means the maximum.
+func (pg *PrepaidGateway) PaymentLink(pr payment.PaymentRequest, ttl time.Duration) (PaymentLink, error) {
+	ctx, span := pg.startSpan("paypal.PaymentLink", "ReferenceID", pr.Item.ReferenceID)
+	defer span.End()
+
+	if ttl <= 0 || ttl > MaxPaymentLinkTTL {
+		ttl = MaxPaymentLinkTTL
+	}
+
+	pr.Item.Currency = strings.ToUpper(pr.Item.Currency)
+	var err error
+	pr.Item.Price, err = pg.validateAmount(pr.Item.Price, pr.Item.Currency)
+	if err != nil {
+		return PaymentLink{}, err
+	}
+
+	ctx, err = pg.routeAccount(ctx, pr)
+	if err != nil {
+		return PaymentLink{}, err
+	}
+	err = pg.savePending(ctx, pr)
+	if err != nil {
+		return PaymentLink{}, err
+	}
+
+	order, approveURL, err := pg.createRedirectOrder(ctx, pr)
+	if err != nil {
+		return PaymentLink{}, err
+	}
+
+	expiresAt := time.Now().Add(ttl)
+	done := pg.observeDB(ctx, "UpdatePaymentLink", "ReferenceID", pr.Item.ReferenceID, "OrderID", order.ID)
+	err = sqlwrapper.UpdatePaymentLink(pg.db, pg.orderSqlTable, pr.Item.ReferenceID, order.ID, ttl)
+	done(err)
+	if err != nil {
+		return PaymentLink{}, err
+	}
+	pg.metrics.checkoutCreated("payment_link")
+
+	return PaymentLink{
+		ReferenceID: pr.Item.ReferenceID,
+		OrderID:     order.ID,
+		URL:         approveURL,
+		ExpiresAt:   expiresAt,
+	}, nil
+}
+
+// createRedirectOrder() creates an order to be approved on PayPal's site, which then sends the payer back to
+// the return or cancel endpoint of the gateway. The PaymentRequest must be validated already.
+func (pg *PrepaidGateway) createRedirectOrder(ctx context.Context, pr payment.PaymentRequest) (*pp.Order, string, error) {
+	order, err := pg.client(ctx).CreateOrder(withLogFields(ctx, "ReferenceID", pr.Item.ReferenceID), pp.OrderIntentCapture, []pp.PurchaseUnitRequest{
+		{
+			ReferenceID: pr.Item.ReferenceID,
+			Amount: &pp.PurchaseUnitAmount{
+				Currency: pr.Item.Currency,
+				Value:    formatAmount(pr.Item.Price, pr.Item.Currency),
+			},
+		},
+	}, nil, &pp.ApplicationContext{
+		UserAction: pp.UserActionPayNow,
+		ReturnURL:  pg.callbackURL("return"),
+		CancelURL:  pg.callbackURL("cancel"),
+	})
+	if err != nil {
+		return nil, "", apiError(err)
+	}
+
+	approveURL := approveLink(order)
+	if approveURL == "" {
+		return nil, "", ErrNoApproveLink
+	}
+	return order, approveURL, nil
+}
+
+// approveLink() finds the HATEOAS link the payer should be sent to.
+func approveLink(order *pp.Order) string {
+	for _, link := range order.Links {
+		if link.Rel == "approve" || link.Rel == "payer-action" {
+			return link.Href
+		}
+	}
+	return ""
+}
+
+// callbackURL() is the full URL of one of the gateway's callback endpoints.
+func (pg *PrepaidGateway) callbackURL(endpoint string) string {
+	return fmt.Sprintf("%s/paypal/%s/%s", pg.callbackBase, pg.instanceID, endpoint)
+}
+
+// handlerPaypalReturn receives the payer back from PayPal after approval.
+// PayPal appends ?token=<OrderID>&PayerID=<PayerID> to the return_url.
+func (pg *PrepaidGateway) handlerPaypalReturn(c *gin.Context) {
+	ctx := c.Request.Context()
+	OrderID := c.Query("token")
+	if OrderID == "" {
+		pg.respondCallback(c, "return", http.StatusBadRequest, BAD_REQUEST)
+		return
+	}
+
+	done := pg.observeDB(ctx, "SelectOrderByOrderID", "OrderID", OrderID)
+	record, err := sqlwrapper.SelectOrderByOrderID(pg.db, pg.orderSqlTable, OrderID)
+	done(err)
+	if err != nil {
+		pg.respondCallback(c, "return", http.StatusBadRequest, BAD_REQUEST)
+		return
+	}
+	ReferenceID := record.ReferenceID
+	setSpanReferenceID(ctx, ReferenceID)
+	if !record.Active {
+		pg.callbackReturn(c, "return", ReferenceID, http.StatusConflict, PAYMENT_ALREADY_PAID)
+		return
+	}
+	if ctx, err = pg.recordAccount(ctx, record); err != nil {
+		pg.callbackReturn(c, "return", ReferenceID, http.StatusInternalServerError, SERVER_BAD_DATABASE)
+		return
+	}
+
+	done = pg.observeDB(ctx, "SelectLinkExpired", "ReferenceID", ReferenceID)
+	expired, err := sqlwrapper.SelectLinkExpired(pg.db, pg.orderSqlTable, ReferenceID)
+	done(err)
+	if err != nil {
+		pg.callbackReturn(c, "return", ReferenceID, http.StatusInternalServerError, SERVER_BAD_DATABASE)
+		return
+	}
+	if expired {
+		pg.callbackReturn(c, "return", ReferenceID, http.StatusGone, PAYMENT_LINK_EXPIRED)
+		return
+	}
+
+	CaptureID, err := pg.captureOrder(ctx, OrderID)
+	if err != nil {
+		if pg.UpdateHandler != nil {
+			(*pg.UpdateHandler)(
+				ReferenceID,
+				payment.PaymentResult{
+					Status: payment.UNKNOWN,
+					Msg:    fmt.Sprintf("(Unverified)ReferenceID %s: pp.client.CaptureOrder() failed: %s", ReferenceID, err),
+				},
+			)
+		}
+		status, resp := paypalFailure(err, http.StatusInternalServerError, SERVER_PAYPAL_BAD_ORDER)
+		pg.callbackReturn(c, "return", ReferenceID, status, resp)
+		return
+	}
+
+	status, resp := pg._verifyApproval(ctx, OrderID, ReferenceID, CaptureID)
+	pg.callbackReturn(c, "return", ReferenceID, status, resp)
+}
+
+// handlerPaypalCancel receives the payer back from PayPal after cancelling.
+func (pg *PrepaidGateway) handlerPaypalCancel(c *gin.Context) {
+	ctx := c.Request.Context()
+	OrderID := c.Query("token")
+	if OrderID == "" {
+		pg.respondCallback(c, "cancel", http.StatusBadRequest, BAD_REQUEST)
+		return
+	}
+
+	done := pg.observeDB(ctx, "SelectOrderByOrderID", "OrderID", OrderID)
+	record, err := sqlwrapper.SelectOrderByOrderID(pg.db, pg.orderSqlTable, OrderID)
+	done(err)
+	if err != nil {
+		pg.respondCallback(c, "cancel", http.StatusBadRequest, BAD_REQUEST)
+		return
+	}
+
+	setSpanReferenceID(ctx, record.ReferenceID)
+	// Paid already, e.g. in another tab, canceling doesn't close it
+	if !record.Active {
+		pg.callbackReturn(c, "cancel", record.ReferenceID, http.StatusConflict, PAYMENT_ALREADY_PAID)
+		return
+	}
+
+	if pg.UpdateHandler != nil {
+		(*pg.UpdateHandler)(
+			record.ReferenceID,
+			payment.PaymentResult{
+				Status: payment.CLOSED,
+				Msg:    fmt.Sprintf("(Unverified)ReferenceID %s: Payer canceled on PayPal", record.ReferenceID),
+			},
+		)
+	}
+	pg.callbackReturn(c, "cancel", record.ReferenceID, http.StatusOK, BUYER_PAYPAL_CANCEL)
+}
+
+// captureOrder() captures an approved order and returns the CaptureID.
+// Capturing again (e.g. the payer reloads the return page) is not an error.
+func (pg *PrepaidGateway) captureOrder(ctx context.Context, OrderID string) (string, error) {
+	capture, err := pg.client(ctx).CaptureOrder(ctx, OrderID, pp.CaptureOrderRequest{})
+	err = apiError(err)
+	if err == nil {
+		if len(capture.PurchaseUnits) > 0 && capture.PurchaseUnits[0].Payments != nil && len(capture.PurchaseUnits[0].Payments.Captures) > 0 {
+			return capture.PurchaseUnits[0].Payments.Captures[0].ID, nil
+		}
+		return "", fmt.Errorf("%w: order %s captured without a capture", ErrPayPalUnexpectedResponse, OrderID)
+	}
+
+	order, getErr := pg.client(ctx).GetOrder(ctx, OrderID)
+	if getErr != nil || order.Status != "COMPLETED" {
+		return "", err
+	}
+	if len(order.PurchaseUnits) > 0 && order.PurchaseUnits[0].Payments != nil && len(order.PurchaseUnits[0].Payments.Captures) > 0 {
+		return order.PurchaseUnits[0].Payments.Captures[0].ID, nil
+	}
+	return "", err
+}
+
+// redirectReturn() sends the payer to returnURL?ref_id=...&status=...&message=...,
+// or shows the result if there is no returnURL.
+// status is one of paid, credited, unpaid, review, rejected, refunded, canceled, expired or error. message is the response message, e.g. PAYMENT_OK.
+func (pg *PrepaidGateway) redirectReturn(c *gin.Context, ReferenceID string, status int, resp gin.H) {
+	if pg.returnURL == "" {
+		c.JSON(status, resp)
+		return
+	}
+
+	target, err := url.Parse(pg.returnURL)
+	if err != nil {
+		c.JSON(status, resp)
+		return
+	}
+	query := target.Query()
+	query.Set("ref_id", ReferenceID)
+	query.Set("status", returnStatus(resp))
+	if message, ok := resp["message"].(string); ok {
+		query.Set("message", message)
+	}
+	target.RawQuery = query.Encode()
+
+	c.Set(callbackStatusKey, status)
+	c.Redirect(http.StatusSeeOther, target.String())
+}
+
+// callbackReturn() is redirectReturn() for a callback, counting it by action and outcome.
+func (pg *PrepaidGateway) callbackReturn(c *gin.Context, action, ReferenceID string, status int, resp gin.H) {
+	pg.metrics.callback(action, resp)
+	pg.redirectReturn(c, ReferenceID, status, resp)
+}
+
+func returnStatus(resp gin.H) string {
+	switch resp["message"] {
+	case PAYMENT_OK["message"], PAYMENT_ALREADY_PAID["message"]:
+		return "paid"
+	case PAYMENT_CREDITED["message"]:
+		return "credited"
+	case PAYMENT_NOT_APPROVED["message"]:
+		return "unpaid"
+	case PAYMENT_UNDER_REVIEW["message"]:
+		return "review"
+	case PAYMENT_REJECTED["message"]:
+		return "rejected"
+	case PAYMENT_REFUNDED["message"]:
+		return "refunded"
+	case BUYER_PAYPAL_CANCEL["message"]:
+		return "canceled"
+	case PAYMENT_LINK_EXPIRED["message"]:
+		return "expired"
+	default:
+		return "error"
+	}
+}
@@ -3,23 +3,32 @@ package paypal
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"math"
+	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
 
-	"github.com/TunnelWork/Ulysses.Lib/api"
 	"github.com/TunnelWork/Ulysses.Lib/payment"
 	"github.com/TunnelWork/payment.PayPal/v2/internal/sqlwrapper"
 	"github.com/gin-gonic/gin"
 	pp "github.com/plutov/paypal/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var (
-	ErrBadInitConf    error = errors.New("paypal: bad initConf")
-	ErrOrderNotPaid   error = errors.New("paypal: order is not in paid state")
-	ErrRepeatedRefund error = errors.New("paypal: refund amount exceeds paid amount")
-	ErrNoCaptureID    error = errors.New("paypal: no capture ID associated or there was an error when fetching capture ID")
+	ErrBadInitConf   error = errors.New("paypal: bad initConf")
+	ErrRefundPending error = errors.New("paypal: refund is issued but not completed yet")
+
+	// Refunds refused before asking PayPal, matching the kind PayPal would refuse them with, see APIError
+	ErrOrderNotPaid           error = &kindError{"paypal: order is not in paid state", ErrRefundNotAllowed}
+	ErrNoCaptureID            error = &kindError{"paypal: no capture ID associated", ErrRefundNotAllowed}
+	ErrRepeatedRefund         error = &kindError{"paypal: order is fully refunded already", ErrCaptureFullyRefunded}
+	ErrRefundExceedsPaid      error = &kindError{"paypal: refund amount exceeds paid amount", ErrRefundAmountExceeded}
+	ErrRefundCurrencyMismatch error = &kindError{"paypal: refund currency differs from the paid one", ErrRefundNotAllowed}
 
 	ExampleInitConf = map[string]string{
 		// These 3 needs to be acquired from PayPal developer dashboard
@@ -31,11 +40,88 @@ var (
 		// Don't include DB name, for it is protected by *sql.DB.
 		"orderSqlTable": `prepaid_paypal_orders_2`, // if unset, will use default value: prepaid_paypal_orders
 
-		// After the payment being executed, user will be 301 to returnURL
-		"returnURL": `https://ulysses.tunnel.work/billing.html`, // reserved for future. tmp unused.
+		// Optional. Per-currency bounds for a single payment, in JSON.
+		"amountLimits": `{"USD":{"min":1,"max":500},"JPY":{"min":100}}`,
+
+		// Optional. Default PayPal JS SDK options, in JSON. See SDKOptions.
+		"sdkOptions": `{"components":["buttons"],"enable_funding":["venmo","paylater"],"locale":"en_US"}`,
+
+		// Optional. With "card-fields" in the components of sdkOptions: how cards are verified, SCA_WHEN_REQUIRED (default) or SCA_ALWAYS,
+		// and which 3-D Secure outcomes are captured, see ThreeDSPolicy. Defaults to reject_failed.
+		"cardVerification": `SCA_WHEN_REQUIRED`,
+		"threeDSPolicy":    `reject_failed`,
+
+		// Optional. Built-in risk rules run on every captured payment, in JSON. See RiskRulesConfig.
+		"riskRules": `{"payer_velocity":{"max":3,"window":"24h","decision":"hold"},"country":{"deny":["KP"],"decision":"refund"}}`,
+
+		// Optional. Which captures failing verification are refunded automatically, in JSON. See AutoRefundPolicy.
+		"autoRefund": `{"amount_mismatch":true,"unknown_reference":true,"duplicate":true,"liability_not_shifted":true}`,
+
+		// Optional. What to do with a second payment for a ReferenceID already paid: refund, credit or flag (default).
+		"duplicatePayment": `refund`,
+
+		// Optional. Retries and circuit breaker of PayPal calls, in JSON. See ResilienceConfig.
+		"resilience": `{"retry":{"max_attempts":3,"base_delay":"200ms","max_delay":"2s"},"circuit_breaker":{"failures":5,"cooldown":"30s"}}`,
+
+		// Optional. Rate limits, body size cap and negative cache of the public callback endpoints, in JSON. See AbuseProtectionConfig.
+		"abuseProtection": `{"per_ip":{"rate":5,"burst":20},"per_reference":{"rate":1,"burst":10},"max_body_bytes":16384,"negative_cache_ttl":"30s","max_webhook_body_bytes":262144}`,
+
+		// Optional. PayPal business accounts besides the one above, by name, in JSON. See MerchantAccount.
+		// Which one a PaymentRequest is paid to is picked by accountRouting, see AccountRouting, or GatewayConfig.AccountRouter.
+		// Orders remember their account, so they are refunded from it.
+		"accounts":       `{"brand_b":{"client_id":"UVWX","secret_id":"YZ0123456789"}}`,
+		"accountRouting": `{"reference_prefixes":{"brandb-":"brand_b"},"currencies":{"EUR":"brand_b"}}`,
+
+		// Optional. Where ReloadCredentials() and WatchCredentials() load new credentials from, in JSON. See CredentialRotationConfig.
+		"credentialRotation": `{"source":"file","path":"/etc/ulysses/paypal.json","interval":"1m","grace_period":"15m"}`,
+
+		// Optional. Start even if PayPal OAuth fails, degraded as reported by Health(). Access tokens are then asked for on first use.
+		"lazyStartup": `true`,
+
+		// Optional. Serves Health() at paypal/<instanceID>/health, under the payment callback path,
+		// to requests with an "Authorization: Bearer <healthToken>" header.
+		"healthToken": `<A_LONG_RANDOM_STRING>`,
+
+		// Optional. Subscribes every merchant account to PayPal webhook events at paypal/<instanceID>/webhook[/<account>],
+		// under the payment callback path, in JSON. See WebhookConfig. Unset, webhooks are left alone.
+		"webhooks": `{"event_types":["PAYMENT.CAPTURE.COMPLETED","PAYMENT.CAPTURE.DENIED","PAYMENT.CAPTURE.REFUNDED","PAYMENT.CAPTURE.REVERSED"]}`,
+
+		// After paying through a payment link, user will be 303 to returnURL?ref_id=<ReferenceID>
+		"returnURL": `https://ulysses.tunnel.work/billing.html`, // if unset, the result is shown as JSON
 	}
 )
 
+// GatewayConfig is the initConf of NewPrepaidGateway() when more than strings are needed.
+// A plain map[string]string, as ExampleInitConf, is still accepted.
+type GatewayConfig struct {
+	InitConf map[string]string // See ExampleInitConf
+
+	// Optional. Gateway metrics are registered here, labelled with the instance ID.
+	Registerer prometheus.Registerer
+
+	// Optional. PayPal calls, database writes and failures are logged here, with secrets redacted.
+	Logger Logger
+
+	// Optional. Proxies, by IP or CIDR, trusted with the X-Forwarded-For of requests to Handler(),
+	// to tell the client IP rate limits apply to. None by default.
+	TrustedProxies []string
+
+	// Optional. Callbacks, PayPal calls and database queries are traced with it.
+	// Defaults to the global TracerProvider of OpenTelemetry.
+	TracerProvider trace.TracerProvider
+
+	// Optional. Picks the merchant account of each PaymentRequest before the AccountRouting of initConf.
+	AccountRouter AccountRouter
+
+	// Optional. Where ReloadCredentials() loads the credentials from, instead of the source of the
+	// "credentialRotation" of initConf, whose interval and grace period still apply.
+	CredentialSource CredentialSource
+
+	// Optional. Leaves the startup of a serving gateway out, for tools working next to one like paypalctl:
+	// the orders table is not migrated, PayPal OAuth waits for the first call and webhooks are not subscribed.
+	NoStartup bool
+}
+
 type PrepaidGateway struct {
 	instanceID string
 
@@ -45,21 +131,90 @@ type PrepaidGateway struct {
 	initConf map[string]string // debug only
 
 	// PayPal JS SDK
-	sdkScriptURL string
+	sdkOptions SDKOptions
+
+	// Keyed by name, the default account of initConf is ""
+	accounts       map[string]*merchantAccount
+	accountRouting AccountRouting
+	accountRouter  AccountRouter
+	credentials    credentialRotation
+
+	healthToken string // The health endpoint is not served if empty
+
+	// Sorted, nil if webhooks are not subscribed to
+	webhookEventTypes []string
+
+	// Keyed by currency
+	amountLimits map[string]AmountLimit
+
+	// Card fields
+	cardVerification string
+	threeDSPolicy    ThreeDSPolicy
 
-	// plutov/paypal
-	client *pp.Client
+	// Run in order on every captured payment
+	riskRules []RiskRule
+
+	autoRefundPolicy AutoRefundPolicy
+	duplicateAction  DuplicateAction
+
+	// nil if no Registerer or Logger is configured
+	metrics *gatewayMetrics
+	log     *gatewayLogger
+	tracer  trace.Tracer
+
+	// nil if disabled
+	breaker *circuitBreaker
+
+	abuse *abuseProtection
 
 	//
-	onClose func(*gin.Context)
+	onClose        func(*gin.Context)
+	onCheckoutPage func(*gin.Context)
+	onReturn       func(*gin.Context)
+	onCancel       func(*gin.Context)
+	onRedirectPage func(*gin.Context)
+	onRedirect     func(*gin.Context)
+	onCardOrder    func(*gin.Context)
+	onCardCapture  func(*gin.Context)
+	onHealth       func(*gin.Context)
+	onWebhook      func(*gin.Context)
+
+	// Serves the handlers above for Handler()
+	router http.Handler
 
 	// Handler func used to notify the Ulysses server
 	UpdateHandler *func(referenceID string, newResult payment.PaymentResult)
 	callbackBase  string
+	returnURL     string
 }
 
-// NewPrepaidGateway() is a payment.PrepaidGatewayGen
+// NewPrepaidGateway() is a payment.PrepaidGatewayGen. See New() to create a gateway outside of Ulysses.
 func NewPrepaidGateway(db *sql.DB, instanceID string, initConf interface{}) (payment.PrepaidGateway, error) {
+	var config GatewayConfig
+	switch conf := initConf.(type) {
+	case map[string]string:
+		config.InitConf = conf
+	case GatewayConfig:
+		config = conf
+	case *GatewayConfig:
+		if conf == nil {
+			return nil, ErrBadInitConf
+		}
+		config = *conf
+	default:
+		return nil, ErrBadInitConf
+	}
+
+	pg, err := New(db, instanceID, config)
+	if err != nil {
+		return nil, err
+	}
+	return pg, nil
+}
+
+// New() creates a gateway without the payment.RegisterPrepaidGatewayGenerator() registry of Ulysses.
+// Its endpoints are served by Handler(), or registered on a gin router by RegisterRoutes().
+func New(db *sql.DB, instanceID string, config GatewayConfig) (*PrepaidGateway, error) {
 	var iConf map[string]string
 	var clientID string
 	var secretID string
@@ -68,7 +223,7 @@ func NewPrepaidGateway(db *sql.DB, instanceID string, initConf interface{}) (pay
 	var callbackBase string
 	var ok bool
 
-	if iConf, ok = initConf.(map[string]string); !ok {
+	if iConf = config.InitConf; iConf == nil {
 		return nil, ErrBadInitConf
 	}
 
@@ -89,48 +244,298 @@ func NewPrepaidGateway(db *sql.DB, instanceID string, initConf interface{}) (pay
 	if callbackBase, ok = iConf["callbackBase"]; !ok {
 		return nil, ErrBadInitConf
 	}
+	amountLimits := map[string]AmountLimit{}
+	if amountLimitsJson := iConf["amountLimits"]; amountLimitsJson != "" {
+		if err := json.Unmarshal([]byte(amountLimitsJson), &amountLimits); err != nil {
+			return nil, ErrBadInitConf
+		}
+	}
+	amountLimits, err := buildAmountLimits(amountLimits)
+	if err != nil {
+		return nil, err
+	}
+	var sdkOptions SDKOptions
+	if sdkOptionsJson := iConf["sdkOptions"]; sdkOptionsJson != "" {
+		if err := json.Unmarshal([]byte(sdkOptionsJson), &sdkOptions); err != nil {
+			return nil, ErrBadInitConf
+		}
+	}
+	cardVerification := iConf["cardVerification"]
+	if cardVerification == "" {
+		cardVerification = CardVerificationSCAWhenRequired
+	} else if cardVerification != CardVerificationSCAWhenRequired && cardVerification != CardVerificationSCAAlways {
+		return nil, ErrBadInitConf
+	}
+	threeDSPolicy := ThreeDSPolicy(iConf["threeDSPolicy"])
+	if threeDSPolicy == "" {
+		threeDSPolicy = ThreeDSRejectFailed
+	} else if !threeDSPolicy.valid() {
+		return nil, ErrBadThreeDSPolicy
+	}
+	var riskRules []RiskRule
+	if riskRulesJson := iConf["riskRules"]; riskRulesJson != "" {
+		var riskRulesConfig RiskRulesConfig
+		if err := json.Unmarshal([]byte(riskRulesJson), &riskRulesConfig); err != nil {
+			return nil, ErrBadInitConf
+		}
+		var err error
+		if riskRules, err = riskRulesConfig.Rules(); err != nil {
+			return nil, err
+		}
+	}
+	var autoRefundPolicy AutoRefundPolicy
+	if autoRefundJson := iConf["autoRefund"]; autoRefundJson != "" {
+		if err := json.Unmarshal([]byte(autoRefundJson), &autoRefundPolicy); err != nil {
+			return nil, ErrBadInitConf
+		}
+	}
+	duplicateAction := DuplicateAction(iConf["duplicatePayment"])
+	if duplicateAction == "" {
+		duplicateAction = DuplicateFlag
+		if autoRefundPolicy.Duplicate {
+			duplicateAction = DuplicateRefund
+		}
+	} else if !duplicateAction.valid() {
+		return nil, ErrBadDuplicateAction
+	}
+
+	var resilienceConfig ResilienceConfig
+	if resilienceJson := iConf["resilience"]; resilienceJson != "" {
+		if err := json.Unmarshal([]byte(resilienceJson), &resilienceConfig); err != nil {
+			return nil, ErrBadInitConf
+		}
+	}
+	retry, breaker, err := resilienceConfig.build()
+	if err != nil {
+		return nil, err
+	}
+	var abuseProtectionConfig AbuseProtectionConfig
+	if abuseProtectionJson := iConf["abuseProtection"]; abuseProtectionJson != "" {
+		if err := json.Unmarshal([]byte(abuseProtectionJson), &abuseProtectionConfig); err != nil {
+			return nil, ErrBadInitConf
+		}
+	}
+	abuse, err := abuseProtectionConfig.build()
+	if err != nil {
+		return nil, err
+	}
 
-	c, err := pp.NewClient(clientID, secretID, apiBase)
+	metrics, err := newGatewayMetrics(config.Registerer, instanceID)
+	if err != nil {
+		return nil, err
+	}
+	log := newGatewayLogger(config.Logger, instanceID)
+	tracer := newTracer(config.TracerProvider)
+	if breaker != nil {
+		breaker.onChange = func(open bool) {
+			metrics.circuitChanged(open)
+			if open {
+				log.Error("PayPal calls failing, circuit breaker open", "cooldown", breaker.cooldown)
+			} else {
+				log.Info("PayPal calls succeeding again, circuit breaker closed")
+			}
+		}
+	}
+
+	var credentialRotationConfig CredentialRotationConfig
+	if credentialRotationJson := iConf["credentialRotation"]; credentialRotationJson != "" {
+		if err := json.Unmarshal([]byte(credentialRotationJson), &credentialRotationConfig); err != nil {
+			return nil, ErrBadInitConf
+		}
+	}
+	credentialRotation, err := credentialRotationConfig.build(db, instanceID)
 	if err != nil {
 		return nil, err
-	} else {
-		_, err := c.GetAccessToken(context.Background())
+	}
+	if config.CredentialSource != nil {
+		credentialRotation.source = config.CredentialSource
+	}
+	lazyStartup := false
+	if lazyStartupStr := iConf["lazyStartup"]; lazyStartupStr != "" {
+		if lazyStartup, err = strconv.ParseBool(lazyStartupStr); err != nil {
+			return nil, ErrBadInitConf
+		}
+	}
+
+	// Every account has its own client, so its own access token. They share the transport.
+	transport := &retryTransport{
+		next:    traceTransport(tracer, log.transport(metrics.transport(http.DefaultTransport))),
+		policy:  retry,
+		breaker: breaker,
+		metrics: metrics,
+		log:     log,
+	}
+	credentials := map[string]MerchantAccount{}
+	if accountsJson := iConf["accounts"]; accountsJson != "" {
+		if err := json.Unmarshal([]byte(accountsJson), &credentials); err != nil {
+			return nil, ErrBadInitConf
+		}
+	}
+	if _, ok := credentials[""]; ok {
+		return nil, ErrBadInitConf // The default account is the one of initConf
+	}
+	credentials[""] = MerchantAccount{ClientID: clientID, SecretID: secretID, ApiBase: apiBase}
+	accounts := map[string]*merchantAccount{}
+	for name, cred := range credentials {
+		if cred.ApiBase == "" {
+			cred.ApiBase = apiBase
+		}
+		c, err := pp.NewClient(cred.ClientID, cred.SecretID, cred.ApiBase)
 		if err != nil {
 			return nil, err
 		}
+		account := &merchantAccount{name: name, client: c}
+		account.httpClient = &http.Client{Transport: &tokenTransport{
+			next:    &credentialFallback{next: transport, account: account, metrics: metrics, log: log},
+			account: account,
+		}}
+		c.SetHTTPClient(account.httpClient)
+		if !config.NoStartup {
+			_, err = c.GetAccessToken(withLogFields(context.Background(), "account", name))
+			if err != nil {
+				if !lazyStartup {
+					return nil, apiError(err)
+				}
+				log.Warn("PayPal OAuth failed, starting degraded", "account", name, "error", apiError(err))
+			}
+		}
+		metrics.credentialsChanged(name, true)
+		accounts[name] = account
 	}
-
-	if err = sqlwrapper.InitializeTables(db, orderSqlTable); err != nil {
+	var accountRouting AccountRouting
+	var webhookEventTypes []string
+	if webhooksJson := iConf["webhooks"]; webhooksJson != "" {
+		var webhookConfig WebhookConfig
+		if err := json.Unmarshal([]byte(webhooksJson), &webhookConfig); err != nil {
+			return nil, ErrBadInitConf
+		}
+		webhookEventTypes = webhookConfig.build()
+	}
+	if accountRoutingJson := iConf["accountRouting"]; accountRoutingJson != "" {
+		if err := json.Unmarshal([]byte(accountRoutingJson), &accountRouting); err != nil {
+			return nil, ErrBadInitConf
+		}
+	}
+	if err = accountRouting.validate(accounts); err != nil {
 		return nil, err
 	}
 
+	if !config.NoStartup {
+		if err = sqlwrapper.InitializeTables(db, orderSqlTable); err != nil {
+			log.Error("database initialization failed", "table", orderSqlTable, "error", err)
+			return nil, err
+		}
+	}
+	log.Info("gateway initialized", "apiBase", apiBase, "table", orderSqlTable)
+
 	var pg PrepaidGateway = PrepaidGateway{
-		instanceID:    instanceID,
-		db:            db,
-		orderSqlTable: orderSqlTable,
-		initConf:      iConf,
-		sdkScriptURL:  `https://www.paypal.com/sdk/js?client-id=` + clientID + `&currency=`,
-		client:        c,
-		callbackBase:  callbackBase,
+		instanceID:        instanceID,
+		db:                db,
+		orderSqlTable:     orderSqlTable,
+		initConf:          iConf,
+		sdkOptions:        sdkOptions,
+		accountRouting:    accountRouting,
+		accountRouter:     config.AccountRouter,
+		accounts:          accounts,
+		credentials:       credentialRotation,
+		healthToken:       iConf["healthToken"],
+		webhookEventTypes: webhookEventTypes,
+		amountLimits:      amountLimits,
+		callbackBase:      callbackBase,
+		returnURL:         iConf["returnURL"],
+
+		cardVerification: cardVerification,
+		threeDSPolicy:    threeDSPolicy,
+
+		riskRules:        riskRules,
+		autoRefundPolicy: autoRefundPolicy,
+		duplicateAction:  duplicateAction,
+
+		metrics: metrics,
+		log:     log,
+		tracer:  tracer,
+		breaker: breaker,
+		abuse:   abuse,
+	}
+	pg.onClose = pg.protected("onClose", pg.traced("paypal.onClose", pg.handlerPaypalExperienceOnClose))
+	pg.onCheckoutPage = pg.protected("checkout", pg.traced("paypal.checkout", pg.handlerCheckoutPage))
+	pg.onReturn = pg.protected("return", pg.traced("paypal.return", pg.handlerPaypalReturn))
+	pg.onCancel = pg.protected("cancel", pg.traced("paypal.cancel", pg.handlerPaypalCancel))
+	pg.onRedirectPage = pg.protected("redirect_page", pg.traced("paypal.redirect.page", pg.handlerRedirectPage))
+	pg.onRedirect = pg.protected("redirect", pg.traced("paypal.redirect", pg.handlerRedirectCheckout))
+	pg.onCardOrder = pg.protected("card_order", pg.traced("paypal.card.order", pg.handlerCardCreateOrder))
+	pg.onCardCapture = pg.protected("card_capture", pg.traced("paypal.card.capture", pg.handlerCardCapture))
+	pg.onHealth = pg.protected("health", pg.handlerHealth)
+	pg.onWebhook = pg.protectedWebhook("webhook", pg.traced("paypal.webhook", pg.handlerWebhook))
+	if pg.router, err = newRouter(pg.routes(), config.TrustedProxies); err != nil {
+		return nil, err
+	}
+
+	if pg.webhookEventTypes != nil && !config.NoStartup {
+		// Saved IDs verify events even if PayPal can't be reached now. Not subscribing leaves payments
+		// working, so it is only reported by Health(), see SyncWebhooks().
+		if err = pg.loadWebhooks(context.Background()); err != nil {
+			return nil, err
+		}
+		pg.SyncWebhooks()
 	}
-	pg.onClose = pg.handlerPaypalExperienceOnClose
 
 	return &pg, nil
 }
 
 // CheckoutForm() is called when frontend requests a Checkout Form to be rendered
+// An *AmountError is returned for an unsupported currency or an amount out of limits,
+// in which case nothing is saved. ErrAlreadyPaid is returned for a ReferenceID paid already.
+// Requesting a form again for a pending ReferenceID updates the amount to be paid.
 func (pg *PrepaidGateway) CheckoutForm(pr payment.PaymentRequest) (formRenderParams map[string]interface{}, err error) {
-	// Save the pending order to database
-	pr.Item.Price = math.Round(pr.Item.Price*100) / 100
+	return pg.CheckoutFormWithSDKOptions(pr, SDKOptions{})
+}
+
+// CheckoutFormWithSDKOptions() is CheckoutForm() with per-request JS SDK options
+// overriding the ones from initConf. payment.PaymentRequest can't carry them since it's
+// shared by all gateways.
+func (pg *PrepaidGateway) CheckoutFormWithSDKOptions(pr payment.PaymentRequest, opts SDKOptions) (formRenderParams map[string]interface{}, err error) {
+	ctx, span := pg.startSpan("paypal.CheckoutFormWithSDKOptions", "ReferenceID", pr.Item.ReferenceID)
+	defer span.End()
+
+	pr.Item.Currency = strings.ToUpper(pr.Item.Currency)
+	pr.Item.Price, err = pg.validateAmount(pr.Item.Price, pr.Item.Currency)
+	if err != nil {
+		return nil, err
+	}
 
-	err = sqlwrapper.PendingOrderID(pg.db, pg.orderSqlTable, pr, PREPAID_GATEWAY)
+	// Save the pending order to database
+	ctx, err = pg.routeAccount(ctx, pr)
+	if err != nil {
+		return nil, err
+	}
+	err = pg.savePending(ctx, pr)
 	if err != nil {
 		return nil, err
 	}
 
-	OnCloseNotifyURL := fmt.Sprintf("%s/paypal/%s/onClose", pg.callbackBase, pg.instanceID)
+	formRenderParams, err = pg.renderParams(ctx, pr, pg.sdkOptions.Merge(opts))
+	if err == nil {
+		pg.metrics.checkoutCreated("smart_buttons")
+	}
+	return formRenderParams, err
+}
+
+// renderParams() builds formRenderParams for a PaymentRequest already saved and validated.
+// A client token is generated if the card fields are enabled.
+func (pg *PrepaidGateway) renderParams(ctx context.Context, pr payment.PaymentRequest, sdkOptions SDKOptions) (map[string]interface{}, error) {
+	OnCloseNotifyURL := pg.callbackURL("onClose")
+
+	cardFields := cardFieldsEnabled(sdkOptions)
+	if cardFields && sdkOptions.ClientToken == "" {
+		clientToken, err := pg.generateClientToken(ctx)
+		if err != nil {
+			return nil, err
+		}
+		sdkOptions.ClientToken = clientToken
+	}
 
-	return map[string]interface{}{
+	params := map[string]interface{}{
 		"notify_url": OnCloseNotifyURL,
 		"purchase_units": []map[string]interface{}{
 			{
@@ -141,15 +546,33 @@ func (pg *PrepaidGateway) CheckoutForm(pr payment.PaymentRequest) (formRenderPar
 				},
 			},
 		},
-		"sdk_url": pg.sdkScriptURL + pr.Item.Currency,
-	}, nil
+		"redirect_url":   pg.callbackURL("redirect/" + url.PathEscape(pr.Item.ReferenceID)),
+		"sdk_url":        sdkOptions.URL(pg.client(ctx).ClientID, pr.Item.Currency),
+		"sdk_attributes": sdkOptions.Attributes(),
+	}
+	if cardFields {
+		pg.cardRenderParams(params, pr.Item.ReferenceID)
+	}
+	return params, nil
 }
 
 // PaymentResult() is called by Ulysses to ACTIVELY verify an order's payment status
 // on the contradictory, please see OnStatusChange() where Ulysses waits for
 // payment gateway to report the payment result.
 func (pg *PrepaidGateway) PaymentResult(referenceID string) (result payment.PaymentResult, err error) {
+	ctx, span := pg.startSpan("paypal.PaymentResult", "ReferenceID", referenceID)
+	defer span.End()
+
+	ctx, err = pg.referenceAccount(ctx, referenceID)
+	if err != nil {
+		return payment.PaymentResult{
+			Status: payment.UNKNOWN,
+			Msg:    fmt.Sprintf("ReferenceID %s: Can't check with database for merchant account", referenceID),
+		}, err
+	}
+	done := pg.observeDB(ctx, "SelectOrderID", "ReferenceID", referenceID)
 	orderID, err := sqlwrapper.SelectOrderID(pg.db, pg.orderSqlTable, referenceID)
+	done(err)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return payment.PaymentResult{
@@ -163,7 +586,8 @@ func (pg *PrepaidGateway) PaymentResult(referenceID string) (result payment.Paym
 		}, err
 	}
 	var order *pp.Order
-	order, err = pg.client.GetOrder(context.Background(), orderID)
+	order, err = pg.client(ctx).GetOrder(withLogFields(ctx, "ReferenceID", referenceID), orderID)
+	err = apiError(err)
 	if err != nil { // Failed to communicate with PayPal, fail.
 		return payment.PaymentResult{
 			Status: payment.UNKNOWN,
@@ -186,32 +610,107 @@ func (pg *PrepaidGateway) PaymentResult(referenceID string) (result payment.Paym
 	}
 
 	priceFloat, _ := strconv.ParseFloat(order.PurchaseUnits[0].Amount.Value, 64)
-
-	return payment.PaymentResult{
+	result = payment.PaymentResult{
 		Status: status,
 		Unit: payment.PaymentUnit{
 			ReferenceID: order.PurchaseUnits[0].ReferenceID,
 			Currency:    order.PurchaseUnits[0].Amount.Currency,
 			Price:       priceFloat,
 		},
-	}, nil
+	}
+
+	// The order stays COMPLETED after the payment is held or refunded
+	if status == payment.PAID {
+		settled, msg, err := pg.settledStatus(ctx, referenceID, orderID)
+		if err != nil {
+			return payment.PaymentResult{
+				Status: payment.UNKNOWN,
+				Msg:    fmt.Sprintf("ReferenceID %s: Can't check with database for refunds and risk decisions", referenceID),
+			}, err
+		}
+		if settled != payment.PAID {
+			result.Status, result.Msg = settled, msg
+		}
+	}
+	return result, nil
+}
+
+// settledStatus() is what the records say of a payment whose order PayPal shows paid: UNPAID if its capture was
+// refunded automatically, UNKNOWN while held by the risk rules, CLOSED once refunded by them or in full.
+// PAID if they say nothing else.
+func (pg *PrepaidGateway) settledStatus(ctx context.Context, referenceID, orderID string) (payment.PaymentStatus, string, error) {
+	done := pg.observeDB(ctx, "SelectAutoRefunds", "ReferenceID", referenceID)
+	autoRefunds, err := sqlwrapper.SelectAutoRefunds(pg.db, pg.orderSqlTable, referenceID)
+	done(err)
+	if err != nil {
+		return payment.UNKNOWN, "", err
+	}
+	for _, autoRefund := range autoRefunds {
+		if autoRefund.OrderID == orderID {
+			return payment.UNPAID, fmt.Sprintf("ReferenceID %s: capture %s automatically refunded for %s", referenceID, autoRefund.CaptureID, autoRefund.Reason), nil
+		}
+	}
+
+	done = pg.observeDB(ctx, "SelectRiskDecisions", "ReferenceID", referenceID)
+	decisions, err := sqlwrapper.SelectRiskDecisions(pg.db, pg.orderSqlTable, referenceID)
+	done(err)
+	if err != nil {
+		return payment.UNKNOWN, "", err
+	}
+	if len(decisions) > 0 {
+		switch latest := decisions[len(decisions)-1]; latest.Decision {
+		case RiskHold.String():
+			return payment.UNKNOWN, fmt.Sprintf("ReferenceID %s: payment held for review by %s: %s", referenceID, latest.Rule, latest.Reason), nil
+		case RiskRefund.String():
+			return payment.CLOSED, fmt.Sprintf("ReferenceID %s: payment refunded by %s: %s", referenceID, latest.Rule, latest.Reason), nil
+		}
+	}
+
+	done = pg.observeDB(ctx, "SelectPaymentRequest", "ReferenceID", referenceID)
+	pr, err := sqlwrapper.SelectPaymentRequest(pg.db, pg.orderSqlTable, referenceID)
+	done(err)
+	if err != nil {
+		return payment.UNKNOWN, "", err
+	}
+	done = pg.observeDB(ctx, "SelectRefunded", "ReferenceID", referenceID)
+	_, refunded, err := sqlwrapper.SelectRefunded(pg.db, pg.orderSqlTable, referenceID)
+	done(err)
+	if err != nil {
+		return payment.UNKNOWN, "", err
+	}
+	if refunded > 0 && refunded >= pr.Item.Price {
+		return payment.CLOSED, fmt.Sprintf("ReferenceID %s: payment refunded in full", referenceID), nil
+	}
+	return payment.PAID, "", nil
 }
 
 // IsRefundable() checks if an order is eligible for at least a partial refund.
 func (pg *PrepaidGateway) IsRefundable(referenceID string) bool {
-	// 1. Checkout OrderID & CaptureID
+	ctx, span := pg.startSpan("paypal.IsRefundable", "ReferenceID", referenceID)
+	defer span.End()
+
+	// 1. Checkout merchant account, OrderID & CaptureID
+	ctx, err := pg.referenceAccount(ctx, referenceID)
+	if err != nil {
+		return false // Can't check DB -> fail
+	}
+	done := pg.observeDB(ctx, "SelectOrderID", "ReferenceID", referenceID)
 	orderID, err := sqlwrapper.SelectOrderID(pg.db, pg.orderSqlTable, referenceID)
+	done(err)
 	if err != nil {
 		return false // Can't check DB -> fail
 	}
+	done = pg.observeDB(ctx, "SelectCaptureID", "ReferenceID", referenceID)
 	captureID, err := sqlwrapper.SelectCaptureID(pg.db, pg.orderSqlTable, referenceID)
+	done(err)
 	if err != nil || captureID == "" {
 		return false // Can't check DB -> fail, no captureID -> fail
 	}
 
 	// 2. Check order with PayPal
 	var order *pp.Order
-	order, err = pg.client.GetOrder(context.Background(), orderID)
+	order, err = pg.client(ctx).GetOrder(withLogFields(ctx, "ReferenceID", referenceID), orderID)
+	err = apiError(err)
 	if err != nil { // Failed to communicate with PayPal, fail.
 		return false
 	}
@@ -223,7 +722,9 @@ func (pg *PrepaidGateway) IsRefundable(referenceID string) bool {
 	amountPaid, _ = strconv.ParseFloat(order.PurchaseUnits[0].Amount.Value, 64)
 
 	// 3. Check if the order has even been completely refunded
+	done = pg.observeDB(ctx, "SelectRefunded", "ReferenceID", referenceID)
 	savedCurrency, refunded, err := sqlwrapper.SelectRefunded(pg.db, pg.orderSqlTable, referenceID)
+	done(err)
 	if err != nil {
 		return false // Can't check DB -> fail
 	}
@@ -236,23 +737,43 @@ func (pg *PrepaidGateway) IsRefundable(referenceID string) bool {
 
 // Refund the transaction according to a request built by caller
 func (pg *PrepaidGateway) Refund(rr payment.RefundRequest) error {
+	ctx, span := pg.startSpan("paypal.Refund", "ReferenceID", rr.Item.ReferenceID)
+	defer span.End()
+
+	return pg.refund(ctx, rr)
+}
+
+// refund() is Refund() under ctx.
+func (pg *PrepaidGateway) refund(ctx context.Context, rr payment.RefundRequest) error {
 	if rr.Item.Price <= 0 {
 		return nil // don't refund at all
 	}
 
-	// 1. Checkout OrderID
+	// 1. Checkout merchant account and OrderID, refunds come from the account paid to
+	ctx, err := pg.referenceAccount(ctx, rr.Item.ReferenceID)
+	if err != nil {
+		return err // Can't check DB -> fail
+	}
+	done := pg.observeDB(ctx, "SelectOrderID", "ReferenceID", rr.Item.ReferenceID)
 	orderID, err := sqlwrapper.SelectOrderID(pg.db, pg.orderSqlTable, rr.Item.ReferenceID)
+	done(err)
 	if err != nil {
 		return err // Can't check DB -> fail
 	}
+	done = pg.observeDB(ctx, "SelectCaptureID", "ReferenceID", rr.Item.ReferenceID)
 	captureID, err := sqlwrapper.SelectCaptureID(pg.db, pg.orderSqlTable, rr.Item.ReferenceID)
-	if err != nil || captureID == "" {
-		return ErrNoCaptureID // Can't check DB -> fail, no captureID -> fail
+	done(err)
+	if err != nil {
+		return err // Can't check DB -> fail
+	}
+	if captureID == "" {
+		return ErrNoCaptureID // no captureID -> fail
 	}
 
 	// 2. Check order with PayPal
 	var order *pp.Order
-	order, err = pg.client.GetOrder(context.Background(), orderID)
+	order, err = pg.client(ctx).GetOrder(withLogFields(ctx, "ReferenceID", rr.Item.ReferenceID), orderID)
+	err = apiError(err)
 	if err != nil { // Failed to communicate with PayPal, fail.
 		return err
 	}
@@ -264,7 +785,9 @@ func (pg *PrepaidGateway) Refund(rr payment.RefundRequest) error {
 	amountPaid, _ = strconv.ParseFloat(order.PurchaseUnits[0].Amount.Value, 64)
 
 	// 3. Check if the order has even been completely refunded
+	done = pg.observeDB(ctx, "SelectRefunded", "ReferenceID", rr.Item.ReferenceID)
 	savedCurrency, refunded, err := sqlwrapper.SelectRefunded(pg.db, pg.orderSqlTable, rr.Item.ReferenceID)
+	done(err)
 	if err != nil {
 		return err // Can't check DB -> fail
 	}
@@ -273,33 +796,46 @@ func (pg *PrepaidGateway) Refund(rr payment.RefundRequest) error {
 		rr.Item.Currency = savedCurrency
 	}
 
-	if refunded+rr.Item.Price > amountPaid || savedCurrency != currency || currency != rr.Item.Currency {
-		return ErrRepeatedRefund // fully refunded or inconsistent result
+	switch {
+	case savedCurrency != currency || currency != rr.Item.Currency:
+		return ErrRefundCurrencyMismatch // inconsistent result
+	case refunded >= amountPaid:
+		return ErrRepeatedRefund
+	case refunded+rr.Item.Price > amountPaid:
+		return ErrRefundExceedsPaid
 	}
 
 	// Really refund the transaction
-	refundResp, refundErr := pg.client.RefundCapture(context.Background(), captureID, pp.RefundCaptureRequest{
+	refundResp, refundErr := pg.refundCapture(ctx, captureID, pp.RefundCaptureRequest{
 		Amount: &pp.Money{
 			Currency: rr.Item.Currency,
-			Value:    fmt.Sprintf("%.2f", rr.Item.Price),
+			Value:    formatAmount(rr.Item.Price, rr.Item.Currency),
 		},
 	})
+	pg.metrics.refunded("requested", refundResp.Status, refundErr)
 
 	if refundErr != nil {
 		return refundErr
 	}
 
+	// Keep record of the refund even if it is not completed yet, so it won't be refunded twice
+	done = pg.observeDB(ctx, "InsertRefund", "ReferenceID", rr.Item.ReferenceID, "CaptureID", captureID, "RefundID", refundResp.ID, "refund_status", refundResp.Status)
+	err = sqlwrapper.InsertRefund(pg.db, pg.orderSqlTable, refundResp.record(rr.Item.ReferenceID, captureID))
+	done(err)
+	if err != nil {
+		return fmt.Errorf("paypal: refund %s for Reference ID %s is issued but not saved: %w", refundResp.ID, rr.Item.ReferenceID, err)
+	}
+
 	if refundResp.Status != "COMPLETED" {
-		return fmt.Errorf("paypal: refund status for Reference ID %s is %s, expecting COMPLETED", rr.Item.ReferenceID, refundResp.Status)
+		return fmt.Errorf("%w: refund %s for Reference ID %s is %s", ErrRefundPending, refundResp.ID, rr.Item.ReferenceID, refundResp.Status)
 	}
 	return nil
 }
 
+// OnStatusChange() sets the func notified of payment results, and registers the endpoints of the gateway
+// on the payment callback router of Ulysses. See SetUpdateHandler() and Handler() outside of Ulysses.
 func (pg *PrepaidGateway) OnStatusChange(UpdateHandler *func(referenceID string, newResult payment.PaymentResult)) error {
-	pg.UpdateHandler = UpdateHandler
-
-	// https://ulysses.tunnel.work/api/payment/callback/paypal/$id/onClose
-	api.CPOST(api.PaymentCallback, fmt.Sprintf("paypal/%s/onClose", pg.instanceID), (*gin.HandlerFunc)(&pg.onClose))
-
+	pg.SetUpdateHandler(UpdateHandler)
+	pg.registerUlyssesRoutes()
 	return nil
 }
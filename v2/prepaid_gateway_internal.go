@@ -2,6 +2,8 @@ package paypal
 
 import (
 	"context"
+	"database/sql"
+	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
@@ -10,7 +12,6 @@ import (
 	"github.com/TunnelWork/Ulysses.Lib/payment"
 	"github.com/TunnelWork/payment.PayPal/v2/internal/sqlwrapper"
 	"github.com/gin-gonic/gin"
-	pp "github.com/plutov/paypal/v4"
 )
 
 // For paypal.Buttons onApprove/onCancel/onError events
@@ -23,11 +24,11 @@ func (pg *PrepaidGateway) handlerPaypalExperienceOnClose(c *gin.Context) {
 	Action := c.PostForm("action") // approve/cancel/error
 
 	if ReferenceID == "" || Action == "" {
-		c.JSON(http.StatusBadRequest, BAD_REQUEST)
+		pg.respondCallback(c, "invalid", http.StatusBadRequest, BAD_REQUEST)
 		return
 	}
 	if (OrderID == "" || CaptureID == "") && Action == "approve" {
-		c.JSON(http.StatusBadRequest, BAD_REQUEST)
+		pg.respondCallback(c, Action, http.StatusBadRequest, BAD_REQUEST)
 		return
 	}
 
@@ -43,7 +44,7 @@ func (pg *PrepaidGateway) handlerPaypalExperienceOnClose(c *gin.Context) {
 				},
 			)
 		}
-		c.JSON(http.StatusServiceUnavailable, BUYER_PAYPAL_ERROR)
+		pg.respondCallback(c, Action, http.StatusServiceUnavailable, BUYER_PAYPAL_ERROR)
 	case "approve":
 		pg._onApprove(c, OrderID, ReferenceID, CaptureID)
 	case "cancel":
@@ -57,18 +58,39 @@ func (pg *PrepaidGateway) handlerPaypalExperienceOnClose(c *gin.Context) {
 				},
 			)
 		}
-		c.JSON(http.StatusOK, BUYER_PAYPAL_CANCEL)
+		pg.respondCallback(c, Action, http.StatusOK, BUYER_PAYPAL_CANCEL)
 	default:
-		c.JSON(http.StatusBadRequest, BAD_REQUEST)
+		pg.respondCallback(c, "invalid", http.StatusBadRequest, BAD_REQUEST)
 	}
 
 }
 
 func (pg *PrepaidGateway) _onApprove(c *gin.Context, OrderID, ReferenceID, CaptureID string) {
+	ctx := c.Request.Context()
+	status, resp := pg._verifyApproval(ctx, OrderID, ReferenceID, CaptureID)
+	pg.respondCallback(c, "approve", status, resp)
+}
+
+// respondCallback() responds to a callback, counting it by action and outcome.
+// action must not come from the request unchecked, to keep the label values few.
+func (pg *PrepaidGateway) respondCallback(c *gin.Context, action string, status int, resp gin.H) {
+	pg.metrics.callback(action, resp)
+	c.JSON(status, resp)
+}
+
+// _verifyApproval() checks an approved and captured order against the record, finalizes it in the database
+// and reports to UpdateHandler. Returns the HTTP status and response to be given to the buyer.
+func (pg *PrepaidGateway) _verifyApproval(ctx context.Context, OrderID, ReferenceID, CaptureID string) (int, gin.H) {
 	// Fetch the OrderID's detail from PayPal:
+	ctx = withLogFields(ctx, "ReferenceID", ReferenceID, "CaptureID", CaptureID)
+	ctx, err := pg.referenceAccount(ctx, ReferenceID)
+	if err != nil {
+		return http.StatusInternalServerError, SERVER_BAD_DATABASE
+	}
 
 	// Get latest Access Token
-	_, err := pg.client.GetAccessToken(context.Background())
+	_, err = pg.client(ctx).GetAccessToken(ctx)
+	err = apiError(err)
 	if err != nil { // Failed to communicate with PayPal, fail.
 		if pg.UpdateHandler != nil {
 			(*pg.UpdateHandler)(
@@ -79,14 +101,14 @@ func (pg *PrepaidGateway) _onApprove(c *gin.Context, OrderID, ReferenceID, Captu
 				},
 			)
 		}
-		c.JSON(http.StatusInternalServerError, SERVER_PAYPAL_BAD_AUTH)
-		return
+		return paypalFailure(err, http.StatusInternalServerError, SERVER_PAYPAL_BAD_AUTH)
 	}
 
 	// Checkout the order from PayPal
-	var order *pp.Order
-	order, err = pg.client.GetOrder(context.Background(), OrderID)
+	fetched, err := pg.getCardOrder(ctx, OrderID)
+	order := &fetched.Order
 	if err != nil { // Failed to communicate with PayPal, fail.
+		pg.metrics.verificationFailed("get_order")
 		if pg.UpdateHandler != nil {
 			(*pg.UpdateHandler)(
 				ReferenceID,
@@ -96,11 +118,14 @@ func (pg *PrepaidGateway) _onApprove(c *gin.Context, OrderID, ReferenceID, Captu
 				},
 			)
 		}
-		c.JSON(http.StatusInternalServerError, SERVER_PAYPAL_BAD_ORDER)
-		return
+		if errors.Is(err, ErrPayPalResourceNotFound) { // Made up OrderID
+			return http.StatusBadRequest, SERVER_PAYPAL_BAD_ORDER
+		}
+		return paypalFailure(err, http.StatusInternalServerError, SERVER_PAYPAL_BAD_ORDER)
 	}
 	// No bundle order allowed.
 	if len(order.PurchaseUnits) != 1 {
+		pg.metrics.verificationFailed("bundled_order")
 		if pg.UpdateHandler != nil {
 			(*pg.UpdateHandler)(
 				ReferenceID,
@@ -110,11 +135,26 @@ func (pg *PrepaidGateway) _onApprove(c *gin.Context, OrderID, ReferenceID, Captu
 				},
 			)
 		}
-		c.JSON(http.StatusBadRequest, SERVER_PAYPAL_BAD_ORDER)
-		return
+		return http.StatusBadRequest, SERVER_PAYPAL_BAD_ORDER
+	}
+	// The capture reported must be one of the order
+	capture := orderCapture(order, CaptureID)
+	if capture == nil {
+		pg.metrics.verificationFailed("capture_not_in_order")
+		if pg.UpdateHandler != nil {
+			(*pg.UpdateHandler)(
+				ReferenceID,
+				payment.PaymentResult{
+					Status: payment.UNKNOWN,
+					Msg:    fmt.Sprintf("(Unverified)ReferenceID %s: capture %s is not part of pp.Order %s", ReferenceID, CaptureID, OrderID),
+				},
+			)
+		}
+		return http.StatusBadRequest, SERVER_PAYPAL_BAD_ORDER
 	}
 	// Order's ReferenceID must match reported ReferenceID
 	if ReferenceID != order.PurchaseUnits[0].ReferenceID {
+		pg.metrics.verificationFailed("reference_mismatch")
 		if pg.UpdateHandler != nil {
 			(*pg.UpdateHandler)(
 				ReferenceID,
@@ -124,12 +164,19 @@ func (pg *PrepaidGateway) _onApprove(c *gin.Context, OrderID, ReferenceID, Captu
 				},
 			)
 		}
-		c.JSON(http.StatusBadRequest, SERVER_PAYPAL_BAD_ORDER)
-		return
+		return http.StatusBadRequest, SERVER_PAYPAL_BAD_ORDER
 	}
 
 	// Checkout the Reference from Database
+	done := pg.observeDB(ctx, "SelectPaymentRequest", "ReferenceID", ReferenceID)
 	requestOnRecord, err := sqlwrapper.SelectPaymentRequest(pg.db, pg.orderSqlTable, ReferenceID)
+	done(err)
+	if err == sql.ErrNoRows {
+		pg.metrics.verificationFailed("unknown_reference")
+		if status, resp, ok := pg.autoRefund(ctx, AutoRefundUnknownReference, "no record of the ReferenceID", ReferenceID, order, capture); ok {
+			return status, resp
+		}
+	}
 	if err != nil {
 		// fmt.Printf("PTR: %v\n", pg.UpdateHandler)
 		time.Sleep(1 * time.Second)
@@ -142,13 +189,13 @@ func (pg *PrepaidGateway) _onApprove(c *gin.Context, OrderID, ReferenceID, Captu
 				},
 			)
 		}
-		c.JSON(http.StatusInternalServerError, SERVER_BAD_DATABASE)
-		return
+		return http.StatusInternalServerError, SERVER_BAD_DATABASE
 	}
 
 	// Match paid currency and value
 	paypalPricing, err := strconv.ParseFloat(order.PurchaseUnits[0].Amount.Value, 64)
 	if err != nil {
+		pg.metrics.verificationFailed("bad_amount")
 		if pg.UpdateHandler != nil {
 			(*pg.UpdateHandler)(
 				ReferenceID,
@@ -158,10 +205,15 @@ func (pg *PrepaidGateway) _onApprove(c *gin.Context, OrderID, ReferenceID, Captu
 				},
 			)
 		}
-		c.JSON(http.StatusInternalServerError, SERVER_PAYPAL_BAD_ORDER)
-		return
+		return http.StatusInternalServerError, SERVER_PAYPAL_BAD_ORDER
 	}
 	if requestOnRecord.Item.Currency != order.PurchaseUnits[0].Amount.Currency || requestOnRecord.Item.Price != paypalPricing {
+		pg.metrics.verificationFailed("amount_mismatch")
+		detail := fmt.Sprintf("paid %s %s, expecting %s %s", order.PurchaseUnits[0].Amount.Value, order.PurchaseUnits[0].Amount.Currency,
+			formatAmount(requestOnRecord.Item.Price, requestOnRecord.Item.Currency), requestOnRecord.Item.Currency)
+		if status, resp, ok := pg.autoRefund(ctx, AutoRefundAmountMismatch, detail, ReferenceID, order, capture); ok {
+			return status, resp
+		}
 		if pg.UpdateHandler != nil {
 			(*pg.UpdateHandler)(
 				ReferenceID,
@@ -171,8 +223,7 @@ func (pg *PrepaidGateway) _onApprove(c *gin.Context, OrderID, ReferenceID, Captu
 				},
 			)
 		}
-		c.JSON(http.StatusBadRequest, SERVER_PAYPAL_BAD_ORDER)
-		return
+		return http.StatusBadRequest, SERVER_PAYPAL_BAD_ORDER
 	}
 
 	// Only these 2 status means paid
@@ -187,12 +238,63 @@ func (pg *PrepaidGateway) _onApprove(c *gin.Context, OrderID, ReferenceID, Captu
 				},
 			)
 		}
-		c.JSON(http.StatusConflict, PAYMENT_NOT_APPROVED)
-		return
+		return http.StatusConflict, PAYMENT_NOT_APPROVED
+	}
+
+	// Card payments captured without handlerCardCapture, e.g. by the JS SDK, are held to the ThreeDSPolicy too
+	if result, ok := fetched.card(); ok && ctx.Value(savedChargeKey{}) == nil && !pg.threeDSPolicy.allows(result) {
+		return pg.rejectCardPayment(ctx, ReferenceID, order, capture, result)
+	}
+
+	// A ReferenceID is paid once. The same capture verified again (e.g. a reloaded return page) is not news.
+	done = pg.observeDB(ctx, "SelectCaptureID", "ReferenceID", ReferenceID)
+	paidCaptureID, err := sqlwrapper.SelectCaptureID(pg.db, pg.orderSqlTable, ReferenceID)
+	done(err)
+	if err != nil {
+		if pg.UpdateHandler != nil {
+			(*pg.UpdateHandler)(
+				ReferenceID,
+				payment.PaymentResult{
+					Status: payment.UNKNOWN,
+					Msg:    fmt.Sprintf("(Verified)ReferenceID %s: Can't check database reference, error: %s", ReferenceID, err),
+				},
+			)
+		}
+		return http.StatusInternalServerError, SERVER_BAD_DATABASE
+	}
+	if paidCaptureID == CaptureID {
+		return http.StatusConflict, PAYMENT_ALREADY_PAID
+	}
+	if paidCaptureID != "" {
+		return pg.handleDuplicate(ctx, ReferenceID, OrderID, paidCaptureID, capture)
 	}
 
 	// All verification good. Update the database
+	done = pg.observeDB(ctx, "AppendOrderInfo", "ReferenceID", ReferenceID, "OrderID", OrderID, "CaptureID", CaptureID)
 	err = sqlwrapper.AppendOrderInfo(pg.db, pg.orderSqlTable, order, CaptureID)
+	done(err)
+	if err == sqlwrapper.ErrAlreadyPaid {
+		// Another capture of the ReferenceID was finalized since it was checked above
+		done = pg.observeDB(ctx, "SelectCaptureID", "ReferenceID", ReferenceID)
+		paidCaptureID, err = sqlwrapper.SelectCaptureID(pg.db, pg.orderSqlTable, ReferenceID)
+		done(err)
+		if err != nil {
+			if pg.UpdateHandler != nil {
+				(*pg.UpdateHandler)(
+					ReferenceID,
+					payment.PaymentResult{
+						Status: payment.UNKNOWN,
+						Msg:    fmt.Sprintf("(Verified)ReferenceID %s: paid concurrently, can't check by which capture, error: %s", ReferenceID, err),
+					},
+				)
+			}
+			return http.StatusInternalServerError, SERVER_BAD_DATABASE
+		}
+		if paidCaptureID == CaptureID {
+			return http.StatusConflict, PAYMENT_ALREADY_PAID
+		}
+		return pg.handleDuplicate(ctx, ReferenceID, OrderID, paidCaptureID, capture)
+	}
 	if err != nil {
 		if pg.UpdateHandler != nil {
 			(*pg.UpdateHandler)(
@@ -208,8 +310,50 @@ func (pg *PrepaidGateway) _onApprove(c *gin.Context, OrderID, ReferenceID, Captu
 				},
 			)
 		}
-		c.JSON(http.StatusInternalServerError, SERVER_BAD_DATABASE)
-		return
+		return http.StatusInternalServerError, SERVER_BAD_DATABASE
+	}
+
+	// Fee and net amount are nice to have, don't fail a confirmed payment for them
+	var breakdownMsg string
+	breakdown, err := pg.captureBreakdown(ctx, order, CaptureID)
+	if err == nil {
+		done := pg.observeDB(ctx, "UpdateCaptureBreakdown", "ReferenceID", ReferenceID)
+		err = sqlwrapper.UpdateCaptureBreakdown(pg.db, pg.orderSqlTable, ReferenceID, breakdown)
+		done(err)
+	}
+	if err != nil {
+		breakdownMsg = fmt.Sprintf(" Fee breakdown unavailable: %s", err)
+	} else {
+		currency := requestOnRecord.Item.Currency
+		breakdownMsg = fmt.Sprintf(" Gross %s, fee %s, net %s %s.",
+			formatAmount(breakdown.Gross, currency), formatAmount(breakdown.Fee, currency), formatAmount(breakdown.Net, currency), currency)
+	}
+
+	// Same for saving the payment method in PayPal Vault, see VaultCheckout()
+	var vaultMsg string
+	done = pg.observeDB(ctx, "SelectVaultCustomerID", "ReferenceID", ReferenceID)
+	customerID, err := sqlwrapper.SelectVaultCustomerID(pg.db, pg.orderSqlTable, ReferenceID)
+	done(err)
+	if err == nil && customerID != "" {
+		token, err := pg.saveVaultToken(ctx, customerID, OrderID)
+		if err != nil {
+			vaultMsg = fmt.Sprintf(" Payment method not saved: %s", err)
+		} else {
+			vaultMsg = fmt.Sprintf(" Payment method %s saved for customer %s.", token.PaymentTokenID, customerID)
+		}
+	}
+
+	// Last, the risk rules may hold or refund an otherwise good payment
+	decision, status, resp := pg.assessRisk(ctx, RiskPayment{
+		ReferenceID: ReferenceID,
+		OrderID:     OrderID,
+		CaptureID:   CaptureID,
+		Currency:    requestOnRecord.Item.Currency,
+		Amount:      requestOnRecord.Item.Price,
+		Payer:       sqlwrapper.PayerOf(order),
+	})
+	if decision != RiskAccept {
+		return status, resp
 	}
 
 	// All good!
@@ -223,9 +367,9 @@ func (pg *PrepaidGateway) _onApprove(c *gin.Context, OrderID, ReferenceID, Captu
 					Currency:    requestOnRecord.Item.Currency,
 					Price:       requestOnRecord.Item.Price,
 				},
-				Msg: fmt.Sprintf("(Verified)ReferenceID %s: Payment confirmed.", ReferenceID),
+				Msg: fmt.Sprintf("(Verified)ReferenceID %s: Payment confirmed.%s%s", ReferenceID, breakdownMsg, vaultMsg),
 			},
 		)
 	}
-	c.JSON(http.StatusOK, PAYMENT_OK)
+	return http.StatusOK, PAYMENT_OK
 }
@@ -9,6 +9,9 @@ type PrepaidConfig struct {
 	ClientID string `json:"client_id"`
 	SecretID string `json:"secret_id"`
 	ApiBase  string `json:"api_base"` // https://api-m.sandbox.paypal.com
+
+	Accounts       map[string]MerchantAccount `json:"accounts,omitempty"`
+	AccountRouting *AccountRouting            `json:"account_routing,omitempty"`
 }
 
 var DefaultPrepaidConfig = PrepaidConfig{
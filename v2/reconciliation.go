@@ -0,0 +1,491 @@
+package paypal
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/TunnelWork/payment.PayPal/v2/internal/sqlwrapper"
+	pp "github.com/plutov/paypal/v4"
+)
+
+var (
+	ErrBadSettlementReport error = errors.New("paypal: settlement report has no column header (CH) row")
+)
+
+// SettlementTransaction is a single PayPal transaction, either returned by
+// the Transaction Search API or read from a downloaded STL/TRR report.
+type SettlementTransaction struct {
+	TransactionID string // For a payment this is the CaptureID
+	ReferenceID   string // PayPal Reference ID, e.g. the original CaptureID of a refund
+	InvoiceID     string
+	CustomField   string
+	EventCode     string // T0006, T1107...
+	Status        string
+	Date          time.Time
+	Currency      string
+	Gross         float64 // Negative for debits, e.g. refunds
+	Fee           float64 // Positive when charged by PayPal, negative when given back
+	FeeCurrency   string  // Empty if the same as Currency
+	Account       string  // Merchant account searched, empty for the default one or a report
+}
+
+// IsPayment() tells if the transaction is a payment received (T00xx) and not a refund or else.
+func (st SettlementTransaction) IsPayment() bool {
+	return strings.HasPrefix(st.EventCode, "T00") && st.Gross > 0
+}
+
+// IsRefund() tells if the transaction is a refund (T11xx) sent to the buyer.
+func (st SettlementTransaction) IsRefund() bool {
+	return strings.HasPrefix(st.EventCode, "T11")
+}
+
+type DiscrepancyKind uint8
+
+const (
+	// The transaction is seen at PayPal but not in the orders table
+	MISSING_LOCALLY DiscrepancyKind = iota
+	// The order is closed with a CaptureID in the orders table but PayPal has no such transaction
+	MISSING_AT_PAYPAL
+	// Paid or refunded amount differs
+	AMOUNT_MISMATCH
+	// Paid currency differs
+	CURRENCY_MISMATCH
+)
+
+func (dk DiscrepancyKind) String() string {
+	switch dk {
+	case MISSING_LOCALLY:
+		return "MISSING_LOCALLY"
+	case MISSING_AT_PAYPAL:
+		return "MISSING_AT_PAYPAL"
+	case AMOUNT_MISMATCH:
+		return "AMOUNT_MISMATCH"
+	case CURRENCY_MISMATCH:
+		return "CURRENCY_MISMATCH"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+type Discrepancy struct {
+	Kind          DiscrepancyKind
+	ReferenceID   string
+	TransactionID string
+	Detail        string
+}
+
+type ReconciliationReport struct {
+	Start, End    time.Time
+	Matched       int
+	Discrepancies []Discrepancy
+
+	// Keyed by currency, the fee's own for FeeTotals
+	GrossTotals  map[string]float64
+	FeeTotals    map[string]float64
+	RefundTotals map[string]float64
+}
+
+// SearchTransactions() pulls all transactions in [start, end) from the Transaction Search API.
+// PayPal only allows a 31-day window per query, longer ranges are split.
+// Every merchant account is searched.
+// Note: it may take up to 3 hours for a transaction to show up in Transaction Search.
+func (pg *PrepaidGateway) SearchTransactions(start, end time.Time) ([]SettlementTransaction, error) {
+	ctx, span := pg.startSpan("paypal.SearchTransactions")
+	defer span.End()
+
+	var txns []SettlementTransaction
+	for _, name := range pg.accountNames() {
+		accountTxns, err := pg.searchAccountTransactions(withAccount(ctx, pg.accounts[name]), start, end)
+		for i := range accountTxns {
+			accountTxns[i].Account = name
+		}
+		txns = append(txns, accountTxns...)
+		if err != nil {
+			return txns, err
+		}
+	}
+	return txns, nil
+}
+
+// searchAccountTransactions() pulls the transactions of the merchant account of ctx.
+func (pg *PrepaidGateway) searchAccountTransactions(ctx context.Context, start, end time.Time) ([]SettlementTransaction, error) {
+	var txns []SettlementTransaction
+	pageSize := 500
+
+	for windowStart := start; windowStart.Before(end); windowStart = windowStart.AddDate(0, 0, 31) {
+		windowEnd := windowStart.AddDate(0, 0, 31)
+		if windowEnd.After(end) {
+			windowEnd = end
+		}
+
+		for page := 1; ; page++ {
+			currentPage := page
+			resp, err := pg.client(ctx).ListTransactions(ctx, &pp.TransactionSearchRequest{
+				StartDate: windowStart,
+				EndDate:   windowEnd,
+				PageSize:  &pageSize,
+				Page:      &currentPage,
+			})
+			if err != nil {
+				return txns, apiError(err)
+			}
+
+			for _, detail := range resp.TransactionDetails {
+				txns = append(txns, searchTransaction(detail.TransactionInfo))
+			}
+			if page >= resp.TotalPages {
+				break
+			}
+		}
+	}
+
+	return txns, nil
+}
+
+func searchTransaction(info pp.SearchTransactionInfo) SettlementTransaction {
+	gross, _ := strconv.ParseFloat(info.TransactionAmount.Value, 64)
+	var fee float64
+	var feeCurrency string
+	if info.FeeAmount != nil {
+		fee, _ = strconv.ParseFloat(info.FeeAmount.Value, 64)
+		fee = -fee // Transaction Search reports a charged fee as negative
+		feeCurrency = info.FeeAmount.Currency
+	}
+
+	return SettlementTransaction{
+		TransactionID: info.TransactionID,
+		ReferenceID:   info.PayPalReferenceID,
+		InvoiceID:     info.InvoiceID,
+		CustomField:   info.CustomField,
+		EventCode:     info.TransactionEventCode,
+		Status:        info.TransactionStatus,
+		Date:          time.Time(info.TransactionInitiationDate),
+		Currency:      info.TransactionAmount.Currency,
+		Gross:         gross,
+		Fee:           fee,
+		FeeCurrency:   feeCurrency,
+	}
+}
+
+// ParseSettlementReport() reads a Settlement (STL) or Transaction Detail (TRR) report
+// downloaded from PayPal's SFTP or Reports page, in CSV format.
+// Only the section body (SB) rows are returned. Columns are located by the column header (CH) row,
+// so both report types and their different versions are understood.
+func ParseSettlementReport(r io.Reader) ([]SettlementTransaction, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+
+	var columns map[string]int
+	var txns []SettlementTransaction
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return txns, err
+		}
+		if len(row) == 0 {
+			continue
+		}
+
+		switch strings.TrimPrefix(row[0], "\ufeff") {
+		case "CH":
+			columns = map[string]int{}
+			for i, name := range row {
+				columns[normalizeColumnName(name)] = i
+			}
+		case "SB":
+			if columns == nil {
+				return txns, ErrBadSettlementReport
+			}
+			txn, err := settlementRow(row, columns)
+			if err != nil {
+				return txns, err
+			}
+			txns = append(txns, txn)
+		}
+	}
+
+	if columns == nil {
+		return nil, ErrBadSettlementReport
+	}
+	return txns, nil
+}
+
+func normalizeColumnName(name string) string {
+	return strings.ToLower(strings.Join(strings.Fields(name), " "))
+}
+
+func settlementRow(row []string, columns map[string]int) (SettlementTransaction, error) {
+	field := func(name string) string {
+		if i, ok := columns[name]; ok && i < len(row) {
+			return strings.TrimSpace(row[i])
+		}
+		return ""
+	}
+
+	txn := SettlementTransaction{
+		TransactionID: field("transaction id"),
+		ReferenceID:   field("paypal reference id"),
+		InvoiceID:     field("invoice id"),
+		CustomField:   field("custom field"),
+		EventCode:     field("transaction event code"),
+		Status:        field("transaction status"),
+		Currency:      field("gross transaction currency"),
+	}
+
+	if date := field("transaction initiation date"); date != "" {
+		txn.Date, _ = time.Parse("2006/01/02 15:04:05 -0700", date)
+	}
+
+	// Amounts are in the currency's minor unit, e.g. cents
+	gross, err := minorUnitAmount(field("gross transaction amount"), txn.Currency)
+	if err != nil {
+		return txn, fmt.Errorf("paypal: bad gross amount of transaction %s: %w", txn.TransactionID, err)
+	}
+	if field("transaction debit or credit") == "DR" {
+		gross = -gross
+	}
+	txn.Gross = gross
+
+	feeCurrency := field("fee currency")
+	if feeCurrency == "" {
+		feeCurrency = txn.Currency
+	}
+	fee, err := minorUnitAmount(field("fee amount"), feeCurrency)
+	if err != nil {
+		return txn, fmt.Errorf("paypal: bad fee amount of transaction %s: %w", txn.TransactionID, err)
+	}
+	if field("fee debit or credit") == "CR" {
+		fee = -fee
+	}
+	txn.Fee = fee
+	if feeCurrency != txn.Currency {
+		txn.FeeCurrency = feeCurrency
+	}
+
+	return txn, nil
+}
+
+func minorUnitAmount(value, currency string) (float64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	minor, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return float64(minor) / math.Pow10(currencyDecimals(currency)), nil
+}
+
+// Reconcile() matches transactions (see SearchTransactions() and ParseSettlementReport())
+// against orders paid in [start, end), or by a payment among txns, and reports every discrepancy found.
+// Payments are matched by CaptureID, then by Invoice ID or Custom Field holding the ReferenceID.
+// Captures refunded automatically and duplicate payments have no order of their own, and are matched to
+// their record. Refunds are matched to their payment by PayPal Reference ID and compared to the refunded
+// amount on record.
+func (pg *PrepaidGateway) Reconcile(start, end time.Time, txns []SettlementTransaction) (ReconciliationReport, error) {
+	ctx, span := pg.startSpan("paypal.Reconcile")
+	defer span.End()
+
+	done := pg.observeDB(ctx, "ListClosedOrders")
+	records, err := sqlwrapper.ListClosedOrders(pg.db, pg.orderSqlTable, start, end)
+	done(err)
+	if err != nil {
+		return ReconciliationReport{}, err
+	}
+
+	// PayPal dates a payment by its own clock, which may put it on the other side of the window
+	var captureIDs []string
+	for _, txn := range txns {
+		if txn.IsPayment() {
+			captureIDs = append(captureIDs, txn.TransactionID)
+		}
+	}
+	done = pg.observeDB(ctx, "SelectOrdersByCaptureIDs")
+	paid, err := sqlwrapper.SelectOrdersByCaptureIDs(pg.db, pg.orderSqlTable, captureIDs)
+	done(err)
+	if err != nil {
+		return ReconciliationReport{}, err
+	}
+	records = append(records, paid...)
+
+	others := map[string]otherCapture{}
+	done = pg.observeDB(ctx, "SelectAutoRefundsByCaptures")
+	autoRefunds, err := sqlwrapper.SelectAutoRefundsByCaptures(pg.db, pg.orderSqlTable, captureIDs)
+	done(err)
+	if err != nil {
+		return ReconciliationReport{}, err
+	}
+	for _, autoRefund := range autoRefunds {
+		others[autoRefund.CaptureID] = otherCapture{autoRefund.ReferenceID, autoRefund.Currency, autoRefund.Amount}
+	}
+	done = pg.observeDB(ctx, "SelectDuplicatesByCaptures")
+	duplicates, err := sqlwrapper.SelectDuplicatesByCaptures(pg.db, pg.orderSqlTable, captureIDs)
+	done(err)
+	if err != nil {
+		return ReconciliationReport{}, err
+	}
+	for _, duplicate := range duplicates {
+		others[duplicate.CaptureID] = otherCapture{duplicate.ReferenceID, duplicate.Currency, duplicate.Amount}
+	}
+
+	report := reconcile(records, others, txns)
+	report.Start = start
+	report.End = end
+	return report, nil
+}
+
+// otherCapture is a capture recorded without an order of its own: refunded automatically, or a duplicate payment.
+type otherCapture struct {
+	ReferenceID string
+	Currency    string
+	Amount      float64
+}
+
+func reconcile(records []sqlwrapper.OrderRecord, others map[string]otherCapture, txns []SettlementTransaction) ReconciliationReport {
+	report := ReconciliationReport{
+		GrossTotals:  map[string]float64{},
+		FeeTotals:    map[string]float64{},
+		RefundTotals: map[string]float64{},
+	}
+
+	byCaptureID := map[string]*sqlwrapper.OrderRecord{}
+	byReferenceID := map[string]*sqlwrapper.OrderRecord{}
+	for i := range records {
+		if records[i].CaptureID == "" {
+			continue // not paid, nothing to settle
+		}
+		byCaptureID[records[i].CaptureID] = &records[i]
+		byReferenceID[records[i].ReferenceID] = &records[i]
+	}
+
+	seen := map[string]bool{}
+	refunded := map[string]float64{}
+	for _, txn := range txns {
+		feeCurrency := txn.FeeCurrency
+		if feeCurrency == "" {
+			feeCurrency = txn.Currency
+		}
+		report.FeeTotals[feeCurrency] += txn.Fee
+
+		if txn.IsRefund() {
+			report.RefundTotals[txn.Currency] += -txn.Gross
+			if _, ok := byCaptureID[txn.ReferenceID]; ok {
+				refunded[txn.ReferenceID] += -txn.Gross
+			}
+			continue
+		}
+		if !txn.IsPayment() {
+			continue
+		}
+		report.GrossTotals[txn.Currency] += txn.Gross
+
+		record, ok := byCaptureID[txn.TransactionID]
+		if !ok {
+			record, ok = byReferenceID[txn.InvoiceID]
+		}
+		if !ok {
+			record, ok = byReferenceID[txn.CustomField]
+		}
+		if !ok {
+			if other, ok := others[txn.TransactionID]; ok {
+				if discrepancy, ok := otherDiscrepancy(other, txn); ok {
+					report.Discrepancies = append(report.Discrepancies, discrepancy)
+				} else {
+					report.Matched++
+				}
+				continue
+			}
+			report.Discrepancies = append(report.Discrepancies, Discrepancy{
+				Kind:          MISSING_LOCALLY,
+				TransactionID: txn.TransactionID,
+				Detail:        fmt.Sprintf("%s %.2f %s on %s", txn.EventCode, txn.Gross, txn.Currency, txn.Date.Format(time.RFC3339)),
+			})
+			continue
+		}
+		seen[record.CaptureID] = true
+
+		matched := true
+		if record.Currency != txn.Currency {
+			matched = false
+			report.Discrepancies = append(report.Discrepancies, Discrepancy{
+				Kind:          CURRENCY_MISMATCH,
+				ReferenceID:   record.ReferenceID,
+				TransactionID: txn.TransactionID,
+				Detail:        fmt.Sprintf("%s on record, %s at PayPal", record.Currency, txn.Currency),
+			})
+		} else if !sameAmount(record.Total, txn.Gross, txn.Currency) {
+			matched = false
+			report.Discrepancies = append(report.Discrepancies, Discrepancy{
+				Kind:          AMOUNT_MISMATCH,
+				ReferenceID:   record.ReferenceID,
+				TransactionID: txn.TransactionID,
+				Detail:        fmt.Sprintf("paid %.2f on record, %.2f at PayPal", record.Total, txn.Gross),
+			})
+		}
+		if matched {
+			report.Matched++
+		}
+	}
+
+	for _, record := range byCaptureID {
+		if !seen[record.CaptureID] {
+			report.Discrepancies = append(report.Discrepancies, Discrepancy{
+				Kind:          MISSING_AT_PAYPAL,
+				ReferenceID:   record.ReferenceID,
+				TransactionID: record.CaptureID,
+				Detail:        fmt.Sprintf("paid %.2f %s on record", record.Total, record.Currency),
+			})
+			continue
+		}
+		if !sameAmount(record.Refunded, refunded[record.CaptureID], record.Currency) {
+			report.Discrepancies = append(report.Discrepancies, Discrepancy{
+				Kind:          AMOUNT_MISMATCH,
+				ReferenceID:   record.ReferenceID,
+				TransactionID: record.CaptureID,
+				Detail:        fmt.Sprintf("refunded %.2f on record, %.2f at PayPal", record.Refunded, refunded[record.CaptureID]),
+			})
+		}
+	}
+
+	sort.SliceStable(report.Discrepancies, func(i, j int) bool {
+		return report.Discrepancies[i].Kind < report.Discrepancies[j].Kind
+	})
+	return report
+}
+
+// otherDiscrepancy() compares a payment with the capture recorded without an order.
+func otherDiscrepancy(other otherCapture, txn SettlementTransaction) (Discrepancy, bool) {
+	switch {
+	case other.Currency != txn.Currency:
+		return Discrepancy{
+			Kind:          CURRENCY_MISMATCH,
+			ReferenceID:   other.ReferenceID,
+			TransactionID: txn.TransactionID,
+			Detail:        fmt.Sprintf("%s on record, %s at PayPal", other.Currency, txn.Currency),
+		}, true
+	case !sameAmount(other.Amount, txn.Gross, txn.Currency):
+		return Discrepancy{
+			Kind:          AMOUNT_MISMATCH,
+			ReferenceID:   other.ReferenceID,
+			TransactionID: txn.TransactionID,
+			Detail:        fmt.Sprintf("captured %.2f on record, %.2f at PayPal", other.Amount, txn.Gross),
+		}, true
+	}
+	return Discrepancy{}, false
+}
+
+func sameAmount(a, b float64, currency string) bool {
+	return math.Abs(a-b) < math.Pow10(-currencyDecimals(currency))/2
+}
@@ -0,0 +1,235 @@
+package paypal
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TunnelWork/payment.PayPal/v2/internal/sqlwrapper"
+)
+
+// Starts with a byte order mark, as saved by some spreadsheets
+const testSettlementReport = "\ufeff" + `"RH","2021/10/01 02:00:00 -0700","R","MERCHANTID",011
+"FH",01
+"SH","2021/09/30 00:00:00 -0700","2021/09/30 23:59:59 -0700","MERCHANTID",""
+"CH","Transaction ID","Invoice ID","PayPal Reference ID","PayPal Reference ID Type","Transaction Event Code","Transaction Initiation Date","Transaction Completion Date","Transaction  Debit or Credit","Gross Transaction Amount","Gross Transaction Currency","Fee Debit or Credit","Fee Amount","Fee Currency","Transaction Status","Custom Field"
+"SB","1AB23456CD789012E","REF-1","","","T0006","2021/09/30 10:00:00 -0700","2021/09/30 10:00:01 -0700","CR","1005","USD","DR","59","USD","S","REF-1"
+"SB","2AB23456CD789012E","","1AB23456CD789012E","TXN","T1107","2021/09/30 11:00:00 -0700","2021/09/30 11:00:01 -0700","DR","500","USD","CR","15","USD","S",""
+"SB","3AB23456CD789012E","REF-2","","","T0006","2021/09/30 12:00:00 -0700","2021/09/30 12:00:01 -0700","CR","1200","JPY","DR","85","USD","S",""
+"SF","USD",1
+"SC",3
+"RF",3
+`
+
+func TestParseSettlementReport(t *testing.T) {
+	txns, err := ParseSettlementReport(strings.NewReader(testSettlementReport))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []SettlementTransaction{
+		{TransactionID: "1AB23456CD789012E", InvoiceID: "REF-1", CustomField: "REF-1", EventCode: "T0006", Status: "S",
+			Date: time.Date(2021, 9, 30, 17, 0, 0, 0, time.UTC), Currency: "USD", Gross: 10.05, Fee: 0.59},
+		{TransactionID: "2AB23456CD789012E", ReferenceID: "1AB23456CD789012E", EventCode: "T1107", Status: "S",
+			Date: time.Date(2021, 9, 30, 18, 0, 0, 0, time.UTC), Currency: "USD", Gross: -5, Fee: -0.15},
+		{TransactionID: "3AB23456CD789012E", InvoiceID: "REF-2", EventCode: "T0006", Status: "S",
+			Date: time.Date(2021, 9, 30, 19, 0, 0, 0, time.UTC), Currency: "JPY", Gross: 1200, Fee: 0.85, FeeCurrency: "USD"},
+	}
+	if len(txns) != len(want) {
+		t.Fatalf("ParseSettlementReport() = %d transactions, want %d", len(txns), len(want))
+	}
+	for i := range want {
+		got := txns[i]
+		if !got.Date.Equal(want[i].Date) {
+			t.Errorf("transaction %d: Date = %s, want %s", i, got.Date, want[i].Date)
+		}
+		got.Date = want[i].Date
+		if got != want[i] {
+			t.Errorf("transaction %d = %+v, want %+v", i, got, want[i])
+		}
+	}
+	if !txns[0].IsPayment() || txns[0].IsRefund() || txns[1].IsPayment() || !txns[1].IsRefund() {
+		t.Error("payment and refund not told apart by event code")
+	}
+}
+
+func TestParseSettlementReportErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		report  string
+		wantErr error
+	}{
+		{"empty", "", ErrBadSettlementReport},
+		{"no column header", `"RH","2021/10/01 02:00:00 -0700"` + "\n" + `"RF",0` + "\n", ErrBadSettlementReport},
+		{"body before column header", `"SB","1AB23456CD789012E"` + "\n" + `"CH","Transaction ID"` + "\n", ErrBadSettlementReport},
+	}
+	for _, tt := range tests {
+		if _, err := ParseSettlementReport(strings.NewReader(tt.report)); !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s: ParseSettlementReport() error = %v, want %v", tt.name, err, tt.wantErr)
+		}
+	}
+
+	report := `"CH","Transaction ID","Gross Transaction Amount","Gross Transaction Currency"` + "\n" + `"SB","1AB23456CD789012E","10.05","USD"` + "\n"
+	if _, err := ParseSettlementReport(strings.NewReader(report)); err == nil {
+		t.Error("ParseSettlementReport() of an amount not in minor units succeeded")
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	payment := func(captureID, invoiceID, currency string, gross, fee float64) SettlementTransaction {
+		return SettlementTransaction{TransactionID: captureID, InvoiceID: invoiceID, EventCode: "T0006", Currency: currency, Gross: gross, Fee: fee}
+	}
+	refund := func(id, captureID, currency string, amount float64) SettlementTransaction {
+		return SettlementTransaction{TransactionID: id, ReferenceID: captureID, EventCode: "T1107", Currency: currency, Gross: -amount}
+	}
+	order := func(referenceID, captureID, currency string, total, refunded float64) sqlwrapper.OrderRecord {
+		return sqlwrapper.OrderRecord{ReferenceID: referenceID, CaptureID: captureID, Currency: currency, Total: total, Refunded: refunded}
+	}
+
+	tests := []struct {
+		name        string
+		records     []sqlwrapper.OrderRecord
+		others      map[string]otherCapture
+		txns        []SettlementTransaction
+		wantMatched int
+		wantKinds   []DiscrepancyKind
+	}{
+		{
+			name:        "matched by capture ID",
+			records:     []sqlwrapper.OrderRecord{order("REF-1", "CAP-1", "USD", 10.05, 0)},
+			txns:        []SettlementTransaction{payment("CAP-1", "", "USD", 10.05, 0.59)},
+			wantMatched: 1,
+		},
+		{
+			name:        "matched by invoice ID",
+			records:     []sqlwrapper.OrderRecord{order("REF-1", "CAP-1", "USD", 10, 0)},
+			txns:        []SettlementTransaction{payment("CAP-9", "REF-1", "USD", 10, 0)},
+			wantMatched: 1,
+		},
+		{
+			name:        "matched by custom field",
+			records:     []sqlwrapper.OrderRecord{order("REF-1", "CAP-1", "JPY", 1200, 0)},
+			txns:        []SettlementTransaction{{TransactionID: "CAP-9", CustomField: "REF-1", EventCode: "T0006", Currency: "JPY", Gross: 1200}},
+			wantMatched: 1,
+		},
+		{
+			name:        "same order listed twice",
+			records:     []sqlwrapper.OrderRecord{order("REF-1", "CAP-1", "USD", 10, 0), order("REF-1", "CAP-1", "USD", 10, 0)},
+			txns:        []SettlementTransaction{payment("CAP-1", "", "USD", 10, 0)},
+			wantMatched: 1,
+		},
+		{
+			name:      "missing locally",
+			txns:      []SettlementTransaction{payment("CAP-1", "", "USD", 10, 0)},
+			wantKinds: []DiscrepancyKind{MISSING_LOCALLY},
+		},
+		{
+			name:      "missing at PayPal",
+			records:   []sqlwrapper.OrderRecord{order("REF-1", "CAP-1", "USD", 10, 0)},
+			wantKinds: []DiscrepancyKind{MISSING_AT_PAYPAL},
+		},
+		{
+			name:    "unpaid orders are not expected at PayPal",
+			records: []sqlwrapper.OrderRecord{order("REF-1", "", "USD", 10, 0)},
+		},
+		{
+			name:      "amount mismatch",
+			records:   []sqlwrapper.OrderRecord{order("REF-1", "CAP-1", "USD", 10, 0)},
+			txns:      []SettlementTransaction{payment("CAP-1", "", "USD", 10.01, 0)},
+			wantKinds: []DiscrepancyKind{AMOUNT_MISMATCH},
+		},
+		{
+			name:        "rounding within half a minor unit",
+			records:     []sqlwrapper.OrderRecord{order("REF-1", "CAP-1", "HUF", 1500, 0)},
+			txns:        []SettlementTransaction{payment("CAP-1", "", "HUF", 1500.4, 0)},
+			wantMatched: 1,
+		},
+		{
+			name:      "currency mismatch",
+			records:   []sqlwrapper.OrderRecord{order("REF-1", "CAP-1", "USD", 10, 0)},
+			txns:      []SettlementTransaction{payment("CAP-1", "", "EUR", 10, 0)},
+			wantKinds: []DiscrepancyKind{CURRENCY_MISMATCH},
+		},
+		{
+			name:        "refund matched",
+			records:     []sqlwrapper.OrderRecord{order("REF-1", "CAP-1", "USD", 10, 4)},
+			txns:        []SettlementTransaction{payment("CAP-1", "", "USD", 10, 0), refund("RF-1", "CAP-1", "USD", 1.5), refund("RF-2", "CAP-1", "USD", 2.5)},
+			wantMatched: 1,
+		},
+		{
+			name:        "refund mismatch",
+			records:     []sqlwrapper.OrderRecord{order("REF-1", "CAP-1", "USD", 10, 4)},
+			txns:        []SettlementTransaction{payment("CAP-1", "", "USD", 10, 0), refund("RF-1", "CAP-1", "USD", 1.5)},
+			wantMatched: 1,
+			wantKinds:   []DiscrepancyKind{AMOUNT_MISMATCH},
+		},
+		{
+			name:        "auto refunded or duplicate capture",
+			others:      map[string]otherCapture{"CAP-2": {"REF-1", "USD", 10}},
+			txns:        []SettlementTransaction{payment("CAP-2", "REF-1", "USD", 10, 0)},
+			wantMatched: 1,
+		},
+		{
+			name:      "auto refunded capture mismatch",
+			others:    map[string]otherCapture{"CAP-2": {"REF-1", "USD", 10}, "CAP-3": {"REF-2", "USD", 10}},
+			txns:      []SettlementTransaction{payment("CAP-2", "", "USD", 12, 0), payment("CAP-3", "", "EUR", 10, 0)},
+			wantKinds: []DiscrepancyKind{AMOUNT_MISMATCH, CURRENCY_MISMATCH},
+		},
+		{
+			name: "discrepancies sorted by kind",
+			records: []sqlwrapper.OrderRecord{
+				order("REF-1", "CAP-1", "USD", 10, 0),
+				order("REF-2", "CAP-2", "USD", 10, 0),
+			},
+			txns:      []SettlementTransaction{payment("CAP-2", "", "USD", 11, 0), payment("CAP-3", "", "USD", 10, 0)},
+			wantKinds: []DiscrepancyKind{MISSING_LOCALLY, MISSING_AT_PAYPAL, AMOUNT_MISMATCH},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report := reconcile(tt.records, tt.others, tt.txns)
+			if report.Matched != tt.wantMatched {
+				t.Errorf("Matched = %d, want %d", report.Matched, tt.wantMatched)
+			}
+			if len(report.Discrepancies) != len(tt.wantKinds) {
+				t.Fatalf("Discrepancies = %+v, want kinds %v", report.Discrepancies, tt.wantKinds)
+			}
+			for i, kind := range tt.wantKinds {
+				if report.Discrepancies[i].Kind != kind {
+					t.Errorf("Discrepancies[%d] = %s, want %s", i, report.Discrepancies[i].Kind, kind)
+				}
+			}
+		})
+	}
+}
+
+func TestReconcileTotals(t *testing.T) {
+	txns := []SettlementTransaction{
+		{TransactionID: "CAP-1", EventCode: "T0006", Currency: "USD", Gross: 10, Fee: 0.59},
+		{TransactionID: "CAP-2", EventCode: "T0006", Currency: "JPY", Gross: 1200, Fee: 0.85, FeeCurrency: "USD"},
+		{TransactionID: "CAP-3", EventCode: "T0006", Currency: "JPY", Gross: 800, Fee: 40},
+		{TransactionID: "RF-1", ReferenceID: "CAP-1", EventCode: "T1107", Currency: "USD", Gross: -5, Fee: -0.15},
+		{TransactionID: "WD-1", EventCode: "T0400", Currency: "USD", Gross: -100},
+	}
+	report := reconcile(nil, nil, txns)
+
+	for _, tt := range []struct {
+		name   string
+		totals map[string]float64
+		want   map[string]float64
+	}{
+		{"GrossTotals", report.GrossTotals, map[string]float64{"USD": 10, "JPY": 2000}},
+		{"FeeTotals", report.FeeTotals, map[string]float64{"USD": 0.59 + 0.85 - 0.15, "JPY": 40}},
+		{"RefundTotals", report.RefundTotals, map[string]float64{"USD": 5}},
+	} {
+		if len(tt.totals) != len(tt.want) {
+			t.Errorf("%s = %v, want %v", tt.name, tt.totals, tt.want)
+			continue
+		}
+		for currency, want := range tt.want {
+			if !sameAmount(tt.totals[currency], want, currency) {
+				t.Errorf("%s[%s] = %v, want %v", tt.name, currency, tt.totals[currency], want)
+			}
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package paypal
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/TunnelWork/Ulysses.Lib/payment"
+	"github.com/TunnelWork/payment.PayPal/v2/internal/sqlwrapper"
+	"github.com/gin-gonic/gin"
+)
+
+// RedirectCheckout() is the checkout flow without JavaScript. It creates the order on the server
+// and returns the URL the payer should be redirected to. Once approved on PayPal's site, the payer comes
+// back to the gateway's return endpoint, where the order is captured and verified like onApprove of
+// the Smart Buttons, then redirected to returnURL with a status parameter.
+func (pg *PrepaidGateway) RedirectCheckout(pr payment.PaymentRequest) (approveURL string, err error) {
+	ctx, span := pg.startSpan("paypal.RedirectCheckout", "ReferenceID", pr.Item.ReferenceID)
+	defer span.End()
+
+	pr.Item.Currency = strings.ToUpper(pr.Item.Currency)
+	pr.Item.Price, err = pg.validateAmount(pr.Item.Price, pr.Item.Currency)
+	if err != nil {
+		return "", err
+	}
+
+	ctx, err = pg.routeAccount(ctx, pr)
+	if err != nil {
+		return "", err
+	}
+	err = pg.savePending(ctx, pr)
+	if err != nil {
+		return "", err
+	}
+
+	return pg.redirectCheckout(ctx, pr)
+}
+
+// redirectCheckout() creates the order for a pending ReferenceID and saves its OrderID.
+func (pg *PrepaidGateway) redirectCheckout(ctx context.Context, pr payment.PaymentRequest) (string, error) {
+	order, approveURL, err := pg.createRedirectOrder(ctx, pr)
+	if err != nil {
+		return "", err
+	}
+
+	done := pg.observeDB(ctx, "UpdatePendingOrderID", "ReferenceID", pr.Item.ReferenceID, "OrderID", order.ID)
+	err = sqlwrapper.UpdatePendingOrderID(pg.db, pg.orderSqlTable, pr.Item.ReferenceID, order.ID)
+	done(err)
+	if err != nil {
+		return "", err
+	}
+	pg.metrics.checkoutCreated("redirect")
+	return approveURL, nil
+}
+
+// redirectPending() looks up the pending ReferenceID of a redirect checkout request, which is
+// responded to if it isn't pending.
+func (pg *PrepaidGateway) redirectPending(c *gin.Context) (context.Context, payment.PaymentRequest, bool) {
+	ctx := c.Request.Context()
+	ReferenceID := c.Param("ref_id")
+
+	done := pg.observeDB(ctx, "SelectPaymentRequest", "ReferenceID", ReferenceID)
+	pr, err := sqlwrapper.SelectPaymentRequest(pg.db, pg.orderSqlTable, ReferenceID)
+	done(err)
+	if err != nil {
+		if err == sql.ErrNoRows || err == sqlwrapper.ErrNilPointer {
+			c.JSON(http.StatusNotFound, CHECKOUT_NOT_FOUND)
+			return ctx, pr, false
+		}
+		c.JSON(http.StatusInternalServerError, SERVER_BAD_DATABASE)
+		return ctx, pr, false
+	}
+	done = pg.observeDB(ctx, "SelectCaptureID", "ReferenceID", ReferenceID)
+	captureID, err := sqlwrapper.SelectCaptureID(pg.db, pg.orderSqlTable, ReferenceID)
+	done(err)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, SERVER_BAD_DATABASE)
+		return ctx, pr, false
+	}
+	if ctx, err = pg.referenceAccount(ctx, ReferenceID); err != nil {
+		c.JSON(http.StatusInternalServerError, SERVER_BAD_DATABASE)
+		return ctx, pr, false
+	}
+	if captureID != "" {
+		pg.redirectReturn(c, ReferenceID, http.StatusConflict, PAYMENT_ALREADY_PAID)
+		return ctx, pr, false
+	}
+	return ctx, pr, true
+}
+
+type redirectPageData struct {
+	Title    string
+	Action   string
+	Amount   string
+	Currency string
+}
+
+// handlerRedirectPage serves the page starting the redirect flow for a pending ReferenceID, e.g. linked from
+// the redirect_url in render params. Only its form creates the order, so link prefetchers and crawlers can't.
+func (pg *PrepaidGateway) handlerRedirectPage(c *gin.Context) {
+	_, pr, ok := pg.redirectPending(c)
+	if !ok {
+		return
+	}
+
+	c.Header("Content-Security-Policy", "default-src 'none'")
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	c.Status(http.StatusOK)
+	checkoutTemplate.ExecuteTemplate(c.Writer, "redirect", redirectPageData{
+		Title:    "Checkout with PayPal",
+		Action:   pg.callbackURL("redirect/" + url.PathEscape(pr.Item.ReferenceID)),
+		Amount:   formatAmount(pr.Item.Price, pr.Item.Currency),
+		Currency: pr.Item.Currency,
+	})
+}
+
+// handlerRedirectCheckout creates the order for a pending ReferenceID and sends the payer to PayPal,
+// posted by the <noscript> form of the checkout page or the page of handlerRedirectPage.
+func (pg *PrepaidGateway) handlerRedirectCheckout(c *gin.Context) {
+	ctx, pr, ok := pg.redirectPending(c)
+	if !ok {
+		return
+	}
+	ReferenceID := pr.Item.ReferenceID
+
+	approveURL, err := pg.redirectCheckout(ctx, pr)
+	if err != nil {
+		if pg.UpdateHandler != nil {
+			(*pg.UpdateHandler)(
+				ReferenceID,
+				payment.PaymentResult{
+					Status: payment.UNPAID,
+					Msg:    fmt.Sprintf("(Unverified)ReferenceID %s: can't create order for redirect checkout: %s", ReferenceID, err),
+				},
+			)
+		}
+		status, resp := paypalFailure(err, http.StatusServiceUnavailable, SERVER_PAYPAL_BAD_ORDER)
+		pg.redirectReturn(c, ReferenceID, status, resp)
+		return
+	}
+
+	c.Redirect(http.StatusSeeOther, approveURL)
+}
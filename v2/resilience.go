@@ -0,0 +1,334 @@
+package paypal
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	ErrBadResilienceConfig error = errors.New("paypal: bad resilience config")
+	ErrCircuitOpen         error = errors.New("paypal: PayPal calls fail fast after repeated failures")
+)
+
+// ResilienceConfig is the "resilience" of initConf, in JSON. Zero values take the defaults.
+//
+// Reads, and writes carrying a PayPal-Request-Id, are retried with jittered exponential backoff
+// when PayPal can't be reached, times out, fails on its side or limits the rate. Every write
+// is given a PayPal-Request-Id, so a retried capture or refund is never made twice.
+//
+// After CircuitBreaker.Failures consecutive failures, PayPal calls fail fast with ErrCircuitOpen
+// for CircuitBreaker.Cooldown, then a single call is let through to see if PayPal is back.
+type ResilienceConfig struct {
+	Retry struct {
+		MaxAttempts   int    `json:"max_attempts"`    // Including the first one, 1 disables retries. Defaults to 3.
+		BaseDelay     string `json:"base_delay"`      // Doubled on every retry. Defaults to 200ms.
+		MaxDelay      string `json:"max_delay"`       // Defaults to 2s.
+		MaxRetryAfter string `json:"max_retry_after"` // A longer Retry-After is not waited for. Defaults to 10s.
+	} `json:"retry"`
+	CircuitBreaker struct {
+		Failures int    `json:"failures"` // Negative disables the circuit breaker. Defaults to 5.
+		Cooldown string `json:"cooldown"` // Defaults to 30s.
+	} `json:"circuit_breaker"`
+}
+
+type retryPolicy struct {
+	maxAttempts   int
+	baseDelay     time.Duration
+	maxDelay      time.Duration
+	maxRetryAfter time.Duration
+}
+
+// build() validates the config and fills in the defaults. The breaker is nil if disabled.
+func (c ResilienceConfig) build() (retryPolicy, *circuitBreaker, error) {
+	policy := retryPolicy{
+		maxAttempts:   c.Retry.MaxAttempts,
+		baseDelay:     200 * time.Millisecond,
+		maxDelay:      2 * time.Second,
+		maxRetryAfter: 10 * time.Second,
+	}
+	if policy.maxAttempts == 0 {
+		policy.maxAttempts = 3
+	} else if policy.maxAttempts < 0 {
+		return policy, nil, fmt.Errorf("%w: retry max_attempts %d", ErrBadResilienceConfig, c.Retry.MaxAttempts)
+	}
+	for _, d := range []struct {
+		name  string
+		value string
+		to    *time.Duration
+	}{
+		{"retry base_delay", c.Retry.BaseDelay, &policy.baseDelay},
+		{"retry max_delay", c.Retry.MaxDelay, &policy.maxDelay},
+		{"retry max_retry_after", c.Retry.MaxRetryAfter, &policy.maxRetryAfter},
+	} {
+		if err := parseConfigDuration(d.value, d.to); err != nil {
+			return policy, nil, fmt.Errorf("%w: %s %q", ErrBadResilienceConfig, d.name, d.value)
+		}
+	}
+
+	if c.CircuitBreaker.Failures < 0 {
+		return policy, nil, nil
+	}
+	breaker := &circuitBreaker{failures: c.CircuitBreaker.Failures, cooldown: 30 * time.Second}
+	if breaker.failures == 0 {
+		breaker.failures = 5
+	}
+	if err := parseConfigDuration(c.CircuitBreaker.Cooldown, &breaker.cooldown); err != nil {
+		return policy, nil, fmt.Errorf("%w: circuit_breaker cooldown %q", ErrBadResilienceConfig, c.CircuitBreaker.Cooldown)
+	}
+	return policy, breaker, nil
+}
+
+// parseConfigDuration() sets *d from s, leaving it unchanged if s is empty.
+func parseConfigDuration(s string, d *time.Duration) error {
+	if s == "" {
+		return nil
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil || parsed <= 0 {
+		return ErrBadResilienceConfig
+	}
+	*d = parsed
+	return nil
+}
+
+// backoff() is the delay before the retry following attempt, picked at random up to the exponential bound.
+func (p retryPolicy) backoff(attempt int) time.Duration {
+	bound := p.maxDelay
+	if attempt < 32 && p.baseDelay<<uint(attempt-1) < bound {
+		bound = p.baseDelay << uint(attempt-1)
+	}
+	n, err := rand.Int(rand.Reader, big.NewInt(int64(bound)+1))
+	if err != nil {
+		return bound
+	}
+	return time.Duration(n.Int64())
+}
+
+// circuitBreaker opens after failures consecutive failed calls. Once open, calls fail fast until cooldown
+// is over, then a single trial call decides whether it closes or opens again.
+// A nil *circuitBreaker lets every call through.
+type circuitBreaker struct {
+	failures int
+	cooldown time.Duration
+
+	mu          sync.Mutex
+	consecutive int
+	openUntil   time.Time // zero while closed
+	trial       bool      // a trial call is in flight
+
+	onChange func(open bool) // called with mu held
+}
+
+// allow() tells if a call may be made now.
+func (b *circuitBreaker) allow() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.openUntil.IsZero() {
+		return true
+	}
+	if b.trial || time.Now().Before(b.openUntil) {
+		return false
+	}
+	b.trial = true
+	return true
+}
+
+type callOutcome int
+
+const (
+	callSucceeded callOutcome = iota // PayPal answered, if only with a 4xx
+	callFailed                       // PayPal couldn't be reached or failed on its side
+	callNeutral                      // Says nothing of PayPal's health, e.g. canceled or rate limited
+)
+
+// record() accounts for a call let through by allow().
+func (b *circuitBreaker) record(outcome callOutcome) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	wasOpen, trial := !b.openUntil.IsZero(), b.trial
+	b.trial = false
+
+	switch outcome {
+	case callSucceeded:
+		b.consecutive = 0
+		b.openUntil = time.Time{}
+		if wasOpen && b.onChange != nil {
+			b.onChange(false)
+		}
+	case callFailed:
+		b.consecutive++
+		if trial || (!wasOpen && b.consecutive >= b.failures) {
+			b.openUntil = time.Now().Add(b.cooldown)
+			if !wasOpen && b.onChange != nil {
+				b.onChange(true)
+			}
+		}
+	}
+}
+
+// open() tells if calls are failing fast.
+func (b *circuitBreaker) open() bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !b.openUntil.IsZero()
+}
+
+// retryTransport retries requests made through next and guards them with the circuit breaker.
+// It is the outermost transport, so every attempt is timed, logged and traced on its own.
+type retryTransport struct {
+	next    http.RoundTripper
+	policy  retryPolicy
+	breaker *circuitBreaker
+	metrics *gatewayMetrics
+	log     *gatewayLogger
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// Writes are made idempotent, unless the body can't be sent twice anyway
+	replayable := req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+	if (req.Method == http.MethodPost || req.Method == http.MethodPatch) && replayable && req.Header.Get("PayPal-Request-Id") == "" {
+		req = req.Clone(req.Context()) // A RoundTripper must not modify the request
+		req.Header.Set("PayPal-Request-Id", newRequestID())
+	}
+	idempotent := req.Method == http.MethodGet || req.Method == http.MethodHead || req.Header.Get("PayPal-Request-Id") != ""
+
+	for attempt := 1; ; attempt++ {
+		if !t.breaker.allow() {
+			return nil, ErrCircuitOpen
+		}
+		resp, err := t.next.RoundTrip(req)
+		t.breaker.record(outcomeOf(req.Context(), resp, err))
+
+		reason, delay, retry := t.policy.retryable(resp, err, attempt)
+		if !retry || !idempotent || !replayable || attempt >= t.policy.maxAttempts || req.Context().Err() != nil {
+			return resp, err
+		}
+		if resp != nil {
+			io.Copy(ioutil.Discard, io.LimitReader(resp.Body, maxLoggedErrorBody))
+			resp.Body.Close()
+		}
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+
+		endpoint := endpointLabel(req.URL.Path)
+		t.metrics.retried(endpoint, reason)
+		t.log.Warn("retrying PayPal request", append(append([]interface{}{}, logFields(req.Context())...),
+			"method", req.Method, "endpoint", endpoint, "attempt", attempt, "reason", reason, "delay", delay)...)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// retryable() tells if an attempt failed in a way worth retrying, why, and how long to wait before.
+func (p retryPolicy) retryable(resp *http.Response, err error, attempt int) (reason string, delay time.Duration, ok bool) {
+	if err != nil {
+		return "error", p.backoff(attempt), true
+	}
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode == http.StatusServiceUnavailable:
+		delay = p.backoff(attempt)
+		if after, ok := retryAfter(resp.Header.Get("Retry-After")); ok {
+			if after > p.maxRetryAfter {
+				return "", 0, false
+			}
+			if after > delay {
+				delay = after
+			}
+		}
+		return strconv.Itoa(resp.StatusCode), delay, true
+	case resp.StatusCode == http.StatusRequestTimeout, resp.StatusCode >= http.StatusInternalServerError:
+		return strconv.Itoa(resp.StatusCode), p.backoff(attempt), true
+	}
+	return "", 0, false
+}
+
+// retryAfter() parses a Retry-After header, in seconds or an HTTP date.
+func retryAfter(header string) (time.Duration, bool) {
+	if header == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(header); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if at, err := http.ParseTime(header); err == nil {
+		if d := time.Until(at); d > 0 {
+			return d, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+func outcomeOf(ctx context.Context, resp *http.Response, err error) callOutcome {
+	switch {
+	case ctx.Err() != nil:
+		return callNeutral
+	case err != nil:
+		return callFailed
+	case resp.StatusCode == http.StatusTooManyRequests:
+		return callNeutral
+	case resp.StatusCode == http.StatusRequestTimeout, resp.StatusCode >= http.StatusInternalServerError:
+		return callFailed
+	}
+	return callSucceeded
+}
+
+// newRequestID() is a random PayPal-Request-Id, a version 4 UUID.
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		// Unique all the same, if not random
+		return fmt.Sprintf("%x-%d", b[:4], time.Now().UnixNano())
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	h := hex.EncodeToString(b)
+	return h[:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+}
+
+// PayPalAvailable() is false while the circuit breaker fails PayPal calls fast.
+func (pg *PrepaidGateway) PayPalAvailable() bool {
+	return !pg.breaker.open()
+}
+
+// paypalFailure() is the response to a failed PayPal call: SERVER_PAYPAL_UNAVAILABLE if PayPal is down
+// or limiting the rate, so the buyer knows to try again later, otherwise status and resp.
+func paypalFailure(err error, status int, resp gin.H) (int, gin.H) {
+	if errors.Is(err, ErrPayPalUnavailable) || errors.Is(err, ErrPayPalRateLimited) {
+		return http.StatusServiceUnavailable, SERVER_PAYPAL_UNAVAILABLE
+	}
+	return status, resp
+}
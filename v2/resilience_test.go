@@ -0,0 +1,195 @@
+package paypal
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	type step struct {
+		wait    bool        // sleep past the cooldown before
+		allowed bool        // what allow() must say
+		outcome callOutcome // recorded if allowed
+		open    bool        // what open() must say after
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"stays closed below failures", []step{
+			{allowed: true, outcome: callFailed},
+			{allowed: true, outcome: callFailed},
+			{allowed: true, outcome: callSucceeded},
+			{allowed: true, outcome: callFailed},
+			{allowed: true, outcome: callFailed},
+		}},
+		{"opens at failures and fails fast", []step{
+			{allowed: true, outcome: callFailed},
+			{allowed: true, outcome: callFailed},
+			{allowed: true, outcome: callFailed, open: true},
+			{allowed: false, open: true},
+		}},
+		{"neutral outcomes don't count", []step{
+			{allowed: true, outcome: callFailed},
+			{allowed: true, outcome: callFailed},
+			{allowed: true, outcome: callNeutral},
+			{allowed: true, outcome: callNeutral},
+		}},
+		{"successful trial closes", []step{
+			{allowed: true, outcome: callFailed},
+			{allowed: true, outcome: callFailed},
+			{allowed: true, outcome: callFailed, open: true},
+			{wait: true, allowed: true, outcome: callSucceeded},
+			{allowed: true, outcome: callFailed},
+		}},
+		{"failed trial opens again", []step{
+			{allowed: true, outcome: callFailed},
+			{allowed: true, outcome: callFailed},
+			{allowed: true, outcome: callFailed, open: true},
+			{wait: true, allowed: true, outcome: callFailed, open: true},
+			{allowed: false, open: true},
+		}},
+		{"neutral trial lets another trial through", []step{
+			{allowed: true, outcome: callFailed},
+			{allowed: true, outcome: callFailed},
+			{allowed: true, outcome: callFailed, open: true},
+			{wait: true, allowed: true, outcome: callNeutral, open: true},
+			{allowed: true, outcome: callSucceeded},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &circuitBreaker{failures: 3, cooldown: 10 * time.Millisecond}
+			var changes []bool
+			b.onChange = func(open bool) { changes = append(changes, open) }
+			wasOpen := false
+			for i, s := range tt.steps {
+				if s.wait {
+					time.Sleep(2 * b.cooldown)
+				}
+				if allowed := b.allow(); allowed != s.allowed {
+					t.Fatalf("step %d: allow() = %v, want %v", i, allowed, s.allowed)
+				}
+				if s.allowed {
+					b.record(s.outcome)
+				}
+				if open := b.open(); open != s.open {
+					t.Fatalf("step %d: open() = %v, want %v", i, open, s.open)
+				}
+				if s.open != wasOpen {
+					if len(changes) == 0 || changes[len(changes)-1] != s.open {
+						t.Fatalf("step %d: onChange(%v) not called, got %v", i, s.open, changes)
+					}
+					wasOpen = s.open
+				}
+			}
+		})
+	}
+}
+
+func TestCircuitBreakerTrialIsSingle(t *testing.T) {
+	b := &circuitBreaker{failures: 1, cooldown: time.Millisecond}
+	b.allow()
+	b.record(callFailed)
+	time.Sleep(2 * b.cooldown)
+	if !b.allow() {
+		t.Fatal("allow() = false after cooldown, want a trial")
+	}
+	if b.allow() {
+		t.Fatal("allow() = true while a trial is in flight")
+	}
+}
+
+func TestNilCircuitBreaker(t *testing.T) {
+	var b *circuitBreaker
+	b.record(callFailed)
+	if !b.allow() || b.open() {
+		t.Fatal("a nil circuitBreaker must let every call through")
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	p := retryPolicy{maxAttempts: 3, baseDelay: time.Millisecond, maxDelay: 4 * time.Millisecond, maxRetryAfter: 10 * time.Second}
+	withRetryAfter := func(status int, after string) *http.Response {
+		resp := &http.Response{StatusCode: status, Header: http.Header{}}
+		if after != "" {
+			resp.Header.Set("Retry-After", after)
+		}
+		return resp
+	}
+	tests := []struct {
+		name       string
+		resp       *http.Response
+		err        error
+		wantReason string
+		wantOK     bool
+		minDelay   time.Duration
+		maxDelay   time.Duration
+	}{
+		{"transport error", nil, errors.New("connection reset"), "error", true, 0, p.maxDelay},
+		{"200", withRetryAfter(http.StatusOK, ""), nil, "", false, 0, 0},
+		{"201", withRetryAfter(http.StatusCreated, ""), nil, "", false, 0, 0},
+		{"400", withRetryAfter(http.StatusBadRequest, ""), nil, "", false, 0, 0},
+		{"404", withRetryAfter(http.StatusNotFound, ""), nil, "", false, 0, 0},
+		{"422", withRetryAfter(http.StatusUnprocessableEntity, ""), nil, "", false, 0, 0},
+		{"408", withRetryAfter(http.StatusRequestTimeout, ""), nil, "408", true, 0, p.maxDelay},
+		{"500", withRetryAfter(http.StatusInternalServerError, ""), nil, "500", true, 0, p.maxDelay},
+		{"502", withRetryAfter(http.StatusBadGateway, ""), nil, "502", true, 0, p.maxDelay},
+		{"429", withRetryAfter(http.StatusTooManyRequests, ""), nil, "429", true, 0, p.maxDelay},
+		{"429 waits for Retry-After", withRetryAfter(http.StatusTooManyRequests, "2"), nil, "429", true, 2 * time.Second, 2 * time.Second},
+		{"503 waits for Retry-After", withRetryAfter(http.StatusServiceUnavailable, "1"), nil, "503", true, time.Second, time.Second},
+		{"Retry-After too long", withRetryAfter(http.StatusServiceUnavailable, "60"), nil, "", false, 0, 0},
+		{"bad Retry-After is backoff", withRetryAfter(http.StatusTooManyRequests, "soon"), nil, "429", true, 0, p.maxDelay},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reason, delay, ok := p.retryable(tt.resp, tt.err, 2)
+			if reason != tt.wantReason || ok != tt.wantOK {
+				t.Fatalf("retryable() = %q, %v, want %q, %v", reason, ok, tt.wantReason, tt.wantOK)
+			}
+			if delay < tt.minDelay || delay > tt.maxDelay {
+				t.Fatalf("retryable() delay = %s, want within [%s, %s]", delay, tt.minDelay, tt.maxDelay)
+			}
+		})
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		header string
+		want   time.Duration
+		wantOK bool
+	}{
+		{"", 0, false},
+		{"0", 0, true},
+		{"3", 3 * time.Second, true},
+		{"-1", 0, false},
+		{"1.5", 0, false},
+		{"later", 0, false},
+		{"Mon, 02 Jan 2006 15:04:05 GMT", 0, true}, // In the past
+	}
+	for _, tt := range tests {
+		got, ok := retryAfter(tt.header)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("retryAfter(%q) = %s, %v, want %s, %v", tt.header, got, ok, tt.want, tt.wantOK)
+		}
+	}
+
+	got, ok := retryAfter(time.Now().Add(time.Minute).UTC().Format(http.TimeFormat))
+	if !ok || got <= 58*time.Second || got > time.Minute {
+		t.Errorf("retryAfter(HTTP date in a minute) = %s, %v, want about 1m", got, ok)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	p := retryPolicy{baseDelay: 10 * time.Millisecond, maxDelay: 50 * time.Millisecond}
+	for attempt, bound := range map[int]time.Duration{1: 10 * time.Millisecond, 2: 20 * time.Millisecond, 3: 40 * time.Millisecond, 4: 50 * time.Millisecond, 40: 50 * time.Millisecond} {
+		for i := 0; i < 20; i++ {
+			if d := p.backoff(attempt); d < 0 || d > bound {
+				t.Fatalf("backoff(%d) = %s, want within [0, %s]", attempt, d, bound)
+			}
+		}
+	}
+}
@@ -0,0 +1,450 @@
+package paypal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/TunnelWork/Ulysses.Lib/payment"
+	"github.com/TunnelWork/payment.PayPal/v2/internal/sqlwrapper"
+	"github.com/gin-gonic/gin"
+)
+
+// RiskDecision is what to do with a captured payment. A more severe decision wins over a less severe one.
+type RiskDecision uint8
+
+const (
+	RiskAccept RiskDecision = iota
+	RiskHold                // Keep the money, but don't report PAID until ResolveHold()
+	RiskRefund              // Refund in full right away
+)
+
+var (
+	ErrBadRiskDecision error = errors.New("paypal: unknown risk decision")
+	ErrBadRiskRule     error = errors.New("paypal: bad risk rule")
+	ErrNotHeld         error = errors.New("paypal: payment is not held for review")
+)
+
+func (d RiskDecision) String() string {
+	switch d {
+	case RiskAccept:
+		return "accept"
+	case RiskHold:
+		return "hold"
+	case RiskRefund:
+		return "refund"
+	default:
+		return fmt.Sprintf("RiskDecision(%d)", uint8(d))
+	}
+}
+
+func (d RiskDecision) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *RiskDecision) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	switch s {
+	case "accept":
+		*d = RiskAccept
+	case "hold":
+		*d = RiskHold
+	case "refund":
+		*d = RiskRefund
+	default:
+		return ErrBadRiskDecision
+	}
+	return nil
+}
+
+// RiskPayment is a captured payment, verified against the record, to be assessed by RiskRules.
+type RiskPayment struct {
+	ReferenceID string
+	OrderID     string
+	CaptureID   string
+	Currency    string
+	Amount      float64
+	Payer       Payer
+}
+
+// RiskHistory gives RiskRules access to earlier payments. The payment being assessed is included.
+type RiskHistory interface {
+	PaymentsByPayer(payerID string, window time.Duration) (int, error)
+	PaymentsByReferencePrefix(prefix string, window time.Duration) (int, error)
+}
+
+// RiskRule assesses a payment. reason is recorded and reported along with any decision other than RiskAccept.
+type RiskRule interface {
+	Name() string
+	Assess(p RiskPayment, history RiskHistory) (decision RiskDecision, reason string, err error)
+}
+
+// RiskRecord is a recorded decision. Rule is empty for accepted payments, and "manual" for ResolveHold().
+type RiskRecord = sqlwrapper.RiskRecord
+
+// AddRiskRules() appends rules to the pipeline run on every captured payment, after the built-in ones from initConf.
+// Not safe to call while payments are being processed.
+func (pg *PrepaidGateway) AddRiskRules(rules ...RiskRule) {
+	pg.riskRules = append(pg.riskRules, rules...)
+}
+
+// RiskDecisions() lists the decisions recorded for a ReferenceID, the latest last.
+func (pg *PrepaidGateway) RiskDecisions(referenceID string) ([]RiskRecord, error) {
+	return sqlwrapper.SelectRiskDecisions(pg.db, pg.orderSqlTable, referenceID)
+}
+
+// ResolveHold() concludes the review of a held payment: it is either reported PAID, or refunded in full.
+func (pg *PrepaidGateway) ResolveHold(referenceID string, accept bool, reason string) error {
+	ctx, span := pg.startSpan("paypal.ResolveHold", "ReferenceID", referenceID)
+	defer span.End()
+
+	done := pg.observeDB(ctx, "SelectRiskDecisions", "ReferenceID", referenceID)
+	decisions, err := sqlwrapper.SelectRiskDecisions(pg.db, pg.orderSqlTable, referenceID)
+	done(err)
+	if err != nil {
+		return err
+	}
+	if len(decisions) == 0 || decisions[len(decisions)-1].Decision != RiskHold.String() {
+		return ErrNotHeld
+	}
+
+	done = pg.observeDB(ctx, "SelectPaymentRequest", "ReferenceID", referenceID)
+	pr, err := sqlwrapper.SelectPaymentRequest(pg.db, pg.orderSqlTable, referenceID)
+	done(err)
+	if err != nil {
+		return err
+	}
+
+	decision := RiskAccept
+	if !accept {
+		decision = RiskRefund
+		err = pg.refund(ctx, payment.RefundRequest{Item: pr.Item})
+		if err != nil {
+			return err
+		}
+	}
+
+	done = pg.observeDB(ctx, "InsertRiskDecision", "ReferenceID", referenceID, "decision", decision.String())
+	err = sqlwrapper.InsertRiskDecision(pg.db, pg.orderSqlTable, RiskRecord{
+		ReferenceID: referenceID,
+		Decision:    decision.String(),
+		Rule:        "manual",
+		Reason:      reason,
+	})
+	done(err)
+	if err != nil {
+		return err
+	}
+
+	if pg.UpdateHandler != nil {
+		result := payment.PaymentResult{
+			Status: payment.PAID,
+			Unit:   pr.Item,
+			Msg:    fmt.Sprintf("(Verified)ReferenceID %s: Payment accepted after review. %s", referenceID, reason),
+		}
+		if !accept {
+			result = payment.PaymentResult{
+				Status: payment.CLOSED,
+				Msg:    fmt.Sprintf("(Verified)ReferenceID %s: Payment refunded after review. %s", referenceID, reason),
+			}
+		}
+		(*pg.UpdateHandler)(referenceID, result)
+	}
+	return nil
+}
+
+// assessRisk() runs the risk rules on a verified and saved payment, acts on the decision and records it.
+// A refund failing holds the payment instead, for ResolveHold() to refund later.
+// For RiskAccept, nothing is reported so the caller reports PAID as usual.
+func (pg *PrepaidGateway) assessRisk(ctx context.Context, p RiskPayment) (RiskDecision, int, gin.H) {
+	decision, rule, reason := pg.runRiskRules(ctx, p)
+
+	var refundErr error
+	if decision == RiskRefund {
+		refundErr = pg.refund(ctx, payment.RefundRequest{Item: payment.PaymentUnit{ReferenceID: p.ReferenceID, Currency: p.Currency, Price: p.Amount}})
+		if refundErr != nil {
+			decision, reason = RiskHold, fmt.Sprintf("%s, but refund failed: %s", reason, refundErr)
+		}
+	}
+
+	done := pg.observeDB(ctx, "InsertRiskDecision", "ReferenceID", p.ReferenceID, "CaptureID", p.CaptureID, "decision", decision.String(), "rule", rule)
+	err := sqlwrapper.InsertRiskDecision(pg.db, pg.orderSqlTable, RiskRecord{
+		ReferenceID: p.ReferenceID,
+		Decision:    decision.String(),
+		Rule:        rule,
+		Reason:      reason,
+	})
+	done(err)
+	if err != nil && decision == RiskAccept {
+		// Nothing to review later, an unrecorded acceptance is harmless
+		err = nil
+	}
+	var recordMsg string
+	if err != nil {
+		recordMsg = fmt.Sprintf(" Decision not recorded: %s", err)
+	}
+
+	switch decision {
+	case RiskRefund:
+		if pg.UpdateHandler != nil {
+			(*pg.UpdateHandler)(p.ReferenceID, payment.PaymentResult{
+				Status: payment.CLOSED,
+				Msg:    fmt.Sprintf("(Verified)ReferenceID %s: Payment refunded by risk rule %s: %s%s", p.ReferenceID, rule, reason, recordMsg),
+			})
+		}
+		return RiskRefund, http.StatusForbidden, PAYMENT_REJECTED
+	case RiskHold:
+		if pg.UpdateHandler != nil {
+			msg := fmt.Sprintf("(Verified)ReferenceID %s: Payment held for review by risk rule %s: %s%s", p.ReferenceID, rule, reason, recordMsg)
+			(*pg.UpdateHandler)(p.ReferenceID, payment.PaymentResult{Status: payment.UNKNOWN, Msg: msg})
+		}
+		return RiskHold, http.StatusAccepted, PAYMENT_UNDER_REVIEW
+	}
+	return RiskAccept, http.StatusOK, PAYMENT_OK
+}
+
+// runRiskRules() returns the most severe decision and which rule made it. A rule failing holds the payment.
+func (pg *PrepaidGateway) runRiskRules(ctx context.Context, p RiskPayment) (decision RiskDecision, rule, reason string) {
+	history := riskHistory{pg, ctx}
+	for _, r := range pg.riskRules {
+		d, why, err := r.Assess(p, history)
+		if err != nil {
+			d, why = RiskHold, fmt.Sprintf("rule failed: %s", err)
+		}
+		if d > decision {
+			decision, rule, reason = d, r.Name(), why
+		}
+	}
+	return decision, rule, reason
+}
+
+type riskHistory struct {
+	pg  *PrepaidGateway
+	ctx context.Context
+}
+
+func (h riskHistory) PaymentsByPayer(payerID string, window time.Duration) (int, error) {
+	done := h.pg.observeDB(h.ctx, "CountPaidByPayer")
+	count, err := sqlwrapper.CountPaidByPayer(h.pg.db, h.pg.orderSqlTable, payerID, window)
+	done(err)
+	return count, err
+}
+
+func (h riskHistory) PaymentsByReferencePrefix(prefix string, window time.Duration) (int, error) {
+	done := h.pg.observeDB(h.ctx, "CountPaidByReferencePrefix")
+	count, err := sqlwrapper.CountPaidByReferencePrefix(h.pg.db, h.pg.orderSqlTable, prefix, window)
+	done(err)
+	return count, err
+}
+
+// PayerVelocityRule limits how many payments one PayPal account makes within Window.
+type PayerVelocityRule struct {
+	Max      int
+	Window   time.Duration
+	Decision RiskDecision
+}
+
+func (r PayerVelocityRule) Name() string { return "payer_velocity" }
+
+func (r PayerVelocityRule) Assess(p RiskPayment, history RiskHistory) (RiskDecision, string, error) {
+	if p.Payer.PayerID == "" {
+		return RiskAccept, "", nil
+	}
+	count, err := history.PaymentsByPayer(p.Payer.PayerID, r.Window)
+	if err != nil {
+		return RiskAccept, "", err
+	}
+	if count > r.Max {
+		return r.Decision, fmt.Sprintf("payer %s made %d payments within %s, max %d", p.Payer.PayerID, count, r.Window, r.Max), nil
+	}
+	return RiskAccept, "", nil
+}
+
+// ReferencePrefixVelocityRule limits how many payments are made within Window for ReferenceIDs
+// sharing the part before the first Separator, e.g. the user in "<user>-<invoice>".
+type ReferencePrefixVelocityRule struct {
+	Separator string
+	Max       int
+	Window    time.Duration
+	Decision  RiskDecision
+}
+
+func (r ReferencePrefixVelocityRule) Name() string { return "reference_prefix_velocity" }
+
+func (r ReferencePrefixVelocityRule) Assess(p RiskPayment, history RiskHistory) (RiskDecision, string, error) {
+	i := strings.Index(p.ReferenceID, r.Separator)
+	if r.Separator == "" || i <= 0 {
+		return RiskAccept, "", nil
+	}
+	prefix := p.ReferenceID[:i+len(r.Separator)]
+	count, err := history.PaymentsByReferencePrefix(prefix, r.Window)
+	if err != nil {
+		return RiskAccept, "", err
+	}
+	if count > r.Max {
+		return r.Decision, fmt.Sprintf("%d payments for %s* within %s, max %d", count, prefix, r.Window, r.Max), nil
+	}
+	return RiskAccept, "", nil
+}
+
+// CountryRule checks the payer's country against an allow list, if any, and a deny list.
+// A payer of unknown country only passes if there is no allow list.
+type CountryRule struct {
+	Allow    []string
+	Deny     []string
+	Decision RiskDecision
+}
+
+func (r CountryRule) Name() string { return "country" }
+
+func (r CountryRule) Assess(p RiskPayment, history RiskHistory) (RiskDecision, string, error) {
+	country := strings.ToUpper(p.Payer.Country)
+	for _, denied := range r.Deny {
+		if strings.EqualFold(denied, country) {
+			return r.Decision, fmt.Sprintf("payer country %s is denied", country), nil
+		}
+	}
+	if len(r.Allow) == 0 {
+		return RiskAccept, "", nil
+	}
+	for _, allowed := range r.Allow {
+		if strings.EqualFold(allowed, country) {
+			return RiskAccept, "", nil
+		}
+	}
+	return r.Decision, fmt.Sprintf("payer country %q is not allowed", country), nil
+}
+
+// EmailBlocklistRule matches the payer's email against full addresses, or domains written as "@example.com".
+type EmailBlocklistRule struct {
+	Emails   []string
+	Decision RiskDecision
+}
+
+func (r EmailBlocklistRule) Name() string { return "email_blocklist" }
+
+func (r EmailBlocklistRule) Assess(p RiskPayment, history RiskHistory) (RiskDecision, string, error) {
+	email := strings.ToLower(p.Payer.Email)
+	if email == "" {
+		return RiskAccept, "", nil
+	}
+	for _, blocked := range r.Emails {
+		blocked = strings.ToLower(blocked)
+		if email == blocked || (strings.HasPrefix(blocked, "@") && strings.HasSuffix(email, blocked)) {
+			return r.Decision, fmt.Sprintf("payer email %s is blocked by %s", email, blocked), nil
+		}
+	}
+	return RiskAccept, "", nil
+}
+
+// LargeAmountRule flags payments above a per-currency threshold. Currencies without one pass.
+type LargeAmountRule struct {
+	Thresholds map[string]float64
+	Decision   RiskDecision
+}
+
+func (r LargeAmountRule) Name() string { return "large_amount" }
+
+func (r LargeAmountRule) Assess(p RiskPayment, history RiskHistory) (RiskDecision, string, error) {
+	threshold, ok := r.Thresholds[p.Currency]
+	if ok && p.Amount > threshold {
+		return r.Decision, fmt.Sprintf("%s %s exceeds %s", formatAmount(p.Amount, p.Currency), p.Currency, formatAmount(threshold, p.Currency)), nil
+	}
+	return RiskAccept, "", nil
+}
+
+// RiskRulesConfig is the "riskRules" initConf entry in JSON, configuring the built-in rules.
+// Windows are Go durations, e.g. "24h". Rules left out are disabled. Every rule needs a "decision" of "hold" or "refund".
+type RiskRulesConfig struct {
+	PayerVelocity *struct {
+		Max      int          `json:"max"`
+		Window   string       `json:"window"`
+		Decision RiskDecision `json:"decision"`
+	} `json:"payer_velocity,omitempty"`
+	ReferencePrefixVelocity *struct {
+		Separator string       `json:"separator"`
+		Max       int          `json:"max"`
+		Window    string       `json:"window"`
+		Decision  RiskDecision `json:"decision"`
+	} `json:"reference_prefix_velocity,omitempty"`
+	Country *struct {
+		Allow    []string     `json:"allow"`
+		Deny     []string     `json:"deny"`
+		Decision RiskDecision `json:"decision"`
+	} `json:"country,omitempty"`
+	EmailBlocklist *struct {
+		Emails   []string     `json:"emails"`
+		Decision RiskDecision `json:"decision"`
+	} `json:"email_blocklist,omitempty"`
+	LargeAmount *struct {
+		Thresholds map[string]float64 `json:"thresholds"`
+		Decision   RiskDecision       `json:"decision"`
+	} `json:"large_amount,omitempty"`
+}
+
+// Rules() builds the configured built-in rules.
+func (c RiskRulesConfig) Rules() ([]RiskRule, error) {
+	var rules []RiskRule
+	if c.PayerVelocity != nil {
+		if err := checkRuleDecision("payer_velocity", c.PayerVelocity.Decision); err != nil {
+			return nil, err
+		}
+		window, err := time.ParseDuration(c.PayerVelocity.Window)
+		if err != nil || window <= 0 {
+			return nil, fmt.Errorf("%w: payer_velocity window %q", ErrBadRiskRule, c.PayerVelocity.Window)
+		}
+		rules = append(rules, PayerVelocityRule{Max: c.PayerVelocity.Max, Window: window, Decision: c.PayerVelocity.Decision})
+	}
+	if c.ReferencePrefixVelocity != nil {
+		if err := checkRuleDecision("reference_prefix_velocity", c.ReferencePrefixVelocity.Decision); err != nil {
+			return nil, err
+		}
+		window, err := time.ParseDuration(c.ReferencePrefixVelocity.Window)
+		if err != nil || window <= 0 {
+			return nil, fmt.Errorf("%w: reference_prefix_velocity window %q", ErrBadRiskRule, c.ReferencePrefixVelocity.Window)
+		}
+		if c.ReferencePrefixVelocity.Separator == "" {
+			return nil, fmt.Errorf("%w: reference_prefix_velocity has no separator", ErrBadRiskRule)
+		}
+		rules = append(rules, ReferencePrefixVelocityRule{
+			Separator: c.ReferencePrefixVelocity.Separator,
+			Max:       c.ReferencePrefixVelocity.Max,
+			Window:    window,
+			Decision:  c.ReferencePrefixVelocity.Decision,
+		})
+	}
+	if c.Country != nil {
+		if err := checkRuleDecision("country", c.Country.Decision); err != nil {
+			return nil, err
+		}
+		rules = append(rules, CountryRule{Allow: c.Country.Allow, Deny: c.Country.Deny, Decision: c.Country.Decision})
+	}
+	if c.EmailBlocklist != nil {
+		if err := checkRuleDecision("email_blocklist", c.EmailBlocklist.Decision); err != nil {
+			return nil, err
+		}
+		rules = append(rules, EmailBlocklistRule{Emails: c.EmailBlocklist.Emails, Decision: c.EmailBlocklist.Decision})
+	}
+	if c.LargeAmount != nil {
+		if err := checkRuleDecision("large_amount", c.LargeAmount.Decision); err != nil {
+			return nil, err
+		}
+		rules = append(rules, LargeAmountRule{Thresholds: c.LargeAmount.Thresholds, Decision: c.LargeAmount.Decision})
+	}
+	return rules, nil
+}
+
+// checkRuleDecision() rejects accepting, the default, as what a built-in rule decides: the rule would do nothing.
+func checkRuleDecision(name string, decision RiskDecision) error {
+	if decision == RiskAccept {
+		return fmt.Errorf("%w: %s decision must be hold or refund", ErrBadRiskRule, name)
+	}
+	return nil
+}
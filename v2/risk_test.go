@@ -0,0 +1,239 @@
+package paypal
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TunnelWork/Ulysses.Lib/payment"
+)
+
+type stubRule struct {
+	name     string
+	decision RiskDecision
+	err      error
+}
+
+func (r stubRule) Name() string { return r.name }
+
+func (r stubRule) Assess(p RiskPayment, history RiskHistory) (RiskDecision, string, error) {
+	return r.decision, r.name + " says so", r.err
+}
+
+// stubHistory counts the same payments for any payer or prefix, and remembers what it was asked.
+type stubHistory struct {
+	count  int
+	err    error
+	asked  string
+	window time.Duration
+}
+
+func (h *stubHistory) PaymentsByPayer(payerID string, window time.Duration) (int, error) {
+	h.asked, h.window = payerID, window
+	return h.count, h.err
+}
+
+func (h *stubHistory) PaymentsByReferencePrefix(prefix string, window time.Duration) (int, error) {
+	h.asked, h.window = prefix, window
+	return h.count, h.err
+}
+
+func TestRunRiskRules(t *testing.T) {
+	tests := []struct {
+		name         string
+		rules        []RiskRule
+		wantDecision RiskDecision
+		wantRule     string
+	}{
+		{"no rules", nil, RiskAccept, ""},
+		{"all accept", []RiskRule{stubRule{"a", RiskAccept, nil}, stubRule{"b", RiskAccept, nil}}, RiskAccept, ""},
+		{"hold wins over accept", []RiskRule{stubRule{"a", RiskAccept, nil}, stubRule{"b", RiskHold, nil}}, RiskHold, "b"},
+		{"refund wins over hold", []RiskRule{stubRule{"a", RiskHold, nil}, stubRule{"b", RiskRefund, nil}, stubRule{"c", RiskHold, nil}}, RiskRefund, "b"},
+		{"first of equals wins", []RiskRule{stubRule{"a", RiskHold, nil}, stubRule{"b", RiskHold, nil}}, RiskHold, "a"},
+		{"failing rule holds", []RiskRule{stubRule{"a", RiskAccept, errors.New("db down")}}, RiskHold, "a"},
+		{"failing rule loses to refund", []RiskRule{stubRule{"a", RiskAccept, errors.New("db down")}, stubRule{"b", RiskRefund, nil}}, RiskRefund, "b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pg := &PrepaidGateway{riskRules: tt.rules}
+			decision, rule, reason := pg.runRiskRules(context.Background(), RiskPayment{ReferenceID: "REF-1"})
+			if decision != tt.wantDecision || rule != tt.wantRule {
+				t.Fatalf("runRiskRules() = %s, %q, want %s, %q", decision, rule, tt.wantDecision, tt.wantRule)
+			}
+			if (decision == RiskAccept) != (reason == "") {
+				t.Fatalf("runRiskRules() reason %q for %s", reason, decision)
+			}
+		})
+	}
+}
+
+func TestAssessRisk(t *testing.T) {
+	tests := []struct {
+		name         string
+		decision     RiskDecision
+		wantDecision RiskDecision
+		wantStatus   int
+		wantResult   bool
+		wantSaved    string
+	}{
+		{"accepted", RiskAccept, RiskAccept, http.StatusOK, false, "accept"},
+		{"held", RiskHold, RiskHold, http.StatusAccepted, true, "hold"},
+		// Nothing to refund on record, so the refund fails
+		{"refund failed is held", RiskRefund, RiskHold, http.StatusAccepted, true, "hold"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var saved []string
+			db := newFakeDB(t, func(query string, args []driver.Value) ([][]driver.Value, error) {
+				if strings.Contains(query, "INSERT INTO pp_risk") {
+					saved = append(saved, args[1].(string))
+				}
+				return nil, nil
+			})
+			_, srv := newFakePayPal(t)
+			pg, results := newTestGateway(t, db, srv)
+			pg.riskRules = []RiskRule{stubRule{"stub", tt.decision, nil}}
+
+			decision, status, _ := pg.assessRisk(context.Background(), RiskPayment{ReferenceID: "REF-1", Currency: "USD", Amount: 10})
+			if decision != tt.wantDecision || status != tt.wantStatus {
+				t.Fatalf("assessRisk() = %s, %d, want %s, %d", decision, status, tt.wantDecision, tt.wantStatus)
+			}
+			if len(saved) != 1 || saved[0] != tt.wantSaved {
+				t.Fatalf("saved %v, want %s", saved, tt.wantSaved)
+			}
+			if tt.wantResult != (len(*results) == 1) || (tt.wantResult && (*results)[0].Status != payment.UNKNOWN) {
+				t.Fatalf("UpdateHandler got %+v", *results)
+			}
+		})
+	}
+}
+
+func TestBuiltInRiskRules(t *testing.T) {
+	payer := Payer{PayerID: "PAYER1", Email: "Buyer@Example.com", Country: "kp"}
+	tests := []struct {
+		name    string
+		rule    RiskRule
+		payment RiskPayment
+		history stubHistory
+		want    RiskDecision
+		wantErr bool
+	}{
+		{"payer velocity below max", PayerVelocityRule{Max: 3, Window: time.Hour, Decision: RiskHold}, RiskPayment{Payer: payer}, stubHistory{count: 3}, RiskAccept, false},
+		{"payer velocity above max", PayerVelocityRule{Max: 3, Window: time.Hour, Decision: RiskHold}, RiskPayment{Payer: payer}, stubHistory{count: 4}, RiskHold, false},
+		{"payer velocity without payer", PayerVelocityRule{Max: 0, Window: time.Hour, Decision: RiskHold}, RiskPayment{}, stubHistory{count: 4}, RiskAccept, false},
+		{"payer velocity history failed", PayerVelocityRule{Max: 3, Window: time.Hour, Decision: RiskHold}, RiskPayment{Payer: payer}, stubHistory{err: errors.New("db down")}, RiskAccept, true},
+
+		{"prefix velocity above max", ReferencePrefixVelocityRule{Separator: "-", Max: 1, Window: time.Hour, Decision: RiskRefund}, RiskPayment{ReferenceID: "user1-inv9"}, stubHistory{count: 2}, RiskRefund, false},
+		{"prefix velocity below max", ReferencePrefixVelocityRule{Separator: "-", Max: 1, Window: time.Hour, Decision: RiskRefund}, RiskPayment{ReferenceID: "user1-inv9"}, stubHistory{count: 1}, RiskAccept, false},
+		{"prefix velocity without separator", ReferencePrefixVelocityRule{Separator: "-", Max: 0, Window: time.Hour, Decision: RiskRefund}, RiskPayment{ReferenceID: "user1"}, stubHistory{count: 2}, RiskAccept, false},
+		{"prefix velocity with separator first", ReferencePrefixVelocityRule{Separator: "-", Max: 0, Window: time.Hour, Decision: RiskRefund}, RiskPayment{ReferenceID: "-inv9"}, stubHistory{count: 2}, RiskAccept, false},
+
+		{"country denied", CountryRule{Deny: []string{"KP"}, Decision: RiskRefund}, RiskPayment{Payer: payer}, stubHistory{}, RiskRefund, false},
+		{"country not denied", CountryRule{Deny: []string{"IR"}, Decision: RiskRefund}, RiskPayment{Payer: payer}, stubHistory{}, RiskAccept, false},
+		{"country allowed", CountryRule{Allow: []string{"KP"}, Decision: RiskHold}, RiskPayment{Payer: payer}, stubHistory{}, RiskAccept, false},
+		{"country not allowed", CountryRule{Allow: []string{"US"}, Decision: RiskHold}, RiskPayment{Payer: payer}, stubHistory{}, RiskHold, false},
+		{"unknown country not allowed", CountryRule{Allow: []string{"US"}, Decision: RiskHold}, RiskPayment{}, stubHistory{}, RiskHold, false},
+		{"unknown country without allow list", CountryRule{Deny: []string{"KP"}, Decision: RiskHold}, RiskPayment{}, stubHistory{}, RiskAccept, false},
+
+		{"email blocked", EmailBlocklistRule{Emails: []string{"buyer@example.com"}, Decision: RiskRefund}, RiskPayment{Payer: payer}, stubHistory{}, RiskRefund, false},
+		{"email domain blocked", EmailBlocklistRule{Emails: []string{"@EXAMPLE.com"}, Decision: RiskHold}, RiskPayment{Payer: payer}, stubHistory{}, RiskHold, false},
+		{"email domain suffix only", EmailBlocklistRule{Emails: []string{"@ample.com"}, Decision: RiskHold}, RiskPayment{Payer: payer}, stubHistory{}, RiskAccept, false},
+		{"email not blocked", EmailBlocklistRule{Emails: []string{"other@example.com"}, Decision: RiskHold}, RiskPayment{Payer: payer}, stubHistory{}, RiskAccept, false},
+		{"no email", EmailBlocklistRule{Emails: []string{"@example.com"}, Decision: RiskHold}, RiskPayment{}, stubHistory{}, RiskAccept, false},
+
+		{"amount above threshold", LargeAmountRule{Thresholds: map[string]float64{"USD": 500}, Decision: RiskHold}, RiskPayment{Currency: "USD", Amount: 500.01}, stubHistory{}, RiskHold, false},
+		{"amount at threshold", LargeAmountRule{Thresholds: map[string]float64{"USD": 500}, Decision: RiskHold}, RiskPayment{Currency: "USD", Amount: 500}, stubHistory{}, RiskAccept, false},
+		{"currency without threshold", LargeAmountRule{Thresholds: map[string]float64{"USD": 500}, Decision: RiskHold}, RiskPayment{Currency: "EUR", Amount: 5000}, stubHistory{}, RiskAccept, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decision, reason, err := tt.rule.Assess(tt.payment, &tt.history)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Assess() error = %v, want error %v", err, tt.wantErr)
+			}
+			if decision != tt.want {
+				t.Fatalf("Assess() = %s (%s), want %s", decision, reason, tt.want)
+			}
+			if decision != RiskAccept && reason == "" {
+				t.Fatalf("Assess() = %s without a reason", decision)
+			}
+		})
+	}
+}
+
+func TestRiskHistoryAsked(t *testing.T) {
+	h := &stubHistory{}
+	PayerVelocityRule{Max: 1, Window: time.Hour, Decision: RiskHold}.Assess(RiskPayment{Payer: Payer{PayerID: "PAYER1"}}, h)
+	if h.asked != "PAYER1" || h.window != time.Hour {
+		t.Errorf("PayerVelocityRule asked for %q within %s", h.asked, h.window)
+	}
+	ReferencePrefixVelocityRule{Separator: "::", Max: 1, Window: time.Minute, Decision: RiskHold}.Assess(RiskPayment{ReferenceID: "user1::inv::9"}, h)
+	if h.asked != "user1::" || h.window != time.Minute {
+		t.Errorf("ReferencePrefixVelocityRule asked for %q within %s", h.asked, h.window)
+	}
+}
+
+func TestRiskRulesConfig(t *testing.T) {
+	tests := []struct {
+		name      string
+		conf      string
+		wantRules []string
+		wantErr   error
+	}{
+		{"none", `{}`, nil, nil},
+		{"all", `{
+			"payer_velocity":{"max":3,"window":"24h","decision":"hold"},
+			"reference_prefix_velocity":{"separator":"-","max":5,"window":"1h","decision":"hold"},
+			"country":{"deny":["KP"],"decision":"refund"},
+			"email_blocklist":{"emails":["@example.com"],"decision":"refund"},
+			"large_amount":{"thresholds":{"USD":500},"decision":"hold"}
+		}`, []string{"payer_velocity", "reference_prefix_velocity", "country", "email_blocklist", "large_amount"}, nil},
+		{"bad window", `{"payer_velocity":{"max":3,"window":"a day","decision":"hold"}}`, nil, ErrBadRiskRule},
+		{"no window", `{"payer_velocity":{"max":3,"decision":"hold"}}`, nil, ErrBadRiskRule},
+		{"negative window", `{"reference_prefix_velocity":{"separator":"-","max":3,"window":"-1h","decision":"hold"}}`, nil, ErrBadRiskRule},
+		{"no separator", `{"reference_prefix_velocity":{"max":3,"window":"1h","decision":"hold"}}`, nil, ErrBadRiskRule},
+		{"no decision", `{"country":{"deny":["KP"]}}`, nil, ErrBadRiskRule},
+		{"accept decision", `{"email_blocklist":{"emails":["@example.com"],"decision":"accept"}}`, nil, ErrBadRiskRule},
+		{"no large amount decision", `{"large_amount":{"thresholds":{"USD":500}}}`, nil, ErrBadRiskRule},
+		{"unknown decision", `{"country":{"deny":["KP"],"decision":"block"}}`, nil, ErrBadRiskDecision},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var conf RiskRulesConfig
+			err := json.Unmarshal([]byte(tt.conf), &conf)
+			var rules []RiskRule
+			if err == nil {
+				rules, err = conf.Rules()
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Rules() error = %v, want %v", err, tt.wantErr)
+			}
+			if len(rules) != len(tt.wantRules) {
+				t.Fatalf("Rules() = %d rules, want %v", len(rules), tt.wantRules)
+			}
+			for i, rule := range rules {
+				if rule.Name() != tt.wantRules[i] {
+					t.Errorf("rule %d is %s, want %s", i, rule.Name(), tt.wantRules[i])
+				}
+			}
+		})
+	}
+}
+
+func TestRiskDecisionJSON(t *testing.T) {
+	for _, d := range []RiskDecision{RiskAccept, RiskHold, RiskRefund} {
+		b, err := json.Marshal(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got RiskDecision
+		if err := json.Unmarshal(b, &got); err != nil || got != d {
+			t.Errorf("%s round trips to %s, %v", d, got, err)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package paypal
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const sdkBaseURL = `https://www.paypal.com/sdk/js`
+
+// SDKOptions configures the PayPal JS SDK <script> tag.
+// Query parameters end up in the sdk_url, data-* attributes are returned separately
+// since they must be set on the <script> tag itself.
+// https://developer.paypal.com/sdk/js/configuration/
+type SDKOptions struct {
+	// Query parameters
+	Components     []string `json:"components,omitempty"`      // e.g. buttons, card-fields, messages
+	EnableFunding  []string `json:"enable_funding,omitempty"`  // e.g. venmo, paylater
+	DisableFunding []string `json:"disable_funding,omitempty"` // e.g. card, credit
+	Intent         string   `json:"intent,omitempty"`          // capture (default) or authorize
+	Commit         *bool    `json:"commit,omitempty"`
+	Vault          *bool    `json:"vault,omitempty"`
+	Locale         string   `json:"locale,omitempty"`        // e.g. en_US
+	BuyerCountry   string   `json:"buyer_country,omitempty"` // sandbox only
+	MerchantID     string   `json:"merchant_id,omitempty"`
+	Debug          bool     `json:"debug,omitempty"`
+
+	// data-* attributes
+	PartnerAttributionID string `json:"partner_attribution_id,omitempty"`
+	CSPNonce             string `json:"csp_nonce,omitempty"`
+	ClientToken          string `json:"client_token,omitempty"`
+	PageType             string `json:"page_type,omitempty"`
+}
+
+// Merge() returns a copy of the options with every field set in override replacing the original.
+func (o SDKOptions) Merge(override SDKOptions) SDKOptions {
+	if override.Components != nil {
+		o.Components = override.Components
+	}
+	if override.EnableFunding != nil {
+		o.EnableFunding = override.EnableFunding
+	}
+	if override.DisableFunding != nil {
+		o.DisableFunding = override.DisableFunding
+	}
+	if override.Intent != "" {
+		o.Intent = override.Intent
+	}
+	if override.Commit != nil {
+		o.Commit = override.Commit
+	}
+	if override.Vault != nil {
+		o.Vault = override.Vault
+	}
+	if override.Locale != "" {
+		o.Locale = override.Locale
+	}
+	if override.BuyerCountry != "" {
+		o.BuyerCountry = override.BuyerCountry
+	}
+	if override.MerchantID != "" {
+		o.MerchantID = override.MerchantID
+	}
+	if override.Debug {
+		o.Debug = true
+	}
+	if override.PartnerAttributionID != "" {
+		o.PartnerAttributionID = override.PartnerAttributionID
+	}
+	if override.CSPNonce != "" {
+		o.CSPNonce = override.CSPNonce
+	}
+	if override.ClientToken != "" {
+		o.ClientToken = override.ClientToken
+	}
+	if override.PageType != "" {
+		o.PageType = override.PageType
+	}
+	return o
+}
+
+// URL() builds the src of the SDK <script> tag.
+func (o SDKOptions) URL(clientID, currency string) string {
+	query := url.Values{}
+	query.Set("client-id", clientID)
+	query.Set("currency", currency)
+	if len(o.Components) > 0 {
+		query.Set("components", strings.Join(o.Components, ","))
+	}
+	if len(o.EnableFunding) > 0 {
+		query.Set("enable-funding", strings.Join(o.EnableFunding, ","))
+	}
+	if len(o.DisableFunding) > 0 {
+		query.Set("disable-funding", strings.Join(o.DisableFunding, ","))
+	}
+	if o.Intent != "" {
+		query.Set("intent", o.Intent)
+	}
+	if o.Commit != nil {
+		query.Set("commit", strconv.FormatBool(*o.Commit))
+	}
+	if o.Vault != nil {
+		query.Set("vault", strconv.FormatBool(*o.Vault))
+	}
+	if o.Locale != "" {
+		query.Set("locale", o.Locale)
+	}
+	if o.BuyerCountry != "" {
+		query.Set("buyer-country", o.BuyerCountry)
+	}
+	if o.MerchantID != "" {
+		query.Set("merchant-id", o.MerchantID)
+	}
+	if o.Debug {
+		query.Set("debug", "true")
+	}
+	return sdkBaseURL + "?" + query.Encode()
+}
+
+// Attributes() are the data-* attributes to be set on the SDK <script> tag, unset ones left out.
+func (o SDKOptions) Attributes() map[string]string {
+	attrs := map[string]string{}
+	if o.PartnerAttributionID != "" {
+		attrs["data-partner-attribution-id"] = o.PartnerAttributionID
+	}
+	if o.CSPNonce != "" {
+		attrs["data-csp-nonce"] = o.CSPNonce
+	}
+	if o.ClientToken != "" {
+		attrs["data-client-token"] = o.ClientToken
+	}
+	if o.PageType != "" {
+		attrs["data-page-type"] = o.PageType
+	}
+	return attrs
+}
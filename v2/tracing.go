@@ -0,0 +1,164 @@
+package paypal
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/TunnelWork/payment.PayPal/v2"
+
+// Span attribute keys of the log fields, others become paypal.<lowercase key>
+var spanAttributeKeys = map[string]string{
+	"ReferenceID":    "paypal.reference_id",
+	"OrderID":        "paypal.order_id",
+	"CaptureID":      "paypal.capture_id",
+	"RefundID":       "paypal.refund_id",
+	"CustomerID":     "paypal.customer_id",
+	"PaymentTokenID": "paypal.payment_token_id",
+}
+
+// newTracer() is the gateway's tracer from tp, or from the global TracerProvider if tp is nil.
+func newTracer(tp trace.TracerProvider) trace.Tracer {
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	return tp.Tracer(tracerName)
+}
+
+// spanAttributes() turns log fields, e.g. "ReferenceID", ReferenceID, into span attributes. Secrets are redacted.
+func spanAttributes(keysAndValues ...interface{}) []attribute.KeyValue {
+	attrs := make([]attribute.KeyValue, 0, len(keysAndValues)/2)
+	for i := 0; i+1 < len(keysAndValues); i += 2 {
+		key := fmt.Sprint(keysAndValues[i])
+		name, ok := spanAttributeKeys[key]
+		if !ok {
+			name = "paypal." + strings.ToLower(key)
+		}
+		switch value := redact(key, keysAndValues[i+1]).(type) {
+		case string:
+			attrs = append(attrs, attribute.String(name, value))
+		case int:
+			attrs = append(attrs, attribute.Int(name, value))
+		case bool:
+			attrs = append(attrs, attribute.Bool(name, value))
+		default:
+			attrs = append(attrs, attribute.String(name, fmt.Sprint(value)))
+		}
+	}
+	return attrs
+}
+
+// startSpan() starts a span for a method called by Ulysses, which has no context to continue.
+func (pg *PrepaidGateway) startSpan(name string, keysAndValues ...interface{}) (context.Context, trace.Span) {
+	return pg.tracer.Start(context.Background(), name, trace.WithAttributes(spanAttributes(keysAndValues...)...))
+}
+
+// traced() runs a callback handler in a server span, continuing the trace propagated by the caller if any.
+// The handler's PayPal and database calls are made under c.Request.Context().
+func (pg *PrepaidGateway) traced(name string, handler gin.HandlerFunc) func(*gin.Context) {
+	return func(c *gin.Context) {
+		ctx := otel.GetTextMapPropagator().Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+		ctx, span := pg.tracer.Start(ctx, name,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.method", c.Request.Method),
+				attribute.String("http.route", c.FullPath()),
+				attribute.String("paypal.instance", pg.instanceID),
+			),
+		)
+		defer span.End()
+		c.Request = c.Request.WithContext(ctx)
+
+		handler(c)
+
+		// Handlers finding the ReferenceID by OrderID set it themselves
+		if ReferenceID := c.Param("ref_id"); ReferenceID != "" {
+			span.SetAttributes(attribute.String("paypal.reference_id", ReferenceID))
+		} else if ReferenceID := c.PostForm("ref_id"); ReferenceID != "" {
+			span.SetAttributes(attribute.String("paypal.reference_id", ReferenceID))
+		}
+		status := c.Writer.Status()
+		span.SetAttributes(attribute.Int("http.status_code", status))
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+	}
+}
+
+// setSpanReferenceID() adds the ReferenceID to the current span, once a handler knows it.
+func setSpanReferenceID(ctx context.Context, ReferenceID string) {
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("paypal.reference_id", ReferenceID))
+}
+
+// traceTransport() traces every request to PayPal made through next as a client span.
+// No trace context is sent to PayPal.
+func traceTransport(tracer trace.Tracer, next http.RoundTripper) http.RoundTripper {
+	return &tracingTransport{next: next, tracer: tracer}
+}
+
+type tracingTransport struct {
+	next   http.RoundTripper
+	tracer trace.Tracer
+}
+
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	fields := logFields(req.Context())
+	fields = append(append([]interface{}{}, fields...), pathIDs(req.URL.Path, fields)...)
+	endpoint := endpointLabel(req.URL.Path)
+
+	ctx, span := t.tracer.Start(req.Context(), fmt.Sprintf("PayPal %s %s", req.Method, endpoint),
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(spanAttributes(fields...)...),
+		trace.WithAttributes(
+			attribute.String("http.method", req.Method),
+			attribute.String("http.host", req.URL.Host),
+			attribute.String("http.target", endpoint),
+		),
+	)
+	defer span.End()
+
+	resp, err := t.next.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return resp, err
+	}
+	span.SetAttributes(
+		attribute.Int("http.status_code", resp.StatusCode),
+		attribute.String("paypal.debug_id", resp.Header.Get("Paypal-Debug-Id")),
+	)
+	if resp.StatusCode >= http.StatusBadRequest {
+		span.SetStatus(codes.Error, http.StatusText(resp.StatusCode))
+	}
+	return resp, nil
+}
+
+// traceDB() starts a client span for a database operation, the returned func ends it.
+func (pg *PrepaidGateway) traceDB(ctx context.Context, op string, keysAndValues ...interface{}) func(error) {
+	_, span := pg.tracer.Start(ctx, "sqlwrapper."+op,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(spanAttributes(keysAndValues...)...),
+		trace.WithAttributes(
+			attribute.String("db.system", "mysql"),
+			attribute.String("db.operation", op),
+			attribute.String("db.sql.table", pg.orderSqlTable),
+		),
+	)
+	return func(err error) {
+		if err != nil && err != sql.ErrNoRows {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}
+}
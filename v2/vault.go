@@ -0,0 +1,415 @@
+package paypal
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/TunnelWork/Ulysses.Lib/payment"
+	"github.com/TunnelWork/payment.PayPal/v2/internal/sqlwrapper"
+	pp "github.com/plutov/paypal/v4"
+)
+
+var (
+	ErrNoCustomerID         error = errors.New("paypal: customer ID is required")
+	ErrNoSavedPaymentMethod error = errors.New("paypal: customer has no saved payment method")
+	ErrChargeSavedFailed    error = errors.New("paypal: charging saved payment method failed")
+)
+
+// SavedPaymentMethod is a PayPal wallet or card saved in PayPal Vault for one of our customers.
+type SavedPaymentMethod = sqlwrapper.VaultRecord
+
+// sourceOrder is a v2 order with the payment_source, which pp.Order doesn't have.
+type sourceOrder struct {
+	ID            string `json:"id"`
+	Status        string `json:"status"`
+	PaymentSource *struct {
+		PayPal *struct {
+			EmailAddress string           `json:"email_address"`
+			Attributes   *vaultAttributes `json:"attributes,omitempty"`
+		} `json:"paypal,omitempty"`
+		Card *struct {
+			Brand                string                `json:"brand"`
+			LastDigits           string                `json:"last_digits"`
+			Attributes           *vaultAttributes      `json:"attributes,omitempty"`
+			AuthenticationResult *authenticationResult `json:"authentication_result,omitempty"`
+		} `json:"card,omitempty"`
+	} `json:"payment_source,omitempty"`
+	PurchaseUnits []pp.PurchaseUnit `json:"purchase_units,omitempty"`
+	Links         []pp.Link         `json:"links,omitempty"`
+}
+
+type vaultAttributes struct {
+	Vault *struct {
+		ID       string `json:"id"`
+		Status   string `json:"status"`
+		Customer *struct {
+			ID string `json:"id"`
+		} `json:"customer,omitempty"`
+	} `json:"vault,omitempty"`
+}
+
+// VaultCheckout() is RedirectCheckout() saving the payer's PayPal account in PayPal Vault for customerID
+// once the payment is captured, so later payments can be made with ChargeSaved().
+func (pg *PrepaidGateway) VaultCheckout(customerID string, pr payment.PaymentRequest) (approveURL string, err error) {
+	ctx, span := pg.startSpan("paypal.VaultCheckout", "ReferenceID", pr.Item.ReferenceID, "CustomerID", customerID)
+	defer span.End()
+
+	if customerID == "" {
+		return "", ErrNoCustomerID
+	}
+
+	pr.Item.Currency = strings.ToUpper(pr.Item.Currency)
+	pr.Item.Price, err = pg.validateAmount(pr.Item.Price, pr.Item.Currency)
+	if err != nil {
+		return "", err
+	}
+
+	ctx, err = pg.routeAccount(ctx, pr)
+	if err != nil {
+		return "", err
+	}
+	err = pg.savePending(ctx, pr)
+	if err != nil {
+		return "", err
+	}
+
+	paypalSource := map[string]interface{}{
+		"experience_context": map[string]interface{}{
+			"user_action": pp.UserActionPayNow,
+			"return_url":  pg.callbackURL("return"),
+			"cancel_url":  pg.callbackURL("cancel"),
+		},
+		"attributes": vaultRequestAttributes(pg.paypalCustomerID(ctx, customerID)),
+	}
+	order, err := pg.createOrderWithSource(ctx, pr, "", map[string]interface{}{"paypal": paypalSource})
+	if err != nil {
+		return "", err
+	}
+
+	approveURL = approveLink(&pp.Order{Links: order.Links})
+	if approveURL == "" {
+		return "", ErrNoApproveLink
+	}
+
+	done := pg.observeDB(ctx, "UpdateVaultPending", "ReferenceID", pr.Item.ReferenceID, "OrderID", order.ID, "CustomerID", customerID)
+	err = sqlwrapper.UpdateVaultPending(pg.db, pg.orderSqlTable, pr.Item.ReferenceID, order.ID, customerID)
+	done(err)
+	if err != nil {
+		return "", err
+	}
+	pg.metrics.checkoutCreated("vault")
+	return approveURL, nil
+}
+
+// VaultCheckoutForm() is CheckoutFormWithSDKOptions() saving the card paid with in the card fields in
+// PayPal Vault for customerID once the payment is captured, so later payments can be made with ChargeSaved().
+// ErrNoCardFields is returned if the SDK options don't load the card fields. Payments made with the
+// PayPal buttons of the form aren't saved, see VaultCheckout() for those.
+func (pg *PrepaidGateway) VaultCheckoutForm(customerID string, pr payment.PaymentRequest, opts SDKOptions) (formRenderParams map[string]interface{}, err error) {
+	ctx, span := pg.startSpan("paypal.VaultCheckoutForm", "ReferenceID", pr.Item.ReferenceID, "CustomerID", customerID)
+	defer span.End()
+
+	if customerID == "" {
+		return nil, ErrNoCustomerID
+	}
+	sdkOptions := pg.sdkOptions.Merge(opts)
+	if !cardFieldsEnabled(sdkOptions) {
+		return nil, ErrNoCardFields
+	}
+
+	pr.Item.Currency = strings.ToUpper(pr.Item.Currency)
+	pr.Item.Price, err = pg.validateAmount(pr.Item.Price, pr.Item.Currency)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, err = pg.routeAccount(ctx, pr)
+	if err != nil {
+		return nil, err
+	}
+	err = pg.savePending(ctx, pr)
+	if err != nil {
+		return nil, err
+	}
+
+	// No order yet, handlerCardCreateOrder() creates it asking PayPal to save the card
+	done := pg.observeDB(ctx, "UpdateVaultPending", "ReferenceID", pr.Item.ReferenceID, "CustomerID", customerID)
+	err = sqlwrapper.UpdateVaultPending(pg.db, pg.orderSqlTable, pr.Item.ReferenceID, "", customerID)
+	done(err)
+	if err != nil {
+		return nil, err
+	}
+
+	formRenderParams, err = pg.renderParams(ctx, pr, sdkOptions)
+	if err == nil {
+		pg.metrics.checkoutCreated("smart_buttons")
+	}
+	return formRenderParams, err
+}
+
+// ChargeSaved() charges the latest payment method of customerID, saved with the merchant account the request
+// is routed to, without the buyer present.
+// The order is created and captured at once, then verified and reported to UpdateHandler like any other payment.
+func (pg *PrepaidGateway) ChargeSaved(customerID string, pr payment.PaymentRequest) error {
+	ctx, span := pg.startSpan("paypal.ChargeSaved", "ReferenceID", pr.Item.ReferenceID, "CustomerID", customerID)
+	defer span.End()
+
+	if customerID == "" {
+		return ErrNoCustomerID
+	}
+
+	var err error
+	pr.Item.Currency = strings.ToUpper(pr.Item.Currency)
+	pr.Item.Price, err = pg.validateAmount(pr.Item.Price, pr.Item.Currency)
+	if err != nil {
+		return err
+	}
+
+	// Payment tokens only work with the merchant account they were saved with
+	ctx, err = pg.routeAccount(ctx, pr)
+	if err != nil {
+		return err
+	}
+	token, err := pg.latestVaultToken(ctx, customerID)
+	if err != nil {
+		return err
+	}
+
+	err = pg.savePending(ctx, pr)
+	if err != nil {
+		return err
+	}
+
+	// Each charge has its own PayPal-Request-Id, retried with the same one so it never captures twice.
+	// Reusing the ReferenceID alone would get the order of the first charge back after a decline.
+	done := pg.observeDB(ctx, "UpdateChargeAttempt", "ReferenceID", pr.Item.ReferenceID)
+	attempt, err := sqlwrapper.NextChargeAttempt(pg.db, pg.orderSqlTable, pr.Item.ReferenceID)
+	done(err)
+	if err == sqlwrapper.ErrAlreadyPaid {
+		return ErrAlreadyPaid
+	}
+	if err != nil {
+		return err
+	}
+	requestID := fmt.Sprintf("%s-%d", pr.Item.ReferenceID, attempt)
+
+	order, err := pg.createOrderWithSource(ctx, pr, requestID, map[string]interface{}{
+		token.Source: map[string]interface{}{"vault_id": token.PaymentTokenID},
+	})
+	if err != nil {
+		return err
+	}
+	pg.metrics.checkoutCreated("saved_payment_method")
+
+	done = pg.observeDB(ctx, "UpdatePendingOrderID", "ReferenceID", pr.Item.ReferenceID, "OrderID", order.ID)
+	err = sqlwrapper.UpdatePendingOrderID(pg.db, pg.orderSqlTable, pr.Item.ReferenceID, order.ID)
+	done(err)
+	if err != nil {
+		return err
+	}
+
+	captureID := sourceOrderCaptureID(order)
+	if captureID == "" {
+		captureID, err = pg.captureOrder(ctx, order.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	status, resp := pg._verifyApproval(context.WithValue(ctx, savedChargeKey{}, true), order.ID, pr.Item.ReferenceID, captureID)
+	if status != http.StatusOK {
+		return fmt.Errorf("%w: ReferenceID %s: %v", ErrChargeSavedFailed, pr.Item.ReferenceID, resp["message"])
+	}
+	return nil
+}
+
+// SavedPaymentMethods() lists the payment methods saved for customerID, the latest first.
+func (pg *PrepaidGateway) SavedPaymentMethods(customerID string) ([]SavedPaymentMethod, error) {
+	return sqlwrapper.SelectVaultTokens(pg.db, pg.orderSqlTable, customerID)
+}
+
+// DeleteSavedPaymentMethod() deletes a payment token of customerID from PayPal Vault and the database.
+func (pg *PrepaidGateway) DeleteSavedPaymentMethod(customerID, paymentTokenID string) error {
+	ctx, span := pg.startSpan("paypal.DeleteSavedPaymentMethod", "CustomerID", customerID, "PaymentTokenID", paymentTokenID)
+	defer span.End()
+
+	done := pg.observeDB(ctx, "SelectVaultTokens", "CustomerID", customerID)
+	tokens, err := sqlwrapper.SelectVaultTokens(pg.db, pg.orderSqlTable, customerID)
+	done(err)
+	if err != nil {
+		return err
+	}
+	var found bool
+	for _, token := range tokens {
+		if token.PaymentTokenID == paymentTokenID {
+			found = true
+			// Deleted from the merchant account it was saved with
+			account, err := pg.accountNamed(token.Account)
+			if err != nil {
+				return err
+			}
+			ctx = withAccount(ctx, account)
+			break
+		}
+	}
+	if !found {
+		return ErrNoSavedPaymentMethod
+	}
+
+	req, err := pg.client(ctx).NewRequest(ctx, http.MethodDelete, fmt.Sprintf("%s/v3/vault/payment-tokens/%s", pg.client(ctx).APIBase, paymentTokenID), nil)
+	if err != nil {
+		return err
+	}
+	err = apiError(pg.client(ctx).SendWithAuth(req, nil))
+	// Already gone at PayPal, still delete it here
+	if err != nil && !errors.Is(err, ErrPayPalResourceNotFound) {
+		return err
+	}
+
+	done = pg.observeDB(ctx, "DeleteVaultToken", "CustomerID", customerID, "PaymentTokenID", paymentTokenID)
+	err = sqlwrapper.DeleteVaultToken(pg.db, pg.orderSqlTable, customerID, paymentTokenID)
+	done(err)
+	if err == sql.ErrNoRows {
+		return ErrNoSavedPaymentMethod
+	}
+	return err
+}
+
+// createOrderWithSource() creates an order with the given payment_source, which pp.CreateOrder() can't send.
+func (pg *PrepaidGateway) createOrderWithSource(ctx context.Context, pr payment.PaymentRequest, requestID string, paymentSource map[string]interface{}) (*sourceOrder, error) {
+	order := &sourceOrder{}
+
+	req, err := pg.client(ctx).NewRequest(withLogFields(ctx, "ReferenceID", pr.Item.ReferenceID), http.MethodPost, fmt.Sprintf("%s/v2/checkout/orders", pg.client(ctx).APIBase), map[string]interface{}{
+		"intent": pp.OrderIntentCapture,
+		"purchase_units": []pp.PurchaseUnitRequest{
+			{
+				ReferenceID: pr.Item.ReferenceID,
+				Amount: &pp.PurchaseUnitAmount{
+					Currency: pr.Item.Currency,
+					Value:    formatAmount(pr.Item.Price, pr.Item.Currency),
+				},
+			},
+		},
+		"payment_source": paymentSource,
+	})
+	if err != nil {
+		return order, err
+	}
+	if requestID != "" {
+		req.Header.Set("PayPal-Request-Id", requestID)
+	}
+	req.Header.Set("Prefer", "return=representation")
+
+	err = pg.client(ctx).SendWithAuth(req, order)
+	return order, apiError(err)
+}
+
+// getOrderWithSource() is pp.Client.GetOrder() keeping the payment_source.
+func (pg *PrepaidGateway) getOrderWithSource(ctx context.Context, orderID string) (*sourceOrder, error) {
+	order := &sourceOrder{}
+
+	req, err := pg.client(ctx).NewRequest(ctx, http.MethodGet, fmt.Sprintf("%s/v2/checkout/orders/%s", pg.client(ctx).APIBase, orderID), nil)
+	if err != nil {
+		return order, err
+	}
+
+	err = pg.client(ctx).SendWithAuth(req, order)
+	return order, apiError(err)
+}
+
+// vaultRequestAttributes() asks PayPal to save the payment method once the order is captured,
+// under the existing PayPal customer if there is one.
+func vaultRequestAttributes(paypalCustomerID string) map[string]interface{} {
+	attributes := map[string]interface{}{
+		"vault": map[string]interface{}{
+			"store_in_vault": "ON_SUCCESS",
+			"usage_type":     "MERCHANT",
+			"customer_type":  "CONSUMER",
+		},
+	}
+	if paypalCustomerID != "" {
+		attributes["customer"] = map[string]interface{}{"id": paypalCustomerID}
+	}
+	return attributes
+}
+
+// paypalCustomerID() is the PayPal customer all payment methods of customerID are saved under
+// with the merchant account of ctx, if any yet.
+func (pg *PrepaidGateway) paypalCustomerID(ctx context.Context, customerID string) string {
+	done := pg.observeDB(ctx, "SelectVaultTokens", "CustomerID", customerID)
+	tokens, err := sqlwrapper.SelectVaultTokens(pg.db, pg.orderSqlTable, customerID)
+	done(err)
+	if err != nil {
+		return ""
+	}
+	for _, token := range tokens {
+		if token.PayPalCustomerID != "" && token.Account == pg.account(ctx).name {
+			return token.PayPalCustomerID
+		}
+	}
+	return ""
+}
+
+// latestVaultToken() is the latest payment method of customerID saved with the merchant account of ctx.
+func (pg *PrepaidGateway) latestVaultToken(ctx context.Context, customerID string) (SavedPaymentMethod, error) {
+	done := pg.observeDB(ctx, "SelectVaultTokens", "CustomerID", customerID)
+	tokens, err := sqlwrapper.SelectVaultTokens(pg.db, pg.orderSqlTable, customerID)
+	done(err)
+	if err != nil {
+		return SavedPaymentMethod{}, err
+	}
+	for _, token := range tokens {
+		if token.Account == pg.account(ctx).name {
+			return token, nil
+		}
+	}
+	return SavedPaymentMethod{}, ErrNoSavedPaymentMethod
+}
+
+// saveVaultToken() looks up the payment token PayPal created for a captured order and saves it for customerID.
+func (pg *PrepaidGateway) saveVaultToken(ctx context.Context, customerID, orderID string) (SavedPaymentMethod, error) {
+	order, err := pg.getOrderWithSource(ctx, orderID)
+	if err != nil {
+		return SavedPaymentMethod{}, err
+	}
+
+	token := SavedPaymentMethod{CustomerID: customerID, Account: pg.account(ctx).name}
+	var attributes *vaultAttributes
+	if order.PaymentSource != nil && order.PaymentSource.PayPal != nil {
+		token.Source = "paypal"
+		token.Description = order.PaymentSource.PayPal.EmailAddress
+		attributes = order.PaymentSource.PayPal.Attributes
+	} else if order.PaymentSource != nil && order.PaymentSource.Card != nil {
+		token.Source = "card"
+		token.Description = strings.TrimSpace(order.PaymentSource.Card.Brand + " " + order.PaymentSource.Card.LastDigits)
+		attributes = order.PaymentSource.Card.Attributes
+	}
+	if attributes == nil || attributes.Vault == nil || attributes.Vault.ID == "" {
+		return SavedPaymentMethod{}, fmt.Errorf("%w: order %s has no vaulted payment token", ErrPayPalUnexpectedResponse, orderID)
+	}
+	token.PaymentTokenID = attributes.Vault.ID
+	if attributes.Vault.Customer != nil {
+		token.PayPalCustomerID = attributes.Vault.Customer.ID
+	}
+
+	done := pg.observeDB(ctx, "InsertVaultToken", "CustomerID", customerID, "OrderID", orderID)
+	err = sqlwrapper.InsertVaultToken(pg.db, pg.orderSqlTable, token)
+	done(err)
+	return token, err
+}
+
+func sourceOrderCaptureID(order *sourceOrder) string {
+	if order.Status != "COMPLETED" {
+		return ""
+	}
+	for _, unit := range order.PurchaseUnits {
+		if unit.Payments != nil && len(unit.Payments.Captures) > 0 {
+			return unit.Payments.Captures[0].ID
+		}
+	}
+	return ""
+}
@@ -0,0 +1,306 @@
+package paypal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+
+	"github.com/TunnelWork/payment.PayPal/v2/internal/sqlwrapper"
+	"github.com/gin-gonic/gin"
+	pp "github.com/plutov/paypal/v4"
+)
+
+var ErrWebhooksNotConfigured error = errors.New("paypal: webhooks not configured")
+
+// WebhookConfig is the "webhooks" of initConf, in JSON. Webhooks are only subscribed to if set, e.g. to {}.
+//
+// At startup, and when the credentials of a merchant account are rotated to another PayPal app, the gateway
+// makes sure PayPal sends EventTypes to callbackBase + "/paypal/<instanceID>/webhook", or ".../webhook/<account>"
+// for merchant accounts besides the default one: the subscription with that URL is created if missing, and
+// updated if its event types differ. Its webhook ID is saved, to verify the signature of the events received.
+type WebhookConfig struct {
+	EventTypes []string `json:"event_types"` // Defaults to DefaultWebhookEventTypes
+}
+
+// DefaultWebhookEventTypes are the events of the orders and captures the gateway makes.
+var DefaultWebhookEventTypes = []string{
+	"CHECKOUT.ORDER.APPROVED",
+	"PAYMENT.CAPTURE.COMPLETED",
+	"PAYMENT.CAPTURE.DENIED",
+	"PAYMENT.CAPTURE.PENDING",
+	"PAYMENT.CAPTURE.REFUNDED",
+	"PAYMENT.CAPTURE.REVERSED",
+}
+
+// build() fills in the defaults, and sorts the event types to compare them with PayPal's.
+func (c WebhookConfig) build() []string {
+	eventTypes := c.EventTypes
+	if len(eventTypes) == 0 {
+		eventTypes = DefaultWebhookEventTypes
+	}
+	eventTypes = append([]string{}, eventTypes...)
+	sort.Strings(eventTypes)
+	return eventTypes
+}
+
+// webhookURL() is where PayPal sends the events of a merchant account.
+func (pg *PrepaidGateway) webhookURL(account string) string {
+	if account == "" {
+		return pg.callbackURL("webhook")
+	}
+	return pg.callbackURL("webhook/" + url.PathEscape(account))
+}
+
+// loadWebhooks() sets the webhook IDs saved, so events can be verified before the subscriptions are synced.
+// A subscription saved for another PayPal app than the one in use is left out.
+func (pg *PrepaidGateway) loadWebhooks(ctx context.Context) error {
+	done := pg.observeDB(ctx, "SelectWebhooks")
+	records, err := sqlwrapper.SelectWebhooks(pg.db, pg.orderSqlTable)
+	done(err)
+	if err != nil {
+		return err
+	}
+	for _, record := range records {
+		account, ok := pg.accounts[record.Account]
+		if ok && record.ClientID == account.current().ClientID && record.URL == pg.webhookURL(record.Account) {
+			account.webhookSubscribed(record.WebhookID, record.URL)
+		}
+	}
+	return nil
+}
+
+// SyncWebhooks() creates or updates the webhook subscription of every merchant account, as done at startup.
+// Failures are reported by Health(); the first one is returned.
+func (pg *PrepaidGateway) SyncWebhooks() error {
+	ctx, span := pg.startSpan("paypal.SyncWebhooks")
+	defer span.End()
+
+	if pg.webhookEventTypes == nil {
+		return ErrWebhooksNotConfigured
+	}
+	var firstErr error
+	for _, name := range pg.accountNames() {
+		account := pg.accounts[name]
+		if err := pg.syncWebhook(withAccount(ctx, account), account); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("account %q: %w", name, err)
+		}
+	}
+	return firstErr
+}
+
+// syncWebhook() makes sure the PayPal app of account sends the event types to the webhook URL of account.
+func (pg *PrepaidGateway) syncWebhook(ctx context.Context, account *merchantAccount) error {
+	webhookURL := pg.webhookURL(account.name)
+	c := account.current()
+
+	webhookID, action, err := pg.subscribeWebhook(ctx, c, webhookURL)
+	if err == nil {
+		done := pg.observeDB(ctx, "InsertWebhook", "WebhookID", webhookID)
+		err = sqlwrapper.InsertWebhook(pg.db, pg.orderSqlTable, sqlwrapper.WebhookRecord{
+			Account:    account.name,
+			ClientID:   c.ClientID,
+			WebhookID:  webhookID,
+			URL:        webhookURL,
+			EventTypes: pg.webhookEventTypes,
+		})
+		done(err)
+	}
+	if err != nil {
+		account.webhookFailed(err)
+		pg.log.Error("webhook subscription failed", append(append([]interface{}{}, logFields(ctx)...), "url", webhookURL, "error", err)...)
+		return err
+	}
+
+	account.webhookSubscribed(webhookID, webhookURL)
+	log := pg.log.Debug
+	if action != "unchanged" {
+		log = pg.log.Info
+	}
+	log("webhook subscription "+action, append(append([]interface{}{}, logFields(ctx)...), "url", webhookURL, "WebhookID", webhookID)...)
+	return nil
+}
+
+// subscribeWebhook() looks up the subscription of webhookURL, creating or updating it as needed.
+// Tells whether it was created, updated or unchanged.
+func (pg *PrepaidGateway) subscribeWebhook(ctx context.Context, c *pp.Client, webhookURL string) (webhookID, action string, err error) {
+	eventTypes := make([]pp.WebhookEventType, 0, len(pg.webhookEventTypes))
+	for _, name := range pg.webhookEventTypes {
+		eventTypes = append(eventTypes, pp.WebhookEventType{Name: name})
+	}
+
+	webhooks, err := c.ListWebhooks(ctx, pp.AncorTypeApplication)
+	if err != nil {
+		return "", "", apiError(err)
+	}
+	for _, webhook := range webhooks.Webhooks {
+		if webhook.URL != webhookURL {
+			continue
+		}
+		if sameEventTypes(webhook.EventTypes, pg.webhookEventTypes) {
+			return webhook.ID, "unchanged", nil
+		}
+		_, err = c.UpdateWebhook(ctx, webhook.ID, []pp.WebhookField{{Operation: "replace", Path: "/event_types", Value: eventTypes}})
+		return webhook.ID, "updated", apiError(err)
+	}
+
+	webhook, err := c.CreateWebhook(ctx, &pp.CreateWebhookRequest{URL: webhookURL, EventTypes: eventTypes})
+	if err != nil {
+		return "", "", apiError(err)
+	}
+	return webhook.ID, "created", nil
+}
+
+// sameEventTypes() compares the event types of a subscription with the sorted ones wanted.
+func sameEventTypes(subscribed []pp.WebhookEventType, want []string) bool {
+	if len(subscribed) != len(want) {
+		return false
+	}
+	names := make([]string, 0, len(subscribed))
+	for _, eventType := range subscribed {
+		names = append(names, eventType.Name)
+	}
+	sort.Strings(names)
+	for i := range names {
+		if names[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// handlerWebhook() receives the events PayPal sends to the webhook of a merchant account, and has PayPal verify
+// their signature. A PAYMENT.CAPTURE.COMPLETED event finalizes the payment as the buyer's browser would, so a
+// capture the buyer never came back from is verified and assessed by the risk rules too. Others are only logged.
+func (pg *PrepaidGateway) handlerWebhook(c *gin.Context) {
+	ctx := c.Request.Context()
+	account, err := pg.accountNamed(c.Param("account"))
+	if err != nil {
+		pg.respondCallback(c, "webhook", http.StatusNotFound, BAD_REQUEST)
+		return
+	}
+	ctx = withAccount(ctx, account)
+
+	webhookID := account.webhook()
+	if webhookID == "" {
+		// PayPal sends it again later, hopefully once subscribed
+		pg.respondCallback(c, "webhook", http.StatusServiceUnavailable, WEBHOOK_NOT_SUBSCRIBED)
+		return
+	}
+
+	// Kept for logging the event, VerifyWebhookSignature() reads it too
+	body, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		pg.respondCallback(c, "webhook", http.StatusBadRequest, BAD_REQUEST)
+		return
+	}
+	c.Request.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	verification, err := pg.client(ctx).VerifyWebhookSignature(ctx, c.Request, webhookID)
+	if err != nil {
+		status, resp := paypalFailure(apiError(err), http.StatusInternalServerError, SERVER_PAYPAL_BAD_AUTH)
+		pg.respondCallback(c, "webhook", status, resp)
+		return
+	}
+	var event struct {
+		ID           string          `json:"id"`
+		EventType    string          `json:"event_type"`
+		ResourceType string          `json:"resource_type"`
+		Resource     json.RawMessage `json:"resource"`
+	}
+	json.Unmarshal(body, &event)
+	if verification.VerificationStatus != "SUCCESS" {
+		pg.log.Warn("webhook event signature not verified", append(append([]interface{}{}, logFields(ctx)...),
+			"eventID", event.ID, "eventType", event.EventType, "ip", c.ClientIP(), "verification", verification.VerificationStatus)...)
+		pg.respondCallback(c, "webhook", http.StatusUnauthorized, WEBHOOK_NOT_VERIFIED)
+		return
+	}
+
+	pg.log.Info("webhook event received", append(append([]interface{}{}, logFields(ctx)...),
+		"eventID", event.ID, "eventType", event.EventType, "resourceType", event.ResourceType)...)
+	if event.EventType == "PAYMENT.CAPTURE.COMPLETED" {
+		// PayPal sends it again later if it can't be finalized now
+		if status, resp := pg.webhookCaptureCompleted(ctx, event.Resource); status >= http.StatusInternalServerError {
+			pg.respondCallback(c, "webhook", status, resp)
+			return
+		}
+	}
+	pg.respondCallback(c, "webhook", http.StatusOK, WEBHOOK_RECEIVED)
+}
+
+// webhookCaptureCompleted() finalizes the payment of a capture as _onApprove() does. A capture finalized
+// already, by the buyer's browser or an earlier delivery of the event, is not news.
+func (pg *PrepaidGateway) webhookCaptureCompleted(ctx context.Context, resource json.RawMessage) (int, gin.H) {
+	var capture struct {
+		ID                string `json:"id"`
+		SupplementaryData struct {
+			RelatedIDs struct {
+				OrderID string `json:"order_id"`
+			} `json:"related_ids"`
+		} `json:"supplementary_data"`
+	}
+	if err := json.Unmarshal(resource, &capture); err != nil || capture.ID == "" || capture.SupplementaryData.RelatedIDs.OrderID == "" {
+		pg.log.Warn("webhook capture without an order", append(append([]interface{}{}, logFields(ctx)...), "CaptureID", capture.ID)...)
+		return http.StatusBadRequest, BAD_REQUEST
+	}
+	OrderID := capture.SupplementaryData.RelatedIDs.OrderID
+
+	// The ReferenceID, hence the record, is known from the order
+	order, err := pg.client(ctx).GetOrder(ctx, OrderID)
+	if err != nil {
+		return paypalFailure(apiError(err), http.StatusInternalServerError, SERVER_PAYPAL_BAD_ORDER)
+	}
+	if len(order.PurchaseUnits) != 1 {
+		return http.StatusBadRequest, SERVER_PAYPAL_BAD_ORDER
+	}
+	status, resp := pg._verifyApproval(ctx, OrderID, order.PurchaseUnits[0].ReferenceID, capture.ID)
+	pg.log.Info("webhook capture finalized", append(append([]interface{}{}, logFields(ctx)...),
+		"ReferenceID", order.PurchaseUnits[0].ReferenceID, "OrderID", OrderID, "CaptureID", capture.ID, "status", status)...)
+	return status, resp
+}
+
+// webhook() is the ID of the webhook subscription, empty if not subscribed.
+func (ma *merchantAccount) webhook() string {
+	ma.mu.RLock()
+	defer ma.mu.RUnlock()
+	return ma.webhookID
+}
+
+func (ma *merchantAccount) webhookSubscribed(webhookID, webhookURL string) {
+	ma.mu.Lock()
+	defer ma.mu.Unlock()
+	ma.webhookID, ma.webhookURL, ma.webhookErr = webhookID, webhookURL, nil
+}
+
+func (ma *merchantAccount) webhookFailed(err error) {
+	ma.mu.Lock()
+	defer ma.mu.Unlock()
+	ma.webhookErr = err
+}
+
+// forgetWebhook() drops the subscription of the PayPal app rotated from.
+func (ma *merchantAccount) forgetWebhook() {
+	ma.mu.Lock()
+	defer ma.mu.Unlock()
+	ma.webhookID, ma.webhookURL = "", ""
+}
+
+// webhookHealth() reports the subscription of account, with ma.mu held.
+func (pg *PrepaidGateway) webhookHealth(ma *merchantAccount) WebhookHealth {
+	wh := WebhookHealth{Status: "not_configured"}
+	if pg.webhookEventTypes == nil {
+		return wh
+	}
+	wh.Status, wh.WebhookID, wh.URL = "pending", ma.webhookID, ma.webhookURL
+	if ma.webhookErr != nil {
+		wh.Status, wh.Error = "failing", ma.webhookErr.Error()
+	} else if ma.webhookID != "" {
+		wh.Status = "subscribed"
+	}
+	return wh
+}